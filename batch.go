@@ -0,0 +1,106 @@
+package cafs
+
+import (
+	"fmt"
+)
+
+// Batcher is implemented by Filestores that can operate on many keys more
+// efficiently than one at a time. Results are in the same order as inputs.
+// When some operations in a batch fail the error is a *BatchError, and
+// results for successful operations are still returned
+type Batcher interface {
+	// PutMany adds files to the store, returning their keys
+	PutMany(files []File, pin bool) (keys []string, err error)
+	// GetMany gets files from the store. failed gets have a nil File
+	GetMany(keys []string) ([]File, error)
+	// HasMany reports whether the store has each key
+	HasMany(keys []string) (exists []bool, err error)
+	// DeleteMany removes keys from the store
+	DeleteMany(keys []string) error
+}
+
+// BatchError reports failures within a batch operation
+type BatchError struct {
+	// Errs has an entry for each input to the batch, nil for operations that
+	// succeeded
+	Errs []error
+}
+
+// NewBatchError creates an error from per-operation errors, returning nil if
+// all errs are nil
+func NewBatchError(errs []error) error {
+	if firstError(errs) == nil {
+		return nil
+	}
+	return &BatchError{Errs: errs}
+}
+
+// Error implements the error interface
+func (e *BatchError) Error() string {
+	failed := 0
+	for _, err := range e.Errs {
+		if err != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d operations failed: %s", failed, len(e.Errs), e.Unwrap())
+}
+
+// Unwrap returns the first error in the batch, so errors.Is & errors.As
+// compare against it
+func (e *BatchError) Unwrap() error { return firstError(e.Errs) }
+
+// PutMany adds files to a store, using the store's Batcher implementation if
+// it has one
+func PutMany(fs Filestore, files []File, pin bool) ([]string, error) {
+	if b, ok := fs.(Batcher); ok {
+		return b.PutMany(files, pin)
+	}
+	keys := make([]string, len(files))
+	errs := make([]error, len(files))
+	for i, f := range files {
+		keys[i], errs[i] = fs.Put(f, pin)
+	}
+	return keys, NewBatchError(errs)
+}
+
+// GetMany gets files from a store, using the store's Batcher implementation
+// if it has one
+func GetMany(fs Filestore, keys []string) ([]File, error) {
+	if b, ok := fs.(Batcher); ok {
+		return b.GetMany(keys)
+	}
+	files := make([]File, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		files[i], errs[i] = fs.Get(key)
+	}
+	return files, NewBatchError(errs)
+}
+
+// HasMany checks a store for keys, using the store's Batcher implementation
+// if it has one
+func HasMany(fs Filestore, keys []string) ([]bool, error) {
+	if b, ok := fs.(Batcher); ok {
+		return b.HasMany(keys)
+	}
+	exists := make([]bool, len(keys))
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		exists[i], errs[i] = fs.Has(key)
+	}
+	return exists, NewBatchError(errs)
+}
+
+// DeleteMany removes keys from a store, using the store's Batcher
+// implementation if it has one
+func DeleteMany(fs Filestore, keys []string) error {
+	if b, ok := fs.(Batcher); ok {
+		return b.DeleteMany(keys)
+	}
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = fs.Delete(key)
+	}
+	return NewBatchError(errs)
+}
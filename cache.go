@@ -0,0 +1,450 @@
+package cafs
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// CacheConfig configures a Cache
+type CacheConfig struct {
+	// MaxSize is the number of content bytes the fast store may hold before
+	// least-recently used content is evicted. 0 means no limit
+	MaxSize int64
+	// WriteBack defers writing to the slow store until content is evicted or
+	// Flush is called. Keys for unwritten content are computed with the slow
+	// store's Hasher implementation, write back requires one
+	WriteBack bool
+}
+
+// CacheOption is a function that adjusts cache configuration
+type CacheOption func(cfg *CacheConfig)
+
+// OptCacheMaxSize sets the number of bytes a cache will hold
+func OptCacheMaxSize(size int64) CacheOption {
+	return func(cfg *CacheConfig) {
+		cfg.MaxSize = size
+	}
+}
+
+// OptCacheWriteBack configures a cache to defer writes to the slow store
+func OptCacheWriteBack(cfg *CacheConfig) {
+	cfg.WriteBack = true
+}
+
+// Cache is a Filestore that keeps content from a slow store in a fast one.
+// Keys are always keys of the slow store. Content is read through the cache,
+// and written through or back to the slow store depending on configuration.
+//
+// Cache implements Fetcher, Pinner & Hasher by forwarding to the slow store,
+// returning ErrNotSupported if the slow store doesn't implement them.
+// Adders write directly to the slow store
+type Cache struct {
+	cfg  *CacheConfig
+	fast Filestore
+	slow Filestore
+
+	lk      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	// refs counts entries referring to each fast store node. distinct keys
+	// can resolve to the same content, eg: /ipfs/QmA/b.txt & /ipfs/QmB, and
+	// trees can share files
+	refs map[string]int
+}
+
+// cacheEntry maps a key in the slow store to a key in the fast store
+type cacheEntry struct {
+	key     string
+	fastKey string
+	// nodes is the fast store key of every file & directory in the entry's
+	// tree, so evicting a directory removes its children as well
+	nodes []string
+	size  int64
+	// dirty entries haven't been written to the slow store
+	dirty bool
+	pin   bool
+}
+
+var (
+	_ Filestore = (*Cache)(nil)
+	_ Fetcher   = (*Cache)(nil)
+	_ Pinner    = (*Cache)(nil)
+	_ Hasher    = (*Cache)(nil)
+	_ Closer    = (*Cache)(nil)
+)
+
+// NewCache creates a cache with fast in front of slow
+func NewCache(fast, slow Filestore, opts ...CacheOption) (*Cache, error) {
+	cfg := &CacheConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	if cfg.WriteBack {
+		if _, ok := slow.(Hasher); !ok {
+			return nil, fmt.Errorf("write back caching requires a slow store that implements Hasher")
+		}
+	}
+
+	return &Cache{
+		cfg:     cfg,
+		fast:    fast,
+		slow:    slow,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+		refs:    map[string]int{},
+	}, nil
+}
+
+// PathPrefix returns the prefix of the slow store
+func (c *Cache) PathPrefix() string {
+	return c.slow.PathPrefix()
+}
+
+// Put adds a file to both stores
+func (c *Cache) Put(file File, pin bool) (key string, err error) {
+	fastKey, nodes, size, err := c.putFast(file)
+	if err != nil {
+		return "", err
+	}
+	cached, err := c.fast.Get(fastKey)
+	if err == nil {
+		if c.cfg.WriteBack {
+			key, _, err = HashFile(c.slow.(Hasher), cached)
+		} else {
+			key, err = c.slow.Put(cached, pin)
+		}
+	}
+	if err != nil {
+		c.discard(nodes)
+		return "", err
+	}
+
+	if err := c.add(&cacheEntry{
+		key:     key,
+		fastKey: fastKey,
+		nodes:   nodes,
+		size:    size,
+		dirty:   c.cfg.WriteBack,
+		pin:     pin,
+	}); err != nil {
+		return "", err
+	}
+	if err := c.evict(); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Get reads a file from the fast store, falling back to the slow store &
+// caching the result on a miss
+func (c *Cache) Get(key string) (File, error) {
+	return c.readThrough(key, c.slow.Get)
+}
+
+// Fetch is like Get, but uses the slow store's Fetch method on cache misses
+func (c *Cache) Fetch(source Source, key string) (File, error) {
+	return c.readThrough(key, func(key string) (File, error) {
+		return fetch(c.slow, source, key)
+	})
+}
+
+func (c *Cache) readThrough(key string, get func(key string) (File, error)) (File, error) {
+	if e := c.touch(key); e != nil {
+		if f, err := c.fast.Get(e.fastKey); err == nil {
+			return f, nil
+		}
+		// content has gone missing from the fast store, drop the entry if it's
+		// safe to and read from the slow store. removing the rest of the
+		// entry's content is best-effort, the read doesn't depend on it
+		if !e.dirty {
+			_, unused := c.remove(key)
+			c.deleteFast(unused)
+		}
+	}
+
+	f, err := get(key)
+	if err != nil {
+		return nil, err
+	}
+	fastKey, nodes, size, err := c.putFast(f)
+	if err != nil {
+		return nil, err
+	}
+	if f, err = c.fast.Get(fastKey); err != nil {
+		c.discard(nodes)
+		return nil, err
+	}
+
+	if err := c.add(&cacheEntry{key: key, fastKey: fastKey, nodes: nodes, size: size}); err != nil {
+		return nil, err
+	}
+	if err := c.evict(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// putFast adds a file to the fast store, returning its key, the keys of every
+// node in its tree & the number of content bytes added
+func (c *Cache) putFast(file File) (fastKey string, nodes []string, size int64, err error) {
+	adder, err := c.fast.NewAdder(false, false)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	fastKey, added, err := addAll(adder, newCountingFile(file, &size))
+	if err != nil {
+		return "", nil, 0, err
+	}
+	nodes = make([]string, len(added))
+	for i, a := range added {
+		nodes[i] = a.Path
+	}
+	return fastKey, nodes, size, nil
+}
+
+// discard removes nodes added to the fast store by a failed operation, unless
+// entries use them
+func (c *Cache) discard(nodes []string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	unused := make([]string, 0, len(nodes))
+	for _, key := range nodes {
+		if c.refs[key] == 0 {
+			unused = append(unused, key)
+		}
+	}
+	// the operation has already failed, its error is the one that matters
+	c.deleteFast(unused)
+}
+
+// deleteFast removes nodes from the fast store, returning the first error
+func (c *Cache) deleteFast(nodes []string) (err error) {
+	for _, key := range nodes {
+		if e := c.fast.Delete(key); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Has checks the cache, then the slow store for a key
+func (c *Cache) Has(key string) (exists bool, err error) {
+	if e := c.touch(key); e != nil {
+		return true, nil
+	}
+	return c.slow.Has(key)
+}
+
+// Delete removes a key from both stores
+func (c *Cache) Delete(key string) error {
+	e, unused := c.remove(key)
+	if e != nil {
+		if err := c.deleteFast(unused); err != nil {
+			return err
+		}
+		if e.dirty {
+			// content never made it to the slow store
+			return nil
+		}
+	}
+	return c.slow.Delete(key)
+}
+
+// NewAdder returns an adder for the slow store
+func (c *Cache) NewAdder(pin, wrap bool) (Adder, error) {
+	return c.slow.NewAdder(pin, wrap)
+}
+
+// NewHashAdder returns a hash adder for the slow store
+func (c *Cache) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := c.slow.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return h.NewHashAdder(wrap)
+}
+
+// Pin pins a key in the slow store, writing cached content first if needed
+func (c *Cache) Pin(key string, recursive bool) error {
+	if err := c.flush(key); err != nil {
+		return err
+	}
+	return pin(c.slow, key, recursive)
+}
+
+// Unpin unpins a key in the slow store
+func (c *Cache) Unpin(key string, recursive bool) error {
+	if err := c.flush(key); err != nil {
+		return err
+	}
+	return unpin(c.slow, key, recursive)
+}
+
+// Close writes unwritten content to the slow store, then closes both stores
+func (c *Cache) Close() error {
+	if err := c.Flush(); err != nil {
+		return err
+	}
+	return closeAll(c.fast, c.slow)
+}
+
+// Flush writes all content that's only in the fast store to the slow store
+func (c *Cache) Flush() error {
+	c.lk.Lock()
+	keys := make([]string, 0, len(c.entries))
+	for key, el := range c.entries {
+		if el.Value.(*cacheEntry).dirty {
+			keys = append(keys, key)
+		}
+	}
+	c.lk.Unlock()
+
+	for _, key := range keys {
+		if err := c.flush(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flush writes a single cached key to the slow store if it's dirty
+func (c *Cache) flush(key string) error {
+	c.lk.Lock()
+	el, ok := c.entries[key]
+	if !ok || !el.Value.(*cacheEntry).dirty {
+		c.lk.Unlock()
+		return nil
+	}
+	e := *el.Value.(*cacheEntry)
+	c.lk.Unlock()
+
+	if err := c.writeBack(&e); err != nil {
+		return err
+	}
+
+	c.lk.Lock()
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*cacheEntry).dirty = false
+	}
+	c.lk.Unlock()
+	return nil
+}
+
+// writeBack copies an entry from the fast store to the slow store
+func (c *Cache) writeBack(e *cacheEntry) error {
+	f, err := c.fast.Get(e.fastKey)
+	if err != nil {
+		return err
+	}
+	key, err := c.slow.Put(f, e.pin)
+	if err != nil {
+		return err
+	}
+	if key != e.key {
+		return NewKeyError("flush", e.key, fmt.Errorf("slow store wrote content to a different key: %s", key))
+	}
+	return nil
+}
+
+// add places an entry at the front of the cache, removing content an entry
+// it replaces no longer shares with other entries
+func (c *Cache) add(e *cacheEntry) error {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	for _, key := range e.nodes {
+		c.refs[key]++
+	}
+	c.size += e.size
+
+	el, ok := c.entries[e.key]
+	if !ok {
+		c.entries[e.key] = c.lru.PushFront(e)
+		return nil
+	}
+	prev := el.Value.(*cacheEntry)
+	c.size -= prev.size
+	// never lose track of unwritten content
+	e.dirty = e.dirty || prev.dirty
+	e.pin = e.pin || prev.pin
+	el.Value = e
+	c.lru.MoveToFront(el)
+	return c.deleteFast(c.release(prev.nodes))
+}
+
+// release drops references to fast store nodes, returning nodes that are no
+// longer used. callers must hold the lock
+func (c *Cache) release(nodes []string) (unused []string) {
+	for _, key := range nodes {
+		c.refs[key]--
+		if c.refs[key] <= 0 {
+			delete(c.refs, key)
+			unused = append(unused, key)
+		}
+	}
+	return unused
+}
+
+// touch marks an entry as recently used, returning a copy of it if it exists
+func (c *Cache) touch(key string) *cacheEntry {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	e := *el.Value.(*cacheEntry)
+	return &e
+}
+
+// remove drops an entry from the cache index, returning it if it existed, and
+// the fast store nodes no other entries use
+func (c *Cache) remove(key string) (e *cacheEntry, unused []string) {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e = el.Value.(*cacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, key)
+	c.size -= e.size
+	return e, c.release(e.nodes)
+}
+
+// evict removes least-recently used content until the cache fits within
+// MaxSize, writing back unwritten content first
+func (c *Cache) evict() error {
+	if c.cfg.MaxSize <= 0 {
+		return nil
+	}
+
+	for {
+		c.lk.Lock()
+		back := c.lru.Back()
+		if c.size <= c.cfg.MaxSize || back == nil {
+			c.lk.Unlock()
+			return nil
+		}
+		e := *back.Value.(*cacheEntry)
+		c.lk.Unlock()
+
+		if e.dirty {
+			if err := c.flush(e.key); err != nil {
+				return err
+			}
+		}
+		if _, unused := c.remove(e.key); len(unused) > 0 {
+			if err := c.deleteFast(unused); err != nil {
+				return err
+			}
+		}
+	}
+}
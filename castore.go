@@ -6,12 +6,10 @@
 package cafs
 
 import (
-	"errors"
-)
-
-var (
-	// ErrNotFound is the canonical error for not finding a value
-	ErrNotFound = errors.New("cafs: path not found")
+	"context"
+	"fmt"
+	"io"
+	"time"
 )
 
 // Filestore is an interface for working with a content-addressed file system.
@@ -34,6 +32,8 @@ type Filestore interface {
 	// In some contexts, it may be much cheaper only to check for existence of
 	// a value, rather than retrieving the value itself. (e.g. HTTP HEAD).
 	// The default implementation is found in `GetBackedHas`.
+	// Has only checks content stored locally, and must not use the network.
+	// See Locator for checking availability on a network
 	Has(key string) (exists bool, err error)
 
 	// Delete removes the value for given `key`.
@@ -61,6 +61,81 @@ type Fetcher interface {
 	Fetch(source Source, key string) (File, error)
 }
 
+// Locator is implemented by Filestores that can check content availability on
+// a network. Filestore.Has only reports what's stored locally
+type Locator interface {
+	// Locate finds up to max sources on the network that can provide key.
+	// Sources can be passed to Fetch
+	Locate(ctx context.Context, key string, max int) ([]Source, error)
+	// Provide announces to the network that this store can provide key
+	Provide(ctx context.Context, key string) error
+}
+
+// Hasher is the interface for computing the keys files would be stored under
+// without writing anything to the store. filestores can opt into the hasher
+// interface
+type Hasher interface {
+	// NewHashAdder is like NewAdder, but no content is stored. Hash adders
+	// report added files exactly as a regular adder would, including
+	// the keys of every node in the file tree
+	NewHashAdder(wrap bool) (Adder, error)
+}
+
+// Closer is implemented by Filestores that hold resources like network
+// connections, background goroutines or repo locks. Close releases them, and
+// the store must not be used afterward. Stores that wrap other stores close
+// the stores they wrap
+type Closer interface {
+	Close() error
+}
+
+// Close closes a store if it implements Closer
+func Close(fs Filestore) error {
+	if c, ok := fs.(Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// HashFile computes the key file would be stored under without writing to
+// the store. nodes has an entry for each file & directory in the tree, with
+// the root last
+func HashFile(h Hasher, file File) (key string, nodes []AddedFile, err error) {
+	adder, err := h.NewHashAdder(false)
+	if err != nil {
+		return "", nil, err
+	}
+	return addAll(adder, file)
+}
+
+// addAll adds file with adder & closes it, returning the root key & every
+// node the adder reported, with the root last
+func addAll(adder Adder, file File) (key string, nodes []AddedFile, err error) {
+	done := make(chan struct{})
+	go func() {
+		for added := range adder.Added() {
+			nodes = append(nodes, added)
+		}
+		close(done)
+	}()
+
+	if err = adder.AddFile(file); err != nil {
+		adder.Close()
+		<-done
+		return "", nil, err
+	}
+	if err = adder.Close(); err != nil {
+		<-done
+		return "", nil, err
+	}
+	<-done
+
+	if len(nodes) == 0 {
+		return "", nil, fmt.Errorf("adder didn't report any files")
+	}
+	return nodes[len(nodes)-1].Path, nodes, nil
+}
+
 // Source identifies where a file should come from.
 // examples of different sources could be an HTTP url or P2P node Identifier
 type Source interface {
@@ -77,13 +152,50 @@ func (s source) Address() string { return string(s) }
 var (
 	// SourceAny specifies that content can come from anywhere
 	SourceAny = source("any")
+	// SourceLocal specifies that content must already be in the store.
+	// Fetching from SourceLocal never uses the network, and fails with
+	// ErrNotFound when content is missing
+	SourceLocal = source("local")
 )
 
+// NewSource creates a Source from an address. Stores interpret addresses in
+// their own way, eg: IPFS accepts peer IDs & multiaddrs
+func NewSource(addr string) Source {
+	return source(addr)
+}
+
+// TimeoutSource is a Source that limits how long a fetch may take
+type TimeoutSource interface {
+	Source
+	Timeout() time.Duration
+}
+
+// timeoutSource is an internal implementation of TimeoutSource
+type timeoutSource struct {
+	Source
+	timeout time.Duration
+}
+
+func (s timeoutSource) Timeout() time.Duration { return s.timeout }
+
+// Unwrap returns the source the timeout applies to
+func (s timeoutSource) Unwrap() Source { return s.Source }
+
+// SourceWithTimeout limits how long fetching from s may take. Fetchers
+// return ErrTimeout when the limit is exceeded. Fetchers that don't support
+// timeouts ignore the limit
+func SourceWithTimeout(s Source, timeout time.Duration) TimeoutSource {
+	return timeoutSource{Source: s, timeout: timeout}
+}
+
 // Pinner interface for content stores that support
 // the concept of pinning (originated by IPFS).
-// Necessarily asynchronous, with no stateful guarantees, currently not testable.
+// Pinners that can report what's pinned implement PinTracker
 type Pinner interface {
+	// Pin marks key as pinned. Implementations may return ErrAlreadyPinned if
+	// key is already pinned
 	Pin(key string, recursive bool) error
+	// Unpin removes the pin on key, returning ErrNotPinned if it isn't pinned
 	Unpin(key string, recursive bool) error
 }
 
@@ -124,11 +236,10 @@ func Walk(root File, depth int, visit func(f File, depth int) error) (err error)
 		for {
 			f, err := root.NextFile()
 			if err != nil {
-				if err.Error() == "EOF" {
+				if err == io.EOF {
 					break
-				} else {
-					return err
 				}
+				return err
 			}
 
 			if err := Walk(f, depth+1, visit); err != nil {
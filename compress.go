@@ -0,0 +1,428 @@
+package cafs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// CompressionNone marks content stored without compression
+	CompressionNone byte = iota
+	// CompressionGzip marks gzip-compressed content
+	CompressionGzip
+	// CompressionZstd marks zstd-compressed content. cafs doesn't bundle an
+	// implementation, use RegisterCompressor to make one available
+	CompressionZstd
+)
+
+// compressedMagic prefixes content written by a CompressedStore, followed by
+// a single byte identifying the Compressor
+var compressedMagic = []byte("cfz\x01")
+
+// Compressor is a compression algorithm
+type Compressor interface {
+	// ID is written to stored content to identify the compressor that wrote it
+	ID() byte
+	// Compress returns a writer that compresses to w
+	Compress(w io.Writer) (io.WriteCloser, error)
+	// Decompress returns a reader that decompresses from r
+	Decompress(r io.Reader) (io.Reader, error)
+}
+
+var (
+	compressorsLk sync.RWMutex
+	compressors   = map[byte]Compressor{
+		CompressionGzip: GzipCompressor{Level: gzip.DefaultCompression},
+	}
+)
+
+// RegisterCompressor makes a compressor available for reading & writing,
+// replacing any existing registration for its ID
+func RegisterCompressor(c Compressor) {
+	compressorsLk.Lock()
+	defer compressorsLk.Unlock()
+	compressors[c.ID()] = c
+}
+
+func compressor(id byte) (Compressor, error) {
+	compressorsLk.RLock()
+	defer compressorsLk.RUnlock()
+	c, ok := compressors[id]
+	if !ok {
+		return nil, fmt.Errorf("unsupported compressor: %d", id)
+	}
+	return c, nil
+}
+
+// GzipCompressor compresses with gzip at a given level
+type GzipCompressor struct {
+	Level int
+}
+
+// ID returns CompressionGzip
+func (GzipCompressor) ID() byte { return CompressionGzip }
+
+// Compress returns a gzip writer. gzip headers are left empty so the same
+// content always compresses to the same bytes
+func (c GzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.Level)
+}
+
+// Decompress returns a gzip reader
+func (GzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// compressedFormats are leading bytes of formats that are already compressed
+var compressedFormats = [][]byte{
+	{0x1f, 0x8b},                            // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},                // zstd
+	{'P', 'K', 0x03, 0x04},                  // zip
+	{'B', 'Z', 'h'},                         // bzip2
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},        // xz
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},      // 7z
+	{0x89, 'P', 'N', 'G'},                   // png
+	{0xff, 0xd8, 0xff},                      // jpeg
+	{'G', 'I', 'F', '8'},                    // gif
+	{0x00, 0x00, 0x00, 0x18, 'f', 't', 'y'}, // mp4
+	{'P', 'A', 'R', '1'},                    // parquet
+}
+
+// CompressConfig configures a CompressedStore
+type CompressConfig struct {
+	// Compressor compresses new content, defaults to gzip
+	Compressor Compressor
+	// MinSize is the smallest file in bytes that will be compressed
+	MinSize int
+	// SkipExts lists file extensions, including the leading ".", of files that
+	// are stored without compression
+	SkipExts []string
+}
+
+// CompressOption adjusts compressed store configuration
+type CompressOption func(cfg *CompressConfig)
+
+// OptCompressor sets the compressor used for new content
+func OptCompressor(c Compressor) CompressOption {
+	return func(cfg *CompressConfig) {
+		cfg.Compressor = c
+	}
+}
+
+// OptCompressMinSize sets the smallest file that will be compressed
+func OptCompressMinSize(size int) CompressOption {
+	return func(cfg *CompressConfig) {
+		cfg.MinSize = size
+	}
+}
+
+// OptCompressSkipExts adds file extensions that won't be compressed
+func OptCompressSkipExts(exts ...string) CompressOption {
+	return func(cfg *CompressConfig) {
+		cfg.SkipExts = append(cfg.SkipExts, exts...)
+	}
+}
+
+// CompressedStore is a Filestore that compresses file contents before they
+// reach the store it wraps, and decompresses on read. Keys returned are keys
+// of the wrapped store.
+//
+// Stored files start with a marker naming the compressor used, so stores
+// written with different compressors read correctly. Files without a marker
+// are read as-is, allowing a CompressedStore to wrap a store with existing
+// content. Files that are small, have a skipped extension, look like an
+// already-compressed format or don't shrink are stored with a marker for no
+// compression.
+type CompressedStore struct {
+	cfg   *CompressConfig
+	store Filestore
+}
+
+var (
+	_ Filestore = (*CompressedStore)(nil)
+	_ Fetcher   = (*CompressedStore)(nil)
+	_ Pinner    = (*CompressedStore)(nil)
+	_ Hasher    = (*CompressedStore)(nil)
+	_ Closer    = (*CompressedStore)(nil)
+)
+
+// NewCompressedStore wraps a store with compression
+func NewCompressedStore(store Filestore, opts ...CompressOption) *CompressedStore {
+	cfg := &CompressConfig{
+		Compressor: GzipCompressor{Level: gzip.DefaultCompression},
+		MinSize:    512,
+		SkipExts:   []string{".gz", ".tgz", ".zip", ".zst", ".bz2", ".xz", ".7z", ".png", ".jpg", ".jpeg", ".gif", ".mp4", ".parquet"},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &CompressedStore{cfg: cfg, store: store}
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (c *CompressedStore) PathPrefix() string {
+	return c.store.PathPrefix()
+}
+
+// Put compresses & stores a file
+func (c *CompressedStore) Put(file File, pin bool) (key string, err error) {
+	f, _, err := c.compress(file)
+	if err != nil {
+		return "", err
+	}
+	return c.store.Put(f, pin)
+}
+
+// Get reads a file from the wrapped store, decompressing it as it's read
+func (c *CompressedStore) Get(key string) (File, error) {
+	f, err := c.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return newDecompressingFile(f), nil
+}
+
+// Fetch fetches & decompresses a file, if the wrapped store supports fetching
+func (c *CompressedStore) Fetch(source Source, key string) (File, error) {
+	f, err := fetch(c.store, source, key)
+	if err != nil {
+		return nil, err
+	}
+	return newDecompressingFile(f), nil
+}
+
+// Has checks the wrapped store for a key
+func (c *CompressedStore) Has(key string) (exists bool, err error) {
+	return c.store.Has(key)
+}
+
+// Delete removes a key from the wrapped store
+func (c *CompressedStore) Delete(key string) error {
+	return c.store.Delete(key)
+}
+
+// NewAdder creates an adder that compresses files before adding them to the
+// wrapped store. Added files report logical size in Bytes & stored size in
+// Size
+func (c *CompressedStore) NewAdder(pin, wrap bool) (Adder, error) {
+	return &compressingAdder{
+		c: c,
+		put: func(f File) (string, error) {
+			return c.store.Put(f, pin)
+		},
+		out: make(chan AddedFile, 9),
+	}, nil
+}
+
+// NewHashAdder creates an adder that computes keys for compressed content
+func (c *CompressedStore) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := c.store.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return &compressingAdder{
+		c: c,
+		put: func(f File) (string, error) {
+			key, _, err := HashFile(h, f)
+			return key, err
+		},
+		out: make(chan AddedFile, 9),
+	}, nil
+}
+
+// Pin forwards to the wrapped store
+func (c *CompressedStore) Pin(key string, recursive bool) error {
+	return pin(c.store, key, recursive)
+}
+
+// Unpin forwards to the wrapped store
+func (c *CompressedStore) Unpin(key string, recursive bool) error {
+	return unpin(c.store, key, recursive)
+}
+
+// Close closes the wrapped store
+func (c *CompressedStore) Close() error {
+	return Close(c.store)
+}
+
+// compressionStats tallies the size of content before & after compression
+type compressionStats struct {
+	logical int64
+	stored  int64
+}
+
+// compress creates a compressed copy of a file tree
+func (c *CompressedStore) compress(file File) (File, compressionStats, error) {
+	var stats compressionStats
+	snap, err := snapshotFile(file)
+	if err != nil {
+		return nil, stats, err
+	}
+	if err := c.compressSnapshot(snap, &stats); err != nil {
+		return nil, stats, err
+	}
+	return snap.File(), stats, nil
+}
+
+func (c *CompressedStore) compressSnapshot(s *fileSnapshot, stats *compressionStats) (err error) {
+	if s.isDir {
+		for _, ch := range s.children {
+			if err := c.compressSnapshot(ch, stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	stats.logical += int64(len(s.data))
+	if s.data, err = c.compressData(s.name, s.data); err != nil {
+		return err
+	}
+	stats.stored += int64(len(s.data))
+	return nil
+}
+
+// compressData compresses the contents of a single file, falling back to
+// storing data uncompressed if compression won't help
+func (c *CompressedStore) compressData(name string, data []byte) ([]byte, error) {
+	if !c.skip(name, data) {
+		buf := &bytes.Buffer{}
+		buf.Write(compressedMagic)
+		buf.WriteByte(c.cfg.Compressor.ID())
+		w, err := c.cfg.Compressor.Compress(buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(data) {
+			return buf.Bytes(), nil
+		}
+	}
+
+	stored := make([]byte, 0, len(compressedMagic)+1+len(data))
+	stored = append(stored, compressedMagic...)
+	stored = append(stored, CompressionNone)
+	return append(stored, data...), nil
+}
+
+// skip reports whether a file shouldn't be compressed
+func (c *CompressedStore) skip(name string, data []byte) bool {
+	if len(data) < c.cfg.MinSize {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, skip := range c.cfg.SkipExts {
+		if ext == skip {
+			return true
+		}
+	}
+	for _, magic := range compressedFormats {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressingAdder compresses files & reports logical & stored sizes
+type compressingAdder struct {
+	c   *CompressedStore
+	put func(f File) (key string, err error)
+	out chan AddedFile
+}
+
+func (a *compressingAdder) AddFile(f File) error {
+	name := f.FileName()
+	cf, stats, err := a.c.compress(f)
+	if err != nil {
+		return err
+	}
+	key, err := a.put(cf)
+	if err != nil {
+		return err
+	}
+	a.out <- AddedFile{
+		Path:  key,
+		Name:  name,
+		Hash:  key,
+		Bytes: stats.logical,
+		Size:  strconv.FormatInt(stats.stored, 10),
+	}
+	return nil
+}
+
+func (a *compressingAdder) Added() chan AddedFile {
+	return a.out
+}
+
+func (a *compressingAdder) Close() error {
+	close(a.out)
+	return nil
+}
+
+// decompressingFile decompresses file contents as they're read
+type decompressingFile struct {
+	File
+	r   io.Reader
+	err error
+}
+
+func newDecompressingFile(f File) File {
+	return &decompressingFile{File: f}
+}
+
+func (f *decompressingFile) Read(p []byte) (int, error) {
+	if f.r == nil && f.err == nil {
+		f.r, f.err = decompressReader(f.File)
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.r.Read(p)
+}
+
+func (f *decompressingFile) NextFile() (File, error) {
+	next, err := f.File.NextFile()
+	if err != nil {
+		return nil, err
+	}
+	return newDecompressingFile(next), nil
+}
+
+// decompressReader reads a compression marker from r, returning a reader of
+// decompressed content. content without a marker is returned unmodified
+func decompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(compressedMagic) + 1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, compressedMagic) || len(header) <= len(compressedMagic) {
+		return br, nil
+	}
+
+	id := header[len(compressedMagic)]
+	if _, err := br.Discard(len(header)); err != nil {
+		return nil, err
+	}
+	if id == CompressionNone {
+		return br, nil
+	}
+	c, err := compressor(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(br)
+}
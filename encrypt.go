@@ -0,0 +1,535 @@
+package cafs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Cipher identifies an authenticated encryption algorithm
+type Cipher byte
+
+const (
+	// CipherAESGCM is AES-256 in Galois/Counter Mode
+	CipherAESGCM Cipher = iota + 1
+	// CipherXChaCha20Poly1305 is XChaCha20-Poly1305 with a 24-byte nonce
+	CipherXChaCha20Poly1305
+)
+
+// String implements the stringer interface
+func (c Cipher) String() string {
+	switch c {
+	case CipherAESGCM:
+		return "aes-gcm"
+	case CipherXChaCha20Poly1305:
+		return "xchacha20-poly1305"
+	}
+	return "unknown"
+}
+
+// ErrDecrypt is returned when content can't be decrypted, either because
+// the key that encrypted it isn't known or the ciphertext has been altered
+var ErrDecrypt = errors.New("cafs: cannot decrypt content")
+
+// encryptedMagic prefixes all ciphertexts, followed by a format version
+var encryptedMagic = []byte("cfe\x01")
+
+// EncryptionKey is a symmetric key for encrypting content
+type EncryptionKey struct {
+	// ID names the key. IDs are written to ciphertext so content can be
+	// decrypted after keys are rotated, they're stored in plaintext
+	ID string
+	// Cipher is the algorithm to encrypt with
+	Cipher Cipher
+	// Secret must be 32 bytes
+	Secret []byte
+}
+
+// aead allocates the cipher for a key
+func (k EncryptionKey) aead() (cipher.AEAD, error) {
+	if len(k.Secret) != 32 {
+		return nil, fmt.Errorf("encryption key %q secret must be 32 bytes, got: %d", k.ID, len(k.Secret))
+	}
+	switch k.Cipher {
+	case CipherAESGCM:
+		block, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case CipherXChaCha20Poly1305:
+		return chacha20poly1305.NewX(k.Secret)
+	}
+	return nil, fmt.Errorf("unsupported cipher: %d", k.Cipher)
+}
+
+// nonce derives a nonce from plaintext, making encryption deterministic
+func (k EncryptionKey) nonce(size int, plaintext []byte) []byte {
+	nk := sha256.Sum256(append([]byte("cafs nonce key:"), k.Secret...))
+	mac := hmac.New(sha256.New, nk[:])
+	mac.Write(plaintext)
+	sum := mac.Sum(nil)
+	// XChaCha20 nonces are 24 bytes, GCM 12, both fit in a sha256 sum
+	return sum[:size]
+}
+
+// seal encrypts plaintext, prefixing it with a header that records the
+// cipher, key ID & nonce
+func (k EncryptionKey) seal(plaintext []byte) ([]byte, error) {
+	if len(k.ID) > 255 {
+		return nil, fmt.Errorf("encryption key id must be less than 256 bytes")
+	}
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := k.nonce(aead.NonceSize(), plaintext)
+	buf := bytes.NewBuffer(make([]byte, 0, len(encryptedMagic)+2+len(k.ID)+len(nonce)+len(plaintext)+aead.Overhead()))
+	buf.Write(encryptedMagic)
+	buf.WriteByte(byte(k.Cipher))
+	buf.WriteByte(byte(len(k.ID)))
+	buf.WriteString(k.ID)
+	buf.Write(nonce)
+	header := buf.Bytes()
+	// authenticate the header as additional data
+	return aead.Seal(header, nonce, plaintext, header), nil
+}
+
+// ciphertextKeyID reads the key ID from an encrypted header
+func ciphertextKeyID(ciphertext []byte) (id string, rest []byte, err error) {
+	if !bytes.HasPrefix(ciphertext, encryptedMagic) || len(ciphertext) < len(encryptedMagic)+2 {
+		return "", nil, fmt.Errorf("%w: content isn't encrypted", ErrDecrypt)
+	}
+	rest = ciphertext[len(encryptedMagic)+1:]
+	idLen := int(rest[0])
+	if len(rest) < 1+idLen {
+		return "", nil, fmt.Errorf("%w: header is truncated", ErrDecrypt)
+	}
+	return string(rest[1 : 1+idLen]), rest[1+idLen:], nil
+}
+
+// open decrypts a ciphertext created by seal
+func (k EncryptionKey) open(ciphertext []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if Cipher(ciphertext[len(encryptedMagic)]) != k.Cipher {
+		return nil, fmt.Errorf("%w: cipher mismatch", ErrDecrypt)
+	}
+	_, rest, err := ciphertextKeyID(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: header is truncated", ErrDecrypt)
+	}
+	nonce := rest[:aead.NonceSize()]
+	header := ciphertext[:len(ciphertext)-len(rest)+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, rest[aead.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, err)
+	}
+	return plaintext, nil
+}
+
+// EncryptOption adjusts encrypted store configuration
+type EncryptOption func(e *EncryptedStore)
+
+// OptEncryptNames encrypts file & directory names in addition to contents
+func OptEncryptNames(e *EncryptedStore) {
+	e.encryptNames = true
+}
+
+// OptDecryptionKeys adds keys that can decrypt, but not encrypt content.
+// Use this to read content encrypted with previous keys after rotation
+func OptDecryptionKeys(keys ...EncryptionKey) EncryptOption {
+	return func(e *EncryptedStore) {
+		for _, k := range keys {
+			e.keys[k.ID] = k
+		}
+	}
+}
+
+// EncryptedStore is a Filestore that encrypts content before it reaches
+// the store it wraps, and decrypts content it reads. Keys returned are keys
+// of the wrapped store.
+//
+// Encryption is convergent: nonces are derived from the plaintext & key, so
+// the same content encrypted with the same key produces the same key in the
+// underlying store. This preserves deduplication & allows computing keys
+// with HashFile, at the cost of revealing when two stored files are equal.
+// Each ciphertext records the ID of the key that encrypted it, EncryptedStore
+// will decrypt content with any key it has been given.
+//
+// Decrypted files are read into memory in their entirety
+type EncryptedStore struct {
+	store        Filestore
+	encryptNames bool
+
+	lk      sync.RWMutex
+	current string
+	keys    map[string]EncryptionKey
+}
+
+var (
+	_ Filestore = (*EncryptedStore)(nil)
+	_ Fetcher   = (*EncryptedStore)(nil)
+	_ Pinner    = (*EncryptedStore)(nil)
+	_ Hasher    = (*EncryptedStore)(nil)
+	_ Closer    = (*EncryptedStore)(nil)
+)
+
+// NewEncryptedStore wraps a store, encrypting content with key
+func NewEncryptedStore(store Filestore, key EncryptionKey, opts ...EncryptOption) (*EncryptedStore, error) {
+	if _, err := key.aead(); err != nil {
+		return nil, err
+	}
+	e := &EncryptedStore{
+		store:   store,
+		current: key.ID,
+		keys:    map[string]EncryptionKey{key.ID: key},
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e, nil
+}
+
+// Rotate makes key the key new content is encrypted with. Previous keys are
+// kept for decrypting content they encrypted
+func (e *EncryptedStore) Rotate(key EncryptionKey) error {
+	if _, err := key.aead(); err != nil {
+		return err
+	}
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	e.keys[key.ID] = key
+	e.current = key.ID
+	return nil
+}
+
+// currentKey returns the key to encrypt with
+func (e *EncryptedStore) currentKey() EncryptionKey {
+	e.lk.RLock()
+	defer e.lk.RUnlock()
+	return e.keys[e.current]
+}
+
+// decryptionKey returns the key that encrypted a ciphertext
+func (e *EncryptedStore) decryptionKey(ciphertext []byte) (EncryptionKey, error) {
+	id, _, err := ciphertextKeyID(ciphertext)
+	if err != nil {
+		return EncryptionKey{}, err
+	}
+	e.lk.RLock()
+	defer e.lk.RUnlock()
+	k, ok := e.keys[id]
+	if !ok {
+		return k, fmt.Errorf("%w: unknown key %q", ErrDecrypt, id)
+	}
+	return k, nil
+}
+
+// KeyID reports the ID of the encryption key used to encrypt the content of
+// a file, or the first file found in a directory
+func (e *EncryptedStore) KeyID(key string) (string, error) {
+	f, err := e.store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	err = Walk(f, 0, func(f File, depth int) error {
+		if f.IsDirectory() || id != "" {
+			return nil
+		}
+		ciphertext, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		id, _, err = ciphertextKeyID(ciphertext)
+		return err
+	})
+	if err == nil && id == "" {
+		err = fmt.Errorf("%s contains no files", key)
+	}
+	return id, err
+}
+
+// Reencrypt rewrites content with the current key, returning the new key.
+// The previous key isn't deleted
+func (e *EncryptedStore) Reencrypt(key string, pin bool) (string, error) {
+	f, err := e.Get(key)
+	if err != nil {
+		return "", err
+	}
+	return e.Put(f, pin)
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (e *EncryptedStore) PathPrefix() string {
+	return e.store.PathPrefix()
+}
+
+// Put encrypts & stores a file
+func (e *EncryptedStore) Put(file File, pin bool) (key string, err error) {
+	enc, err := e.encrypt(file)
+	if err != nil {
+		return "", err
+	}
+	return e.store.Put(enc, pin)
+}
+
+// Get reads & decrypts a file
+func (e *EncryptedStore) Get(key string) (File, error) {
+	return e.read(key, e.store.Get)
+}
+
+// Fetch fetches & decrypts a file, if the underlying store supports fetching
+func (e *EncryptedStore) Fetch(source Source, key string) (File, error) {
+	return e.read(key, func(key string) (File, error) {
+		return fetch(e.store, source, key)
+	})
+}
+
+func (e *EncryptedStore) read(key string, get func(string) (File, error)) (File, error) {
+	keys, err := e.storeKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var f File
+	for _, sk := range keys {
+		if f, err = get(sk); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := snapshotFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.decryptSnapshot(snap, "", true); err != nil {
+		return nil, NewKeyError("decrypt", key, err)
+	}
+	return snap.File(), nil
+}
+
+// storeKeys translates a key into keys of the underlying store. With name
+// encryption the path component of a key must be encrypted, & each known
+// key could have been used
+func (e *EncryptedStore) storeKeys(key string) ([]string, error) {
+	k, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if !e.encryptNames || k.Path == "" {
+		return []string{key}, nil
+	}
+
+	e.lk.RLock()
+	candidates := make([]EncryptionKey, 0, len(e.keys))
+	candidates = append(candidates, e.keys[e.current])
+	for id, ek := range e.keys {
+		if id != e.current {
+			candidates = append(candidates, ek)
+		}
+	}
+	e.lk.RUnlock()
+
+	keys := make([]string, 0, len(candidates))
+	segments := strings.Split(strings.TrimPrefix(k.Path, "/"), "/")
+	for _, ek := range candidates {
+		enc := make([]string, len(segments))
+		for i, seg := range segments {
+			if enc[i], err = encryptName(ek, seg); err != nil {
+				return nil, err
+			}
+		}
+		keys = append(keys, k.Root().Join(enc...).String())
+	}
+	return keys, nil
+}
+
+// Has checks the underlying store for a key
+func (e *EncryptedStore) Has(key string) (exists bool, err error) {
+	keys, err := e.storeKeys(key)
+	if err != nil {
+		return false, err
+	}
+	for _, sk := range keys {
+		if exists, err = e.store.Has(sk); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// Delete removes a key from the underlying store
+func (e *EncryptedStore) Delete(key string) error {
+	return e.store.Delete(key)
+}
+
+// NewAdder creates an adder that encrypts files before adding them to the
+// underlying store
+func (e *EncryptedStore) NewAdder(pin, wrap bool) (Adder, error) {
+	a, err := e.store.NewAdder(pin, wrap)
+	if err != nil {
+		return nil, err
+	}
+	return encryptingAdder{Adder: a, e: e}, nil
+}
+
+// NewHashAdder creates a hash adder that computes keys for encrypted content
+func (e *EncryptedStore) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := e.store.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	a, err := h.NewHashAdder(wrap)
+	if err != nil {
+		return nil, err
+	}
+	return encryptingAdder{Adder: a, e: e}, nil
+}
+
+// Pin forwards to the underlying store
+func (e *EncryptedStore) Pin(key string, recursive bool) error {
+	return pin(e.store, key, recursive)
+}
+
+// Unpin forwards to the underlying store
+func (e *EncryptedStore) Unpin(key string, recursive bool) error {
+	return unpin(e.store, key, recursive)
+}
+
+// Close closes the underlying store
+func (e *EncryptedStore) Close() error {
+	return Close(e.store)
+}
+
+type encryptingAdder struct {
+	Adder
+	e *EncryptedStore
+}
+
+func (a encryptingAdder) AddFile(f File) error {
+	enc, err := a.e.encrypt(f)
+	if err != nil {
+		return err
+	}
+	return a.Adder.AddFile(enc)
+}
+
+// encrypt creates an encrypted copy of a file tree
+func (e *EncryptedStore) encrypt(file File) (File, error) {
+	snap, err := snapshotFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.encryptSnapshot(e.currentKey(), snap, ""); err != nil {
+		return nil, err
+	}
+	return snap.File(), nil
+}
+
+func (e *EncryptedStore) encryptSnapshot(k EncryptionKey, s *fileSnapshot, parent string) (err error) {
+	if e.encryptNames && s.name != "" && s.name != "/" {
+		if s.name, err = encryptName(k, s.name); err != nil {
+			return err
+		}
+		s.path = renamePath(s.path, parent, s.name)
+	}
+
+	if !s.isDir {
+		s.data, err = k.seal(s.data)
+		return err
+	}
+	for _, ch := range s.children {
+		if err := e.encryptSnapshot(k, ch, s.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EncryptedStore) decryptSnapshot(s *fileSnapshot, parent string, root bool) (err error) {
+	if e.encryptNames && s.name != "" && s.name != "/" {
+		if name, err := e.decryptName(s.name); err == nil {
+			s.name = name
+			s.path = renamePath(s.path, parent, s.name)
+		} else if !root {
+			// only the root name may be unencrypted, stores may name the root
+			// of a tree after its key
+			return err
+		}
+	}
+
+	if !s.isDir {
+		k, err := e.decryptionKey(s.data)
+		if err != nil {
+			return err
+		}
+		s.data, err = k.open(s.data)
+		return err
+	}
+	for _, ch := range s.children {
+		if err := e.decryptSnapshot(ch, s.path, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renamePath replaces the last element of path with name. when parent is
+// known, the path is rebuilt from it
+func renamePath(path, parent, name string) string {
+	if parent != "" {
+		return filepath.Join(parent, name)
+	}
+	if path == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// encryptName encrypts a file name into a string that's safe to use as a
+// path element
+func encryptName(k EncryptionKey, name string) (string, error) {
+	ct, err := k.seal([]byte(name))
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(ct), nil
+}
+
+func (e *EncryptedStore) decryptName(name string) (string, error) {
+	ct, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: name isn't encrypted", ErrDecrypt)
+	}
+	k, err := e.decryptionKey(ct)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := k.open(ct)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
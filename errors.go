@@ -0,0 +1,92 @@
+package cafs
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrNotFound is the canonical error for not finding a value
+	ErrNotFound = errors.New("cafs: path not found")
+	// ErrNotPinned occurs when unpinning a key that isn't pinned
+	ErrNotPinned = errors.New("cafs: not pinned")
+	// ErrAlreadyPinned occurs when pinning a key that is already pinned
+	ErrAlreadyPinned = errors.New("cafs: already pinned")
+	// ErrPinnedRecursively occurs when removing a recursive pin with a direct
+	// unpin
+	ErrPinnedRecursively = errors.New("cafs: key is pinned recursively")
+	// ErrInvalidKey is returned when a key cannot be parsed or doesn't belong
+	// to the store it was given to
+	ErrInvalidKey = errors.New("cafs: invalid key")
+	// ErrOffline indicates an operation requires a network the store isn't
+	// currently connected to
+	ErrOffline = errors.New("cafs: store is offline")
+	// ErrTimeout indicates an operation didn't complete in the time allotted
+	ErrTimeout = errors.New("cafs: operation timed out")
+	// ErrNotSupported is returned by stores that wrap other stores when an
+	// optional interface (eg: Pinner, Fetcher) isn't implemented by the
+	// underlying store
+	ErrNotSupported = errors.New("cafs: operation not supported")
+	// ErrIntegrity indicates content doesn't hash to the key it was requested
+	// by. Errors matching ErrIntegrity will be of type *IntegrityError
+	ErrIntegrity = errors.New("cafs: content doesn't match key")
+	// ErrClosed is returned by operations on a store that's been closed
+	ErrClosed = errors.New("cafs: store is closed")
+	// ErrInvalidRef is returned for ref names that don't pass ValidRefName
+	ErrInvalidRef = errors.New("cafs: invalid ref name")
+	// ErrRefConflict occurs when a compare-and-swap ref update finds the ref
+	// has changed
+	ErrRefConflict = errors.New("cafs: ref changed")
+	// ErrKeyExists occurs when generating a name key with a name that's
+	// already in use
+	ErrKeyExists = errors.New("cafs: key already exists")
+)
+
+// KeyError records an error and the operation and key that caused it.
+// Use errors.Is to compare a KeyError against the canonical errors in this
+// package, eg: errors.Is(err, cafs.ErrNotFound)
+type KeyError struct {
+	Op  string
+	Key string
+	Err error
+}
+
+// NewKeyError wraps err with an operation & key
+func NewKeyError(op, key string, err error) *KeyError {
+	return &KeyError{Op: op, Key: key, Err: err}
+}
+
+// Error implements the error interface
+func (e *KeyError) Error() string {
+	if e.Key == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Key + ": " + e.Err.Error()
+}
+
+// Unwrap gives access to the underlying error
+func (e *KeyError) Unwrap() error { return e.Err }
+
+// Temporary reports whether the error is transient, and the operation that
+// caused it may succeed if retried
+func (e *KeyError) Temporary() bool { return Temporary(e.Err) }
+
+// Temporary reports whether err is a transient failure that may succeed on
+// retry, as opposed to a permanent one like missing content or a bad key
+func Temporary(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrOffline) || errors.Is(err, ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	for ; err != nil; err = errors.Unwrap(err) {
+		if _, ok := err.(*KeyError); ok {
+			continue
+		}
+		if t, ok := err.(interface{ Temporary() bool }); ok && t.Temporary() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package cafs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestKeyError(t *testing.T) {
+	err := NewKeyError("get", "/map/QmFoo", ErrNotFound)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected KeyError to match ErrNotFound")
+	}
+	if errors.Is(err, ErrNotPinned) {
+		t.Errorf("expected KeyError not to match ErrNotPinned")
+	}
+
+	wrapped := fmt.Errorf("getting dataset: %w", err)
+	var ke *KeyError
+	if !errors.As(wrapped, &ke) {
+		t.Fatalf("expected wrapped error to unwrap to a KeyError")
+	}
+	if ke.Key != "/map/QmFoo" {
+		t.Errorf("key mismatch. expected: %s, got: %s", "/map/QmFoo", ke.Key)
+	}
+
+	expect := "get /map/QmFoo: cafs: path not found"
+	if err.Error() != expect {
+		t.Errorf("error string mismatch. expected: %q, got: %q", expect, err.Error())
+	}
+}
+
+type tempErr bool
+
+func (e tempErr) Error() string   { return "temp" }
+func (e tempErr) Temporary() bool { return bool(e) }
+
+func TestTemporary(t *testing.T) {
+	cases := []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{ErrNotFound, false},
+		{NewKeyError("get", "/map/QmFoo", ErrNotFound), false},
+		{NewKeyError("has", "/map/QmFoo", ErrInvalidKey), false},
+		{ErrOffline, true},
+		{NewKeyError("fetch", "/map/QmFoo", ErrOffline), true},
+		{NewKeyError("get", "/ipfs/QmFoo", ErrTimeout), true},
+		{fmt.Errorf("resolving: %w", context.DeadlineExceeded), true},
+		{NewKeyError("get", "/map/QmFoo", tempErr(true)), true},
+		{NewKeyError("get", "/map/QmFoo", tempErr(false)), false},
+	}
+
+	for i, c := range cases {
+		if got := Temporary(c.err); got != c.expect {
+			t.Errorf("case %d (%v): expected: %t, got: %t", i, c.err, c.expect, got)
+		}
+	}
+}
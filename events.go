@@ -0,0 +1,184 @@
+package cafs
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// EventType enumerates the kinds of changes a store reports
+type EventType int
+
+const (
+	// EventAdd occurs when content is added to a store
+	EventAdd EventType = iota + 1
+	// EventDelete occurs when content is deleted
+	EventDelete
+	// EventPin occurs when a key is pinned
+	EventPin
+	// EventUnpin occurs when a key is unpinned
+	EventUnpin
+	// EventGC occurs when a store has run garbage collection
+	EventGC
+	// EventDropped is delivered to a subscriber that wasn't keeping up, ahead
+	// of the first event after those that were discarded. Subscribers that
+	// need a complete view of the store should resynchronize when they
+	// receive it
+	EventDropped
+)
+
+// String implements the stringer interface
+func (t EventType) String() string {
+	switch t {
+	case EventAdd:
+		return "add"
+	case EventDelete:
+		return "delete"
+	case EventPin:
+		return "pin"
+	case EventUnpin:
+		return "unpin"
+	case EventGC:
+		return "gc"
+	case EventDropped:
+		return "dropped"
+	}
+	return "unknown"
+}
+
+// Event describes a change to a store
+type Event struct {
+	Type EventType
+	// Key is the key that changed. GC & dropped events have no key
+	Key  string
+	Time time.Time
+	// Dropped is the number of events discarded, set on EventDropped events
+	Dropped int
+}
+
+// Subscriber is implemented by Filestores that publish events
+type Subscriber interface {
+	// Subscribe returns a channel of events that's closed when ctx is done.
+	// buffer sets the number of events that will be held for a subscriber
+	// that isn't reading. Stores never block waiting for subscribers, once a
+	// subscriber's buffer is full events are dropped, & later reported with a
+	// single EventDropped. A buffer of 0 holds a single event, negative buffers
+	// are rejected with a closed channel
+	Subscribe(ctx context.Context, buffer int) <-chan Event
+}
+
+// Events delivers events to subscribers. Filestores use Events to implement
+// Subscriber. A nil *Events discards all events
+type Events struct {
+	lk   sync.Mutex
+	subs map[*subscription]struct{}
+	// done is closed by Close
+	done chan struct{}
+}
+
+type subscription struct {
+	ch      chan Event
+	dropped int
+}
+
+// NewEvents allocates an Events
+func NewEvents() *Events {
+	return &Events{
+		subs: map[*subscription]struct{}{},
+		done: make(chan struct{}),
+	}
+}
+
+// Subscribe implements the Subscriber interface
+func (e *Events) Subscribe(ctx context.Context, buffer int) <-chan Event {
+	if buffer < 0 {
+		ch := make(chan Event)
+		close(ch)
+		return ch
+	}
+	if buffer == 0 {
+		// an unbuffered subscription would drop every event, hold at least one
+		buffer = 1
+	}
+	// one slot is reserved on top of the buffer for reporting dropped events
+	sub := &subscription{ch: make(chan Event, buffer+1)}
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	select {
+	case <-e.done:
+		close(sub.ch)
+		return sub.ch
+	default:
+	}
+	e.subs[sub] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-e.done:
+		}
+		e.lk.Lock()
+		e.unsubscribe(sub)
+		e.lk.Unlock()
+	}()
+	return sub.ch
+}
+
+// unsubscribe removes a subscription & closes its channel if it hasn't been
+// already. callers must hold the lock
+func (e *Events) unsubscribe(sub *subscription) {
+	if _, ok := e.subs[sub]; ok {
+		delete(e.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// Close ends all subscriptions. Subscribing to closed Events returns a
+// closed channel, & emitting events does nothing
+func (e *Events) Close() error {
+	if e == nil {
+		return nil
+	}
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	select {
+	case <-e.done:
+		return nil
+	default:
+	}
+	close(e.done)
+	for sub := range e.subs {
+		e.unsubscribe(sub)
+	}
+	return nil
+}
+
+// Emit delivers an event to all subscribers without blocking
+func (e *Events) Emit(t EventType, key string) {
+	if e == nil {
+		return
+	}
+	evt := Event{Type: t, Key: key, Time: time.Now()}
+
+	e.lk.Lock()
+	defer e.lk.Unlock()
+	for sub := range e.subs {
+		sub.send(evt)
+	}
+}
+
+// send delivers an event, dropping it if the subscriber's buffer is full.
+// the last slot of the buffer is held back so a count of dropped events can
+// be delivered ahead of the next event that fits
+func (s *subscription) send(evt Event) {
+	if len(s.ch) >= cap(s.ch)-1 {
+		s.dropped++
+		return
+	}
+	if s.dropped > 0 {
+		s.ch <- Event{Type: EventDropped, Time: evt.Time, Dropped: s.dropped}
+		s.dropped = 0
+	}
+	s.ch <- evt
+}
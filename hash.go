@@ -0,0 +1,146 @@
+package cafs
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// BLAKE2B_256 is the multihash code for 256-bit BLAKE2b
+	BLAKE2B_256 uint64 = multihash.BLAKE2B_MIN + 31
+	// BLAKE3 is the multihash code for BLAKE3. cafs doesn't bundle an
+	// implementation, use RegisterHash to make one available
+	BLAKE3 uint64 = 0x1e
+)
+
+var (
+	hashesLk sync.RWMutex
+	// hashes maps multihash codes to streaming hash constructors
+	hashes = map[uint64]func() hash.Hash{
+		multihash.SHA1:     sha1.New,
+		multihash.SHA2_256: sha256.New,
+		multihash.SHA2_512: sha512.New,
+		multihash.SHA3_256: sha3.New256,
+		multihash.SHA3_512: sha3.New512,
+		BLAKE2B_256:        newBlake2b256,
+	}
+)
+
+func newBlake2b256() hash.Hash {
+	// New256 only errors when given a key that's too long
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// RegisterHash makes a streaming hash function available for a multihash code,
+// replacing any existing registration. Registrations are kept by cafs, codes
+// unknown to the multihash package are accepted when parsing keys once
+// they're registered
+func RegisterHash(code uint64, fn func() hash.Hash) {
+	hashesLk.Lock()
+	defer hashesLk.Unlock()
+	hashes[code] = fn
+}
+
+// registered reports whether a hash function is registered for code
+func registered(code uint64) bool {
+	hashesLk.RLock()
+	defer hashesLk.RUnlock()
+	_, ok := hashes[code]
+	return ok
+}
+
+// castMultihash checks buf is a multihash with a code known to the multihash
+// package or registered with RegisterHash
+func castMultihash(buf []byte) (multihash.Multihash, error) {
+	dec, err := multihash.Decode(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !multihash.ValidCode(dec.Code) && !registered(dec.Code) {
+		return nil, multihash.ErrUnknownCode
+	}
+	return multihash.Multihash(buf), nil
+}
+
+// encodeMultihash encodes a digest as a multihash. Unlike multihash.Encode,
+// codes registered with RegisterHash are accepted
+func encodeMultihash(digest []byte, code uint64) multihash.Multihash {
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(digest))
+	n := binary.PutUvarint(buf, code)
+	n += binary.PutUvarint(buf[n:], uint64(len(digest)))
+	n += copy(buf[n:], digest)
+	return multihash.Multihash(buf[:n])
+}
+
+// NewHash allocates a streaming hash for a multihash code
+func NewHash(code uint64) (hash.Hash, error) {
+	hashesLk.RLock()
+	defer hashesLk.RUnlock()
+	fn, ok := hashes[code]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function: %x", code)
+	}
+	return fn(), nil
+}
+
+// Sum hashes data with the hash function identified by a multihash code
+func Sum(data []byte, code uint64) (multihash.Multihash, error) {
+	h, err := NewHash(code)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.Write(data); err != nil {
+		return nil, fmt.Errorf("error writing hash data: %w", err)
+	}
+	return encodeMultihash(h.Sum(nil), code), nil
+}
+
+// KeyEncoding determines the string form of the hash component of a key
+type KeyEncoding int
+
+const (
+	// EncodingBase58 encodes hashes as a base58 multihash. For SHA2-256 hashes
+	// this is equivalent to an IPFS CIDv0, eg: QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S
+	EncodingBase58 KeyEncoding = iota
+	// EncodingCIDv1Base32 encodes hashes as a case-insensitive base32 CIDv1,
+	// eg: bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku
+	EncodingCIDv1Base32
+)
+
+// String implements the stringer interface
+func (e KeyEncoding) String() string {
+	switch e {
+	case EncodingBase58:
+		return "base58"
+	case EncodingCIDv1Base32:
+		return "cidv1-base32"
+	}
+	return "unknown"
+}
+
+// NewCIDv1Key creates a version 1 key with a base32-encoded hash
+func NewCIDv1Key(prefix string, codec uint64, mh multihash.Multihash) Key {
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(mh))
+	n := binary.PutUvarint(buf, 1)
+	n += binary.PutUvarint(buf[n:], codec)
+	n += copy(buf[n:], mh)
+
+	return Key{
+		Prefix:    prefix,
+		Hash:      "b" + strings.ToLower(base32Encoding.EncodeToString(buf[:n])),
+		Version:   1,
+		Codec:     codec,
+		Multihash: mh,
+	}
+}
@@ -0,0 +1,97 @@
+package cafs
+
+import (
+	"crypto/sha256"
+	"hash"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+func TestSum(t *testing.T) {
+	data := []byte("hello world")
+	cases := []uint64{
+		multihash.SHA2_256,
+		multihash.SHA2_512,
+		multihash.SHA3_256,
+		multihash.SHA3_512,
+		BLAKE2B_256,
+	}
+
+	for _, code := range cases {
+		got, err := Sum(data, code)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", multihash.Codes[code], err.Error())
+			continue
+		}
+		expect, err := multihash.Sum(data, code, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.B58String() != expect.B58String() {
+			t.Errorf("%s: hash mismatch. expected: %s, got: %s", multihash.Codes[code], expect.B58String(), got.B58String())
+		}
+	}
+
+	if _, err := Sum(data, BLAKE3); err == nil {
+		t.Errorf("expected error hashing with unregistered hash function")
+	}
+}
+
+func TestRegisterHash(t *testing.T) {
+	// stand in for a real hash function the multihash package doesn't know
+	const code = 0x300001
+	RegisterHash(code, func() hash.Hash { return sha256.New() })
+	defer func() {
+		hashesLk.Lock()
+		delete(hashes, code)
+		hashesLk.Unlock()
+	}()
+	if multihash.ValidCode(code) {
+		t.Errorf("registering a hash shouldn't modify the multihash package")
+	}
+
+	mh, err := Sum([]byte("hello world"), code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := ParseKey(NewKey("map", mh).String())
+	if err != nil {
+		t.Fatalf("error parsing key with registered hash: %s", err)
+	}
+	dec, err := multihash.Decode(k.Multihash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Code != code {
+		t.Errorf("code mismatch. expected: %x, got: %x", code, dec.Code)
+	}
+}
+
+func TestNewCIDv1Key(t *testing.T) {
+	mh, err := Sum([]byte("hello world"), BLAKE2B_256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewCIDv1Key("map", CodecRaw, mh)
+	if key.Hash[0] != 'b' {
+		t.Errorf("expected base32 multibase prefix, got: %s", key.Hash)
+	}
+
+	got, err := ParseKey(key.String())
+	if err != nil {
+		t.Fatalf("error parsing CIDv1 key: %s", err)
+	}
+	if got.Version != 1 {
+		t.Errorf("version mismatch. expected: 1, got: %d", got.Version)
+	}
+	if got.Codec != CodecRaw {
+		t.Errorf("codec mismatch. expected: %x, got: %x", CodecRaw, got.Codec)
+	}
+	if got.Multihash.B58String() != mh.B58String() {
+		t.Errorf("multihash mismatch. expected: %s, got: %s", mh.B58String(), got.Multihash.B58String())
+	}
+	if got.String() != key.String() {
+		t.Errorf("round trip mismatch. expected: %s, got: %s", key.String(), got.String())
+	}
+}
@@ -0,0 +1,239 @@
+package cafs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// URLSource is a Source that serves content over HTTP
+type URLSource struct {
+	// URL is an http or https url
+	URL string
+	// Gateway treats URL as the root of a gateway that serves content at key
+	// paths, eg: a URL of "https://ipfs.io" serves the key /ipfs/QmFoo at
+	// https://ipfs.io/ipfs/QmFoo. When Gateway is false, URL addresses the
+	// content directly
+	Gateway bool
+}
+
+// Address returns the source URL
+func (s URLSource) Address() string { return s.URL }
+
+// HTTPFetcherOption adjusts HTTPFetcher configuration
+type HTTPFetcherOption func(h *HTTPFetcher)
+
+// OptHTTPClient sets the client used to make requests. The default is
+// http.DefaultClient
+func OptHTTPClient(c *http.Client) HTTPFetcherOption {
+	return func(h *HTTPFetcher) {
+		h.client = c
+	}
+}
+
+// OptHTTPGateways sets gateway URLs to fetch from when fetching from
+// SourceAny. Gateways are tried in order
+func OptHTTPGateways(urls ...string) HTTPFetcherOption {
+	return func(h *HTTPFetcher) {
+		h.gateways = urls
+	}
+}
+
+// OptHTTPMaxBytes limits the size of downloaded content. Downloads larger
+// than max fail with ErrByteLimit. The default of 0 means no limit
+func OptHTTPMaxBytes(max int64) HTTPFetcherOption {
+	return func(h *HTTPFetcher) {
+		h.maxBytes = max
+	}
+}
+
+// HTTPFetcher is a Fetcher that downloads content over HTTP into a store.
+// Downloaded content is stored only if it hashes to the requested key, and is
+// an *IntegrityError otherwise. HTTP sources serve single files, so keys with
+// a path can't be verified & aren't supported. Stores that are Hashers have
+// content checked before it's written. Other stores may be left holding
+// unpinned content that doesn't match, since it can't be told apart from
+// content the store already had.
+//
+// Fetching from a URLSource or, when gateways are configured, SourceAny
+// returns content that's already in the store without making any requests.
+// Other sources are passed to the store's Fetch method
+type HTTPFetcher struct {
+	store    Filestore
+	client   *http.Client
+	gateways []string
+	maxBytes int64
+}
+
+var _ Fetcher = (*HTTPFetcher)(nil)
+
+// NewHTTPFetcher creates a fetcher that adds content to store
+func NewHTTPFetcher(store Filestore, opts ...HTTPFetcherOption) *HTTPFetcher {
+	h := &HTTPFetcher{
+		store:  store,
+		client: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Fetch gets content for key from source
+func (h *HTTPFetcher) Fetch(source Source, key string) (File, error) {
+	timeout := time.Duration(0)
+	if ts, ok := source.(TimeoutSource); ok {
+		timeout = ts.Timeout()
+	}
+
+	var urls []string
+	switch s := unwrapSource(source).(type) {
+	case URLSource:
+		u, err := sourceURL(s, key)
+		if err != nil {
+			return nil, NewKeyError("fetch", key, err)
+		}
+		urls = []string{u}
+	default:
+		if source.Address() != SourceAny.Address() || len(h.gateways) == 0 {
+			return fetch(h.store, source, key)
+		}
+		for _, gw := range h.gateways {
+			u, err := sourceURL(URLSource{URL: gw, Gateway: true}, key)
+			if err != nil {
+				return nil, NewKeyError("fetch", key, err)
+			}
+			urls = append(urls, u)
+		}
+	}
+
+	k, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if k.Path != "" {
+		return nil, NewKeyError("fetch", key, fmt.Errorf("%w: http sources can't fetch keys with a path", ErrNotSupported))
+	}
+
+	if f, err := fetch(h.store, SourceLocal, key); err == nil {
+		return f, nil
+	} else if !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrNotSupported) {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	for _, u := range urls {
+		if err = h.download(ctx, u, k); err == nil {
+			return h.store.Get(key)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, NewKeyError("fetch", key, ErrTimeout)
+		}
+	}
+	return nil, err
+}
+
+// unwrapSource returns the source a TimeoutSource applies to, if it has one
+func unwrapSource(s Source) Source {
+	if w, ok := s.(interface{ Unwrap() Source }); ok {
+		return w.Unwrap()
+	}
+	return s
+}
+
+// sourceURL returns the url to request key from
+func sourceURL(s URLSource, key string) (string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return "", fmt.Errorf("invalid source url %q: %s", s.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("invalid source url %q: scheme must be http or https", s.URL)
+	}
+	if s.Gateway {
+		return strings.TrimSuffix(s.URL, "/") + key, nil
+	}
+	return s.URL, nil
+}
+
+// download requests content from a url, adding it to the store if it hashes
+// to key
+func (h *HTTPFetcher) download(ctx context.Context, u string, key Key) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return NewKeyError("fetch", key.String(), err)
+	}
+	res, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return NewKeyError("fetch", key.String(), err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return NewKeyError("fetch", key.String(), ErrNotFound)
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return NewKeyError("fetch", key.String(), fmt.Errorf("GET %s: unexpected status %s", u, res.Status))
+	}
+
+	body := io.Reader(res.Body)
+	if h.maxBytes > 0 {
+		// read one byte past the limit to tell content that's exactly max
+		// bytes from content that's larger
+		body = io.LimitReader(res.Body, h.maxBytes+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return NewKeyError("fetch", key.String(), err)
+	}
+	if h.maxBytes > 0 && int64(len(data)) > h.maxBytes {
+		return NewKeyError("fetch", key.String(), fmt.Errorf("%w: GET %s: content is larger than %d bytes", ErrByteLimit, u, h.maxBytes))
+	}
+	name := path.Base(req.URL.Path)
+	file := func() File { return NewMemfileBytes(name, data) }
+
+	// check content before writing it when the store can hash without writing
+	if hasher, ok := h.store.(Hasher); ok {
+		got, _, err := HashFile(hasher, file())
+		if err != nil {
+			return NewKeyError("fetch", key.String(), err)
+		}
+		if err := checkKey(key, got); err != nil {
+			return err
+		}
+	}
+
+	got, err := h.store.Put(file(), false)
+	if err != nil {
+		return NewKeyError("fetch", key.String(), err)
+	}
+	// got may be content the store already had, so it's left in place
+	return checkKey(key, got)
+}
+
+// checkKey returns an *IntegrityError if got doesn't identify the same
+// content as expect
+func checkKey(expect Key, got string) error {
+	k, err := ParseKey(got)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(expect.Multihash, k.Multihash) {
+		return &IntegrityError{Key: expect.String(), Expected: expect.Multihash, Got: k.Multihash}
+	}
+	return nil
+}
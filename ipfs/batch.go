@@ -0,0 +1,100 @@
+package ipfs_filestore
+
+import (
+	"sync"
+
+	cafs "github.com/qri-io/cafs"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+)
+
+// batchWorkers limits the number of operations a batch runs concurrently
+const batchWorkers = 8
+
+var _ cafs.Batcher = (*Filestore)(nil)
+
+// PutMany adds files one at a time. adds contend for the same pinner &
+// blockstore locks, so there's nothing to gain from running them in parallel
+func (fs *Filestore) PutMany(files []cafs.File, pin bool) ([]string, error) {
+	keys := make([]string, len(files))
+	errs := make([]error, len(files))
+	for i, f := range files {
+		keys[i], errs[i] = fs.Put(f, pin)
+	}
+	return keys, cafs.NewBatchError(errs)
+}
+
+// GetMany gets files in parallel
+func (fs *Filestore) GetMany(keys []string) ([]cafs.File, error) {
+	files := make([]cafs.File, len(keys))
+	errs := make([]error, len(keys))
+	parallel(len(keys), func(i int) {
+		files[i], errs[i] = fs.Get(keys[i])
+	})
+	return files, cafs.NewBatchError(errs)
+}
+
+// HasMany checks the local blockstore for keys. keys without a path are
+// checked directly, skipping path resolution. keys with a path & ipns names
+// are resolved through local blocks in parallel
+func (fs *Filestore) HasMany(keys []string) ([]bool, error) {
+	exists := make([]bool, len(keys))
+	errs := make([]error, len(keys))
+	var paths []int
+
+	if err := fs.rlock("has", ""); err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		k, err := parseKey("has", key)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if k.Path != "" || k.Prefix == ipnsPrefix {
+			paths = append(paths, i)
+			continue
+		}
+		c, err := cid.Decode(k.Hash)
+		if err != nil {
+			errs[i] = cafs.NewKeyError("has", key, cafs.ErrInvalidKey)
+			continue
+		}
+		if exists[i], err = fs.node.Blockstore.Has(c); err != nil {
+			errs[i] = keyError("has", key, err)
+		}
+	}
+	fs.lk.RUnlock()
+
+	parallel(len(paths), func(j int) {
+		i := paths[j]
+		exists[i], errs[i] = fs.Has(keys[i])
+	})
+	return exists, cafs.NewBatchError(errs)
+}
+
+// DeleteMany deletes keys in a single purge, so reachable content is only
+// computed once
+func (fs *Filestore) DeleteMany(keys []string) error {
+	_, err := fs.Purge(keys...)
+	return err
+}
+
+// parallel calls do for each index in [0, n) using up to batchWorkers
+// goroutines, returning when all calls have completed
+func parallel(n int, do func(i int)) {
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, batchWorkers)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			do(i)
+		}(i)
+	}
+	wg.Wait()
+}
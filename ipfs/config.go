@@ -3,6 +3,7 @@ package ipfs_filestore
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core"
 	fsrepo "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/repo/fsrepo"
@@ -30,6 +31,18 @@ type StoreCfg struct {
 	Ctx context.Context
 	// EnableAPI
 	EnableAPI bool
+	// StatusCallback is called with the new status whenever the store starts
+	// or finishes going online or offline. err is the reason a transition
+	// failed. Callbacks are called synchronously while the transition is in
+	// progress, & must not call GoOnline, GoOffline or Close, which wait for
+	// the transition to finish
+	StatusCallback func(status Status, err error)
+	// DrainTimeout is the longest GoOnline & GoOffline wait for open files &
+	// adders before replacing the node
+	DrainTimeout time.Duration
+	// FetchTimeout limits how long Fetch may take when the source doesn't set
+	// a timeout. zero means no limit
+	FetchTimeout time.Duration
 }
 
 // DefaultConfig results in a local node that
@@ -39,21 +52,32 @@ func DefaultConfig() *StoreCfg {
 		BuildCfg: core.BuildCfg{
 			Online: false,
 		},
-		FsRepoPath: "~/.ipfs",
-		Ctx:        context.Background(),
+		FsRepoPath:   "~/.ipfs",
+		Ctx:          context.Background(),
+		DrainTimeout: time.Second * 10,
+		FetchTimeout: time.Minute,
 	}
 }
 
 // Option is a function that adjusts the store configuration
 type Option func(o *StoreCfg)
 
-// OptEnablePubSub configures ipfs to use the experimental pubsub store
+// OptEnablePubSub configures ipfs to use the experimental pubsub store.
+// Online stores with pubsub enabled implement cafs.PubSub
 func OptEnablePubSub(o *StoreCfg) {
 	o.BuildCfg.ExtraOpts = map[string]bool{
 		"pubsub": true,
 	}
 }
 
+// OptStatusCallback sets a function to call when the store's network status
+// changes. fn must not change the status itself, see StoreCfg.StatusCallback
+func OptStatusCallback(fn func(status Status, err error)) Option {
+	return func(o *StoreCfg) {
+		o.StatusCallback = fn
+	}
+}
+
 // OptsFromMap detects options from a map based on special keywords
 func OptsFromMap(opts map[string]interface{}) Option {
 	return func(o *StoreCfg) {
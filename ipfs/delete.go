@@ -0,0 +1,176 @@
+package ipfs_filestore
+
+import (
+	"context"
+
+	cafs "github.com/qri-io/cafs"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	ipld "gx/ipfs/QmR7TcHkR9nxkUorfi8XMTAMLUK7GiP64TWWBzY3aacc1o/go-ipld-format"
+	"gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/pin"
+	gc "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/pin/gc"
+)
+
+// Delete unpins key & removes every block beneath it from the local
+// blockstore, except blocks that are still reachable from other pins, refs
+// or the node's MFS root. After Delete, Has reports false for key unless its
+// content is shared with other pinned or referenced content. Deleting content
+// that isn't stored locally is a no-op
+func (fs *Filestore) Delete(key string) error {
+	if _, err := parseKey("delete", key); err != nil {
+		return err
+	}
+	if err := fs.rlock("delete", key); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+
+	_, errs, err := fs.purge([]string{key})
+	if err != nil {
+		return keyError("delete", key, err)
+	}
+	return errs[0]
+}
+
+// Purge deletes keys as Delete does, computing reachable content once for
+// all keys. Purge returns the keys of every block it removed, which is useful
+// for confirming user data has actually been erased. Errors for individual
+// keys are reported in a *cafs.BatchError
+func (fs *Filestore) Purge(keys ...string) (removed []string, err error) {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		_, errs[i] = parseKey("delete", key)
+	}
+	if err := cafs.NewBatchError(errs); err != nil {
+		return nil, err
+	}
+
+	if err := fs.rlock("delete", ""); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	removed, errs, err = fs.purge(keys)
+	if err != nil {
+		return removed, cafs.NewKeyError("delete", "", err)
+	}
+	return removed, cafs.NewBatchError(errs)
+}
+
+// purge unpins keys & deletes their unreachable blocks, holding the
+// blockstore's GC lock so no content is added, pinned or referenced while
+// reachability is computed. keys must be valid. errs has an entry for each
+// key. err is non-nil when reachable content couldn't be determined, in which
+// case nothing is removed. callers must hold a read lock
+func (fs *Filestore) purge(keys []string) (removed []string, errs []error, err error) {
+	ctx := fs.ctx
+	node := fs.node
+	dag := offlineDAG(node)
+	errs = make([]error, len(keys))
+
+	fs.refLk.Lock()
+	defer fs.refLk.Unlock()
+	unlocker := node.Blockstore.GCLock()
+	defer unlocker.Unlock()
+
+	candidates := cid.NewSet()
+	for i, key := range keys {
+		k, _ := parseKey("delete", key)
+		nd, err := resolve(ctx, node, dag, k)
+		if err != nil {
+			if !isNotFound(err) {
+				errs[i] = keyError("delete", key, err)
+			}
+			continue
+		}
+
+		if err := node.Pinning.Unpin(ctx, nd.Cid(), true); err == nil {
+			fs.events.Emit(cafs.EventUnpin, key)
+		} else if err != pin.ErrNotPinned {
+			errs[i] = keyError("delete", key, err)
+			continue
+		}
+
+		if err := localBlocks(ctx, dag, nd, candidates); err != nil {
+			errs[i] = keyError("delete", key, err)
+		}
+	}
+	if err := node.Pinning.Flush(); err != nil {
+		return nil, errs, err
+	}
+
+	keep, err := fs.reachable(ctx)
+	if err != nil {
+		return nil, errs, err
+	}
+
+	err = candidates.ForEach(func(c cid.Cid) error {
+		if keep.Has(c) {
+			return nil
+		}
+		if err := node.Blockstore.DeleteBlock(c); err != nil {
+			return err
+		}
+		removed = append(removed, pathFromHash(c.String()))
+		return nil
+	})
+	if err != nil {
+		return removed, errs, err
+	}
+
+	for i, key := range keys {
+		if errs[i] == nil {
+			fs.events.Emit(cafs.EventDelete, key)
+		}
+	}
+	if len(removed) > 0 {
+		log.Infof("deleted %d blocks for %d keys", len(removed), len(keys))
+	}
+	return removed, errs, nil
+}
+
+// localBlocks adds the id of every locally stored block in the DAG beneath
+// nd to set. Missing blocks are skipped
+func localBlocks(ctx context.Context, dag ipld.DAGService, nd ipld.Node, set *cid.Set) error {
+	if !set.Visit(nd.Cid()) {
+		return nil
+	}
+	for _, l := range nd.Links() {
+		if set.Has(l.Cid) {
+			continue
+		}
+		child, err := dag.Get(ctx, l.Cid)
+		if err != nil {
+			if isNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if err := localBlocks(ctx, dag, child, set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reachable returns the set of blocks that must be kept: everything
+// reachable from pins, and local blocks beneath GC roots. Only local blocks
+// are read, and reachability is an error if any pinned block is missing, so
+// deletes never remove content that might be pinned. callers must hold a
+// read lock & refLk
+func (fs *Filestore) reachable(ctx context.Context) (*cid.Set, error) {
+	roots, err := fs.gcRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	output := make(chan gc.Result, 16)
+	go func() {
+		for res := range output {
+			log.Debugf("computing reachable blocks: %s", res.Error)
+		}
+	}()
+	keep, err := gc.ColoredSet(ctx, fs.node.Pinning, offlineDAG(fs.node), roots, output)
+	close(output)
+	return keep, err
+}
@@ -0,0 +1,60 @@
+package ipfs_filestore
+
+import (
+	"context"
+	"errors"
+
+	cafs "github.com/qri-io/cafs"
+
+	ipld "gx/ipfs/QmR7TcHkR9nxkUorfi8XMTAMLUK7GiP64TWWBzY3aacc1o/go-ipld-format"
+	resolver "gx/ipfs/QmT3rzed1ppXefourpmoZ7tyVQfsGPQZ1pHDngLmCvXxd3/go-path/resolver"
+	namesys "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/namesys"
+	"gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/pin"
+	blockservice "gx/ipfs/QmWfhv1D18DRSiSm73r4QGcByspzPtxxRTcmHW3axFXZo8/go-blockservice"
+	ds "gx/ipfs/QmaRb5yNXKonhbkpNxNawoydk4N6es6b4fPj19sjEKsh5D/go-datastore"
+	blockstore "gx/ipfs/QmcDDgAXDbpDUpadCJKLr49KYR4HuL7T8Z1dZTHt6ixsoR/go-ipfs-blockstore"
+	routing "gx/ipfs/QmcQ81jSyWCp1jpkQ8CMbtpXT3jK7Wg6ZtYmoyWFgBoF9c/go-libp2p-routing"
+)
+
+// keyError wraps an error returned by the ipfs node in a cafs.KeyError,
+// translating ipfs errors to their cafs equivalents so callers can use
+// errors.Is regardless of backend
+func keyError(op, key string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return cafs.NewKeyError(op, key, translateError(err))
+}
+
+func translateError(err error) error {
+	if isNotFound(err) {
+		return cafs.ErrNotFound
+	}
+	switch {
+	case errors.Is(err, pin.ErrNotPinned):
+		return cafs.ErrNotPinned
+	case errors.Is(err, context.DeadlineExceeded):
+		return cafs.ErrTimeout
+	}
+	return err
+}
+
+// isNotFound checks for the handful of errors ipfs uses to signal
+// content or names don't exist, including when they've been wrapped
+func isNotFound(err error) bool {
+	for _, target := range []error{
+		ipld.ErrNotFound,
+		blockstore.ErrNotFound,
+		blockservice.ErrNotFound,
+		namesys.ErrResolveFailed,
+		ds.ErrNotFound,
+		// returned when the network has no record of a name
+		routing.ErrNotFound,
+	} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	var noLink resolver.ErrNoLink
+	return errors.As(err, &noLink)
+}
@@ -0,0 +1,159 @@
+package ipfs_filestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	cafs "github.com/qri-io/cafs"
+
+	ipld "gx/ipfs/QmR7TcHkR9nxkUorfi8XMTAMLUK7GiP64TWWBzY3aacc1o/go-ipld-format"
+	merkledag "gx/ipfs/QmSei8kFMfqdJq7Q68d2LMnHbTWKKg2daA29ezUYFAUNgc/go-merkledag"
+	path "gx/ipfs/QmT3rzed1ppXefourpmoZ7tyVQfsGPQZ1pHDngLmCvXxd3/go-path"
+	resolver "gx/ipfs/QmT3rzed1ppXefourpmoZ7tyVQfsGPQZ1pHDngLmCvXxd3/go-path/resolver"
+	ma "gx/ipfs/QmT4U94DnD8FRfqr21obWY32HLM5VExccPKMjQHofeYqr9/go-multiaddr"
+	offline "gx/ipfs/QmT6dHGp3UYd3vUMpy7rzX2CXQv7HLcj42Vtq8qwwjgASb/go-ipfs-exchange-offline"
+	core "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core"
+	blockservice "gx/ipfs/QmWfhv1D18DRSiSm73r4QGcByspzPtxxRTcmHW3axFXZo8/go-blockservice"
+	peer "gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
+	pstore "gx/ipfs/QmZ9zH2FnLcxv1xyzFeUpDUeo55xEhZQHgveZijcxr7TLj/go-libp2p-peerstore"
+	uio "gx/ipfs/QmfB3oNXGGq9S4B2a9YeCajoATms3Zw2VvDm8fK7VeLSV8/go-unixfs/io"
+)
+
+// Fetch gets a file from source, making sure all of its content is in the
+// local repo before returning. Sources are interpreted as:
+//   - cafs.SourceLocal: only content that's already in the repo. Missing
+//     content fails fast with cafs.ErrNotFound, without using the network
+//   - cafs.SourceAny: content is found with the node's content routing
+//   - a peer ID, or a multiaddr ending in /ipfs/<peer ID>: the node connects
+//     to the peer before fetching, so content can come directly from it
+//
+// Fetching content that isn't local requires an online node, & returns
+// cafs.ErrOffline otherwise. Fetches are limited by the source's timeout if
+// it's a cafs.TimeoutSource, or StoreCfg.FetchTimeout if it isn't, and return
+// cafs.ErrTimeout when the limit is exceeded
+func (fs *Filestore) Fetch(source cafs.Source, key string) (cafs.File, error) {
+	k, err := parseKey("fetch", key)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.rlock("fetch", key); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	ctx, cancel := fs.fetchContext(source)
+	defer cancel()
+
+	addr := source.Address()
+	local := addr == cafs.SourceLocal.Address()
+	online := fs.node.OnlineMode()
+
+	dag := fs.node.DAG
+	if local {
+		dag = offlineDAG(fs.node)
+	} else if online && addr != cafs.SourceAny.Address() {
+		if err := connect(ctx, fs.node, addr); err != nil {
+			return nil, fetchError(ctx, key, err)
+		}
+	}
+
+	if err := fetchGraph(ctx, fs.node, dag, k); err != nil {
+		if !local && !online && isNotFound(err) {
+			return nil, cafs.NewKeyError("fetch", key, cafs.ErrOffline)
+		}
+		return nil, fetchError(ctx, key, err)
+	}
+	return fs.getKey(key)
+}
+
+// fetchContext creates a context for a fetch from source, which is cancelled
+// when the store closes
+func (fs *Filestore) fetchContext(source cafs.Source) (context.Context, context.CancelFunc) {
+	timeout := fs.cfg.FetchTimeout
+	if ts, ok := source.(cafs.TimeoutSource); ok {
+		timeout = ts.Timeout()
+	}
+	if timeout <= 0 {
+		return context.WithCancel(fs.ctx)
+	}
+	return context.WithTimeout(fs.ctx, timeout)
+}
+
+// fetchError converts an error encountered while fetching, reporting errors
+// caused by an expired fetch context as timeouts
+func fetchError(ctx context.Context, key string, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return cafs.NewKeyError("fetch", key, cafs.ErrTimeout)
+	}
+	return keyError("fetch", key, err)
+}
+
+// offlineDAG creates a DAG service that only reads from the node's local
+// blockstore
+func offlineDAG(node *core.IpfsNode) ipld.DAGService {
+	return merkledag.NewDAGService(blockservice.New(node.Blockstore, offline.Exchange(node.Blockstore)))
+}
+
+// resolve finds the node a key refers to, reading blocks from dag
+func resolve(ctx context.Context, node *core.IpfsNode, dag ipld.DAGService, k cafs.Key) (ipld.Node, error) {
+	r := &resolver.Resolver{DAG: dag, ResolveOnce: uio.ResolveUnixfsOnce}
+	return core.Resolve(ctx, node.Namesys, r, path.Path(k.String()))
+}
+
+// fetchGraph resolves a key & retrieves every block beneath it from dag
+func fetchGraph(ctx context.Context, node *core.IpfsNode, dag ipld.DAGService, k cafs.Key) error {
+	nd, err := resolve(ctx, node, dag, k)
+	if err != nil {
+		return err
+	}
+	return merkledag.FetchGraph(ctx, nd.Cid(), dag)
+}
+
+// connect connects the node to the peer a source address identifies
+func connect(ctx context.Context, node *core.IpfsNode, addr string) error {
+	pi, err := parsePeer(addr)
+	if err != nil {
+		return err
+	}
+	if err := node.PeerHost.Connect(ctx, pi); err != nil {
+		return fmt.Errorf("connecting to peer %s: %s", pi.ID.Pretty(), err)
+	}
+	return nil
+}
+
+// parsePeer reads peer info from a peer ID or a multiaddr ending in
+// /ipfs/<peer ID>. peer IDs without addresses are found with peer routing
+// when connecting
+func parsePeer(addr string) (pstore.PeerInfo, error) {
+	pi := pstore.PeerInfo{}
+	if !strings.HasPrefix(addr, "/") {
+		id, err := peer.IDB58Decode(addr)
+		if err != nil {
+			return pi, fmt.Errorf("invalid source %q: %s", addr, err)
+		}
+		pi.ID = id
+		return pi, nil
+	}
+
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return pi, fmt.Errorf("invalid source %q: %s", addr, err)
+	}
+	pid, err := maddr.ValueForProtocol(ma.P_IPFS)
+	if err != nil {
+		return pi, fmt.Errorf("invalid source %q: multiaddr sources must end with /ipfs/<peer ID>", addr)
+	}
+	if pi.ID, err = peer.IDB58Decode(pid); err != nil {
+		return pi, fmt.Errorf("invalid source %q: %s", addr, err)
+	}
+
+	if !strings.HasPrefix(addr, "/ipfs/") {
+		tail, err := ma.NewMultiaddr("/ipfs/" + pid)
+		if err != nil {
+			return pi, err
+		}
+		pi.Addrs = []ma.Multiaddr{maddr.Decapsulate(tail)}
+	}
+	return pi, nil
+}
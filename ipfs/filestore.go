@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	logging "github.com/ipfs/go-log"
 	cafs "github.com/qri-io/cafs"
@@ -16,26 +19,51 @@ import (
 	// Qri to writing IPLD. Lots to think about.
 	coreunix "github.com/qri-io/cafs/ipfs/coreunix"
 
-	path "gx/ipfs/QmT3rzed1ppXefourpmoZ7tyVQfsGPQZ1pHDngLmCvXxd3/go-path"
 	core "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core"
 	coreapi "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/coreapi"
 	coreiface "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/coreapi/interface"
 	corerepo "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/corerepo"
+	gc "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/pin/gc"
 	files "gx/ipfs/QmZMWMvWMVKCbHetJ4RgndbuEF1io2UpUxwQwtNjtYPzSC/go-ipfs-files"
-	ipfsds "gx/ipfs/QmaRb5yNXKonhbkpNxNawoydk4N6es6b4fPj19sjEKsh5D/go-datastore"
 )
 
 var log = logging.Logger("cafs/ipfs")
 
 const prefix = "ipfs"
 
+// ipnsPrefix is the prefix of mutable names, which resolve to ipfs content
+const ipnsPrefix = "ipns"
+
 type Filestore struct {
-	cfg  *StoreCfg
-	node *core.IpfsNode
-	capi coreiface.CoreAPI
+	cfg    *StoreCfg
+	node   *core.IpfsNode
+	capi   coreiface.CoreAPI
+	events *cafs.Events
+
+	// ctx is cancelled when the store is closed, stopping adder goroutines
+	ctx    context.Context
+	cancel context.CancelFunc
+	// ownsNode is false when the node was supplied by configuration. stores
+	// only close nodes they create
+	ownsNode bool
+	// apiDone is closed when the HTTP api stops serving
+	apiDone chan struct{}
+	// active tracks open files & adders using node
+	active *activity
+	// status is the current Status, accessed atomically
+	status int32
+	// refs is loaded from the repo on first use. refLk guards refs, & is
+	// acquired before blockstore locks
+	refs  *cafs.Refs
+	refLk sync.Mutex
+
+	// lk guards node, capi & other fields replaced by transitions. operations
+	// hold a read lock for the duration of the call
+	lk           sync.RWMutex
+	transitionLk sync.Mutex
 }
 
-func (f Filestore) PathPrefix() string {
+func (fs *Filestore) PathPrefix() string {
 	return prefix
 }
 
@@ -45,112 +73,197 @@ func NewFilestore(config ...Option) (*Filestore, error) {
 		option(cfg)
 	}
 
+	fs := &Filestore{
+		cfg:    cfg,
+		events: cafs.NewEvents(),
+		active: newActivity(),
+	}
+	fs.ctx, fs.cancel = context.WithCancel(cfg.Ctx)
+
 	if cfg.Node != nil {
-		return &Filestore{
-			cfg:  cfg,
-			node: cfg.Node,
-			capi: coreapi.NewCoreAPI(cfg.Node),
-		}, nil
+		fs.node = cfg.Node
+		fs.capi = coreapi.NewCoreAPI(cfg.Node)
+		fs.status = int32(nodeStatus(cfg.Node))
+		return fs, nil
 	}
 
 	if err := cfg.InitRepo(); err != nil {
+		fs.cancel()
 		return nil, err
 	}
 
-	node, err := core.NewNode(cfg.Ctx, &cfg.BuildCfg)
+	node, err := newNode(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("error creating ipfs node: %s\n", err.Error())
+		fs.cancel()
+		return nil, err
 	}
-
-	return &Filestore{
-		cfg:  cfg,
-		node: node,
-		capi: coreapi.NewCoreAPI(node),
-	}, nil
+	fs.node = node
+	fs.capi = coreapi.NewCoreAPI(node)
+	fs.ownsNode = true
+	fs.status = int32(nodeStatus(node))
+	return fs, nil
 }
 
-func (fs *Filestore) Node() *core.IpfsNode {
-	return fs.node
+// nodeStatus returns the status of a running node
+func nodeStatus(node *core.IpfsNode) Status {
+	if node.OnlineMode() {
+		return StatusOnline
+	}
+	return StatusOffline
 }
 
-func (fs *Filestore) Online() bool {
-	return fs.node.OnlineMode()
+// rlock acquires a read lock for an operation, returning ErrClosed if the
+// store has no node. callers must release the lock if err is nil
+func (fs *Filestore) rlock(op, key string) error {
+	fs.lk.RLock()
+	if fs.node == nil {
+		fs.lk.RUnlock()
+		return cafs.NewKeyError(op, key, cafs.ErrClosed)
+	}
+	return nil
 }
 
-func (fs *Filestore) GoOnline() error {
-	cfg := fs.cfg
-	cfg.BuildCfg.Online = true
+// newNode builds a node from cfg. The node takes ownership of cfg.Repo,
+// closing it along with the node. If building fails the repo is closed
+// immediately, releasing the repo lock. Offline nodes are given offline
+// routing
+func newNode(cfg *StoreCfg) (*core.IpfsNode, error) {
 	node, err := core.NewNode(cfg.Ctx, &cfg.BuildCfg)
 	if err != nil {
-		return fmt.Errorf("error creating ipfs node: %s\n", err.Error())
+		if cfg.Repo != nil {
+			cfg.Repo.Close()
+			cfg.Repo = nil
+		}
+		return nil, fmt.Errorf("error creating ipfs node: %s\n", err.Error())
 	}
-
-	*fs = Filestore{
-		cfg:  cfg,
-		node: node,
-		capi: coreapi.NewCoreAPI(node),
+	// offline nodes need offline routing to publish & resolve names
+	if !cfg.Online {
+		if err := node.SetupOfflineRouting(); err != nil {
+			node.Close()
+			cfg.Repo = nil
+			return nil, fmt.Errorf("error setting up offline routing: %s", err.Error())
+		}
 	}
+	return node, nil
+}
 
-	if cfg.EnableAPI {
-		go func() {
-			if err := fs.serveAPI(); err != nil {
-				log.Errorf("error serving IPFS HTTP api: %s", err)
-			}
-		}()
+var (
+	_ cafs.Subscriber = (*Filestore)(nil)
+	_ cafs.Closer     = (*Filestore)(nil)
+)
+
+// Subscribe returns a channel of store events
+func (fs *Filestore) Subscribe(ctx context.Context, buffer int) <-chan cafs.Event {
+	return fs.events.Subscribe(ctx, buffer)
+}
+
+// Close shuts down the store. Nodes created by the store are closed, which
+// closes the repo & releases its lock, and stops the HTTP api. Nodes supplied
+// with StoreCfg.Node are left running. Close waits for calls in progress, but
+// not for open files & adders. Adders that haven't been closed stop reporting
+// added files, and all event subscriptions end. Operations on a closed store
+// return cafs.ErrClosed. Closing a closed store is a no-op
+func (fs *Filestore) Close() error {
+	fs.transitionLk.Lock()
+	defer fs.transitionLk.Unlock()
+	fs.lk.Lock()
+	defer fs.lk.Unlock()
+	// a failed transition can leave the store without a node, cancel & end
+	// subscriptions regardless
+	fs.cancel()
+	fs.events.Close()
+	if fs.node == nil {
+		return nil
 	}
 
-	return nil
+	var err error
+	if fs.ownsNode {
+		err = fs.node.Close()
+	}
+	// the api shuts down when the node it serves closes
+	if fs.apiDone != nil {
+		<-fs.apiDone
+		fs.apiDone = nil
+	}
+	fs.node = nil
+	fs.capi = nil
+	atomic.StoreInt32(&fs.status, int32(StatusClosed))
+	return err
 }
 
-func (fs *Filestore) Has(key string) (exists bool, err error) {
-	ipfskey := ipfsds.NewKey(key)
+// GC removes content from the repo that isn't pinned, referenced by a ref
+// or in the node's MFS root
+func (fs *Filestore) GC(ctx context.Context) error {
+	if err := fs.rlock("gc", ""); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+	fs.refLk.Lock()
+	defer fs.refLk.Unlock()
 
-	if _, err = core.Resolve(fs.node.Context(), fs.node.Namesys, fs.node.Resolver, path.Path(ipfskey.String())); err != nil {
-		// TODO - return error here?
-		return false, nil
+	roots, err := fs.gcRoots()
+	if err != nil {
+		return err
+	}
+	removed := gc.GC(ctx, fs.node.Blockstore, fs.node.Repo.Datastore(), fs.node.Pinning, roots)
+	if err := corerepo.CollectResult(ctx, removed, nil); err != nil {
+		return err
 	}
+	fs.events.Emit(cafs.EventGC, "")
+	return nil
+}
 
-	return true, nil
+// Node returns the store's current node, which is replaced when the store
+// goes online or offline, and is nil once the store is closed
+func (fs *Filestore) Node() *core.IpfsNode {
+	fs.lk.RLock()
+	defer fs.lk.RUnlock()
+	return fs.node
 }
 
-func (fs *Filestore) Get(key string) (cafs.File, error) {
-	return fs.getKey(key)
+func (fs *Filestore) Online() bool {
+	return fs.Status() == StatusOnline
 }
 
-func (fs *Filestore) Fetch(source cafs.Source, key string) (cafs.File, error) {
+func (fs *Filestore) Get(key string) (cafs.File, error) {
+	if err := fs.rlock("get", key); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
 	return fs.getKey(key)
 }
 
 func (fs *Filestore) Put(file cafs.File, pin bool) (key string, err error) {
-	hash, err := fs.AddFile(file, pin)
-	if err != nil {
-		log.Infof("error adding bytes: %s", err.Error())
-		return
+	if err = fs.rlock("put", ""); err != nil {
+		return "", err
 	}
-	return pathFromHash(hash), nil
-}
+	defer fs.lk.RUnlock()
 
-func (fs *Filestore) Delete(key string) error {
-	// TODO - formally remove files?
-	err := fs.Unpin(key, true)
+	hash, err := fs.addFile(file, pin)
 	if err != nil {
-		if err.Error() == "not pinned" {
-			return nil
-		}
+		log.Infof("error adding bytes: %s", err.Error())
+		return
 	}
-	return nil
+	key = pathFromHash(hash)
+	fs.events.Emit(cafs.EventAdd, key)
+	return key, nil
 }
 
+// getKey gets a file from the current node. callers must hold a read lock
 func (fs *Filestore) getKey(key string) (cafs.File, error) {
-	path, err := coreiface.ParsePath(key)
+	k, err := parseKey("get", key)
 	if err != nil {
 		return nil, err
 	}
+	path, err := coreiface.ParsePath(k.String())
+	if err != nil {
+		return nil, cafs.NewKeyError("get", key, fmt.Errorf("%w: %s", cafs.ErrInvalidKey, err))
+	}
 	file, err := fs.capi.Unixfs().Get(fs.node.Context(), path)
 	if err != nil {
-		return nil, err
+		return nil, keyError("get", key, err)
 	}
-	return cafs.NewMemfileReader(file.FileName(), file), nil
+	return newTrackedFile(cafs.NewMemfileReader(file.FileName(), file), fs.active.start()), nil
 }
 
 // Adder wraps a coreunix adder to conform to the cafs adder interface
@@ -158,6 +271,10 @@ type Adder struct {
 	adder *coreunix.Adder
 	out   chan interface{}
 	added chan cafs.AddedFile
+	// hashNode is a throwaway node used by hash adders, closed with the adder
+	hashNode *core.IpfsNode
+	// done marks the adder inactive, letting transitions proceed
+	done func()
 }
 
 func (a *Adder) AddFile(f cafs.File) error {
@@ -169,6 +286,12 @@ func (a *Adder) Added() chan cafs.AddedFile {
 
 func (a *Adder) Close() error {
 	defer close(a.out)
+	if a.done != nil {
+		defer a.done()
+	}
+	if a.hashNode != nil {
+		defer a.hashNode.Close()
+	}
 	if _, err := a.adder.Finalize(); err != nil {
 		return err
 	}
@@ -176,9 +299,49 @@ func (a *Adder) Close() error {
 }
 
 func (fs *Filestore) NewAdder(pin, wrap bool) (cafs.Adder, error) {
-	node := fs.node
-	ctx := context.Background()
+	if err := fs.rlock("add", ""); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	a, err := newAdder(fs.ctx, fs.node, pin, wrap, fs.events)
+	if err != nil {
+		return nil, err
+	}
+	a.done = fs.active.start()
+	return a, nil
+}
 
+var _ cafs.Hasher = (*Filestore)(nil)
+
+// NewHashAdder creates an adder that calculates keys without writing blocks
+// to the store, equivalent to "ipfs add --only-hash". Like the ipfs command,
+// it adds to a node with a nil repo that's discarded when the adder is closed
+func (fs *Filestore) NewHashAdder(wrap bool) (cafs.Adder, error) {
+	if err := fs.rlock("hash", ""); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	node, err := core.NewNode(fs.node.Context(), &core.BuildCfg{NilRepo: true})
+	if err != nil {
+		return nil, fmt.Errorf("error creating hashing node: %s", err.Error())
+	}
+
+	a, err := newAdder(fs.ctx, node, false, wrap, nil)
+	if err != nil {
+		node.Close()
+		return nil, err
+	}
+	a.hashNode = node
+	a.done = fs.active.start()
+	return a, nil
+}
+
+// newAdder creates an adder. when events is non-nil, an add event is emitted
+// for each top level file. The adder stops reporting added files when ctx is
+// done
+func newAdder(ctx context.Context, node *core.IpfsNode, pin, wrap bool, events *cafs.Events) (*Adder, error) {
 	a, err := coreunix.NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
 	if err != nil {
 		return nil, fmt.Errorf("error allocating adder: %s", err.Error())
@@ -197,12 +360,20 @@ func (fs *Filestore) NewAdder(pin, wrap bool) (cafs.Adder, error) {
 				if ok {
 					output := out.(*coreiface.AddEvent)
 					if len(output.Hash) > 0 {
-						added <- cafs.AddedFile{
+						select {
+						case added <- cafs.AddedFile{
 							Path:  pathFromHash(output.Hash),
 							Name:  output.Name,
 							Hash:  output.Hash,
 							Bytes: output.Bytes,
 							Size:  output.Size,
+						}:
+						case <-ctx.Done():
+							close(added)
+							return
+						}
+						if !strings.Contains(output.Name, "/") {
+							events.Emit(cafs.EventAdd, pathFromHash(output.Hash))
 						}
 					}
 				} else {
@@ -223,13 +394,49 @@ func (fs *Filestore) NewAdder(pin, wrap bool) (cafs.Adder, error) {
 	}, nil
 }
 
+// parseKey validates key is a well-formed path to ipfs content. /ipns/ names
+// are also accepted, and are resolved through the node's name system when
+// they're used. names aren't hashes, so Hash holds the name undecoded. Like
+// cafs.ParseKey, trailing slashes are dropped
+func parseKey(op, key string) (cafs.Key, error) {
+	if strings.HasPrefix(key, "/"+ipnsPrefix+"/") {
+		parts := strings.SplitN(strings.TrimPrefix(key, "/"+ipnsPrefix+"/"), "/", 2)
+		if parts[0] == "" {
+			return cafs.Key{}, cafs.NewKeyError(op, key, fmt.Errorf("%w: ipns name is required", cafs.ErrInvalidKey))
+		}
+		k := cafs.Key{Prefix: ipnsPrefix, Hash: parts[0]}
+		if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+			k.Path = "/" + strings.TrimSuffix(parts[1], "/")
+		}
+		return k, nil
+	}
+
+	k, err := cafs.ParseKey(key)
+	if err != nil {
+		return k, err
+	}
+	if k.Prefix != prefix {
+		return k, cafs.NewKeyError(op, key, fmt.Errorf("%w: prefix %q doesn't match store prefix %q", cafs.ErrInvalidKey, k.Prefix, prefix))
+	}
+	return k, nil
+}
+
 func pathFromHash(hash string) string {
 	return fmt.Sprintf("/%s/%s", prefix, hash)
 }
 
 // AddFile adds a file to the top level IPFS Node
 func (fs *Filestore) AddFile(file cafs.File, pin bool) (hash string, err error) {
-	node := fs.Node()
+	if err = fs.rlock("add", ""); err != nil {
+		return "", err
+	}
+	defer fs.lk.RUnlock()
+	return fs.addFile(file, pin)
+}
+
+// addFile adds a file to the current node. callers must hold a read lock
+func (fs *Filestore) addFile(file cafs.File, pin bool) (hash string, err error) {
+	node := fs.node
 	ctx := context.Background()
 
 	fileAdder, err := coreunix.NewAdder(ctx, node.Pinning, node.Blockstore, node.DAG)
@@ -299,13 +506,33 @@ func (fs *Filestore) AddFile(file cafs.File, pin bool) (hash string, err error)
 }
 
 func (fs *Filestore) Pin(path string, recursive bool) error {
-	_, err := corerepo.Pin(fs.node, fs.capi, fs.node.Context(), []string{path}, recursive)
-	return err
+	if err := fs.rlock("pin", path); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+
+	if _, err := corerepo.Pin(fs.node, fs.capi, fs.node.Context(), []string{path}, recursive); err != nil {
+		return keyError("pin", path, err)
+	}
+	fs.events.Emit(cafs.EventPin, path)
+	return nil
 }
 
 func (fs *Filestore) Unpin(path string, recursive bool) error {
-	_, err := corerepo.Unpin(fs.node, fs.capi, fs.node.Context(), []string{path}, recursive)
-	return err
+	if err := fs.rlock("unpin", path); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+	return fs.unpin(path, recursive)
+}
+
+// unpin unpins a path on the current node. callers must hold a read lock
+func (fs *Filestore) unpin(path string, recursive bool) error {
+	if _, err := corerepo.Unpin(fs.node, fs.capi, fs.node.Context(), []string{path}, recursive); err != nil {
+		return keyError("unpin", path, err)
+	}
+	fs.events.Emit(cafs.EventUnpin, path)
+	return nil
 }
 
 type wrapFile struct {
@@ -1,11 +1,15 @@
 package ipfs_filestore
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/qri-io/cafs"
 	"github.com/qri-io/cafs/test"
@@ -39,6 +43,468 @@ func TestFilestore(t *testing.T) {
 	if err != nil {
 		t.Errorf(err.Error())
 	}
+
+	if err = test.EnsureHasherBehavior(f); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err = test.EnsureBatcherBehavior(f); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err = test.EnsureSubscriberBehavior(f); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err = test.EnsurePinTrackerBehavior(f); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err = test.EnsureReferencerBehavior(f); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err = test.EnsureNameSystemBehavior(f); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	enc, err := cafs.NewEncryptedStore(f, cafs.EncryptionKey{ID: "test", Cipher: cafs.CipherAESGCM, Secret: make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = test.EnsureFilestoreBehavior(enc); err != nil {
+		t.Errorf("encrypted: %s", err.Error())
+	}
+
+	if err = test.EnsureFilestoreBehavior(cafs.NewCompressedStore(f, cafs.OptCompressMinSize(0))); err != nil {
+		t.Errorf("compressed: %s", err.Error())
+	}
+
+	if err = ensureFetchBehavior(f); err != nil {
+		t.Errorf("fetch: %s", err.Error())
+	}
+
+	if err = ensureLocalHasBehavior(f); err != nil {
+		t.Errorf("has: %s", err.Error())
+	}
+
+	if err = ensureDeleteBehavior(f); err != nil {
+		t.Errorf("delete: %s", err.Error())
+	}
+
+	if err = ensureRefRootBehavior(f); err != nil {
+		t.Errorf("refs: %s", err.Error())
+	}
+
+	if err = ensureIPNSKeyBehavior(f); err != nil {
+		t.Errorf("ipns: %s", err.Error())
+	}
+
+	if err = f.PubSubPublish(context.Background(), "topic", []byte("hello")); !errors.Is(err, cafs.ErrOffline) {
+		t.Errorf("expected publishing from an offline store to return ErrOffline, got: %v", err)
+	}
+
+	if _, err = cafs.NewReadOnlyStore(f).Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false); !errors.Is(err, cafs.ErrReadOnly) {
+		t.Errorf("expected read-only put to return ErrReadOnly, got: %v", err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Errorf("error closing filestore: %s", err.Error())
+	}
+	if err = f.Close(); err != nil {
+		t.Errorf("closing a closed filestore should be a no-op, got: %s", err.Error())
+	}
+
+	// closing releases the repo lock, so the repo can be opened again
+	reopened, err := NewFilestore(func(c *StoreCfg) {
+		c.Online = false
+		c.FsRepoPath = path
+	})
+	if err != nil {
+		t.Fatalf("error reopening filestore: %s", err.Error())
+	}
+	// refs are saved in the repo
+	if key, err := reopened.Ref("refs/test/kept"); err != nil || key == "" {
+		t.Errorf("expected refs to persist. key: %q err: %v", key, err)
+	}
+	if err = reopened.Close(); err != nil {
+		t.Errorf("error closing reopened filestore: %s", err.Error())
+	}
+}
+
+// ensureFetchBehavior checks fetching from sources on an offline store
+func ensureFetchBehavior(f *Filestore) error {
+	key, err := f.Put(cafs.NewMemfileBytes("fetch.txt", []byte("fetch me")), false)
+	if err != nil {
+		return err
+	}
+	for _, source := range []cafs.Source{cafs.SourceLocal, cafs.SourceAny, cafs.SourceWithTimeout(cafs.SourceLocal, time.Second)} {
+		file, err := f.Fetch(source, key)
+		if err != nil {
+			return fmt.Errorf("fetching local content from %s: %s", source.Address(), err)
+		}
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return err
+		}
+		if string(data) != "fetch me" {
+			return fmt.Errorf("fetching from %s: expected data to equal 'fetch me', got: %q", source.Address(), string(data))
+		}
+	}
+
+	missing := "/ipfs/QmcbyjMMT5fFtoiWRJiwV8xoiRWJpSRwC6qCFMqp7EXD4Q"
+	if _, err := f.Fetch(cafs.SourceLocal, missing); !errors.Is(err, cafs.ErrNotFound) {
+		return fmt.Errorf("expected fetching missing content locally to return ErrNotFound, got: %v", err)
+	}
+	if _, err := f.Fetch(cafs.SourceAny, missing); !errors.Is(err, cafs.ErrOffline) {
+		return fmt.Errorf("expected fetching missing content while offline to return ErrOffline, got: %v", err)
+	}
+	return nil
+}
+
+// ensureLocalHasBehavior checks Has only consults the local blockstore, and
+// network availability checks require an online node
+func ensureLocalHasBehavior(f *Filestore) error {
+	key, err := f.Put(cafs.NewMemdir("/dir",
+		cafs.NewMemfileBytes("a.txt", []byte("a")),
+		cafs.NewMemfileBytes("b.txt", []byte("b")),
+	), false)
+	if err != nil {
+		return err
+	}
+	for _, k := range []string{key, key + "/a.txt"} {
+		if has, err := f.Has(k); err != nil || !has {
+			return fmt.Errorf("expected Has(%s) to be true. has: %t err: %v", k, has, err)
+		}
+		if has, err := f.HasRecursive(k); err != nil || !has {
+			return fmt.Errorf("expected HasRecursive(%s) to be true. has: %t err: %v", k, has, err)
+		}
+	}
+
+	missing := "/ipfs/QmcbyjMMT5fFtoiWRJiwV8xoiRWJpSRwC6qCFMqp7EXD4Q"
+	start := time.Now()
+	for _, k := range []string{missing, missing + "/a.txt", key + "/missing.txt"} {
+		if has, err := f.Has(k); err != nil || has {
+			return fmt.Errorf("expected Has(%s) to be false. has: %t err: %v", k, has, err)
+		}
+	}
+	if time.Since(start) > time.Second {
+		return fmt.Errorf("checking for missing content took %s, expected Has to return without searching", time.Since(start))
+	}
+
+	if _, err := f.Locate(context.Background(), key, 1); !errors.Is(err, cafs.ErrOffline) {
+		return fmt.Errorf("expected Locate on an offline store to return ErrOffline, got: %v", err)
+	}
+	if err := f.Provide(context.Background(), key); !errors.Is(err, cafs.ErrOffline) {
+		return fmt.Errorf("expected Provide on an offline store to return ErrOffline, got: %v", err)
+	}
+	return nil
+}
+
+// ensureDeleteBehavior checks deleting removes blocks from the blockstore,
+// keeping blocks other pins still reference
+func ensureDeleteBehavior(f *Filestore) error {
+	kept, err := f.Put(cafs.NewMemdir("/kept",
+		cafs.NewMemfileBytes("shared.txt", []byte("shared content")),
+	), true)
+	if err != nil {
+		return err
+	}
+	deleted, err := f.Put(cafs.NewMemdir("/deleted",
+		cafs.NewMemfileBytes("shared.txt", []byte("shared content")),
+		cafs.NewMemfileBytes("private.txt", []byte("private content")),
+	), true)
+	if err != nil {
+		return err
+	}
+	unpinned, err := f.Put(cafs.NewMemfileBytes("unpinned.txt", []byte("unpinned content")), false)
+	if err != nil {
+		return err
+	}
+
+	removed, err := f.Purge(deleted, unpinned)
+	if err != nil {
+		return fmt.Errorf("Purge error: %s", err.Error())
+	}
+	// the deleted directory, its private file & the unpinned file
+	if len(removed) != 3 {
+		return fmt.Errorf("expected Purge to remove 3 blocks, removed: %v", removed)
+	}
+	for _, k := range []string{deleted, deleted + "/private.txt", unpinned} {
+		if has, err := f.Has(k); err != nil || has {
+			return fmt.Errorf("expected Has(%s) to be false after delete. has: %t err: %v", k, has, err)
+		}
+	}
+	if has, err := f.HasRecursive(kept); err != nil || !has {
+		return fmt.Errorf("expected content shared with a pinned key to be kept. has: %t err: %v", has, err)
+	}
+
+	if err := f.Delete(deleted); err != nil {
+		return fmt.Errorf("deleting missing content should be a no-op, got: %s", err.Error())
+	}
+	if err := f.Delete(kept); err != nil {
+		return err
+	}
+	if has, err := f.Has(kept + "/shared.txt"); err != nil || has {
+		return fmt.Errorf("expected shared content to be removed with its last pin. has: %t err: %v", has, err)
+	}
+	return nil
+}
+
+// ensureRefRootBehavior checks GC & Delete keep content refs point to. The
+// ref it creates is left in place to check refs persist
+func ensureRefRootBehavior(f *Filestore) error {
+	key, err := f.Put(cafs.NewMemfileBytes("ref.txt", []byte("referenced content")), false)
+	if err != nil {
+		return err
+	}
+	if err := f.UpdateRef("refs/test/kept", "", key); err != nil {
+		return err
+	}
+	if err := f.GC(context.Background()); err != nil {
+		return err
+	}
+	if has, err := f.Has(key); err != nil || !has {
+		return fmt.Errorf("expected GC to keep referenced content. has: %t err: %v", has, err)
+	}
+	if err := f.Delete(key); err != nil {
+		return err
+	}
+	if has, err := f.Has(key); err != nil || !has {
+		return fmt.Errorf("expected Delete to keep referenced content. has: %t err: %v", has, err)
+	}
+
+	unreferenced, err := f.Put(cafs.NewMemfileBytes("unreferenced.txt", []byte("unreferenced content")), false)
+	if err != nil {
+		return err
+	}
+	if err := f.GC(context.Background()); err != nil {
+		return err
+	}
+	if has, err := f.Has(unreferenced); err != nil || has {
+		return fmt.Errorf("expected GC to remove unreferenced content. has: %t err: %v", has, err)
+	}
+	return nil
+}
+
+// ensureIPNSKeyBehavior checks /ipns/ names can be used as keys, resolving to
+// the content they're published to
+func ensureIPNSKeyBehavior(f *Filestore) error {
+	key, err := f.Put(cafs.NewMemdir("/named",
+		cafs.NewMemfileBytes("a.txt", []byte("named content")),
+	), true)
+	if err != nil {
+		return err
+	}
+	name, err := f.Publish(context.Background(), "self", key, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, k := range []string{name, name + "/a.txt"} {
+		if has, err := f.Has(k); err != nil || !has {
+			return fmt.Errorf("expected Has(%s) to be true. has: %t err: %v", k, has, err)
+		}
+	}
+	file, err := f.Get(name + "/a.txt")
+	if err != nil {
+		return fmt.Errorf("error getting %s: %s", name+"/a.txt", err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	if string(data) != "named content" {
+		return fmt.Errorf("expected %s to resolve to the published content, got: %q", name, data)
+	}
+	return nil
+}
+
+func TestParseKey(t *testing.T) {
+	hash := "QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S"
+	cases := []struct {
+		key, prefix, hash, path, str string
+	}{
+		{"/ipfs/" + hash, "ipfs", hash, "", "/ipfs/" + hash},
+		{"/ipfs/" + hash + "/a.txt", "ipfs", hash, "/a.txt", "/ipfs/" + hash + "/a.txt"},
+		// trailing slashes are dropped
+		{"/ipfs/" + hash + "/dir/", "ipfs", hash, "/dir", "/ipfs/" + hash + "/dir"},
+		{"/ipns/" + hash, "ipns", hash, "", "/ipns/" + hash},
+		{"/ipns/example.com/a.txt", "ipns", "example.com", "/a.txt", "/ipns/example.com/a.txt"},
+		{"/ipns/example.com/", "ipns", "example.com", "", "/ipns/example.com"},
+	}
+	for _, c := range cases {
+		k, err := parseKey("test", c.key)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.key, err)
+			continue
+		}
+		if k.Prefix != c.prefix || k.Hash != c.hash || k.Path != c.path {
+			t.Errorf("%s: expected prefix %q hash %q path %q, got: %q %q %q", c.key, c.prefix, c.hash, c.path, k.Prefix, k.Hash, k.Path)
+		}
+		if k.String() != c.str {
+			t.Errorf("%s: expected string %s, got: %s", c.key, c.str, k.String())
+		}
+	}
+
+	for _, key := range []string{"/ipns/", "/map/" + hash, "/ipfs/not-a-hash"} {
+		if _, err := parseKey("test", key); !errors.Is(err, cafs.ErrInvalidKey) {
+			t.Errorf("%s: expected ErrInvalidKey, got: %v", key, err)
+		}
+	}
+}
+
+func TestParsePeer(t *testing.T) {
+	id := "QmaCpDMGvV2BGHeYERUEnRQAwe3N8SzbUtfsmvsqQLuvuJ"
+	cases := []struct {
+		addr  string
+		addrs int
+		err   bool
+	}{
+		{id, 0, false},
+		{"/ipfs/" + id, 0, false},
+		{"/ip4/104.131.131.82/tcp/4001/ipfs/" + id, 1, false},
+		{"/ip4/104.131.131.82/tcp/4001", 0, true},
+		{"not_a_peer_id", 0, true},
+		{"/not/a/multiaddr", 0, true},
+	}
+
+	for _, c := range cases {
+		pi, err := parsePeer(c.addr)
+		if c.err {
+			if err == nil {
+				t.Errorf("%s: expected error", c.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", c.addr, err)
+			continue
+		}
+		if pi.ID.Pretty() != id {
+			t.Errorf("%s: expected peer id %s, got: %s", c.addr, id, pi.ID.Pretty())
+		}
+		if len(pi.Addrs) != c.addrs {
+			t.Errorf("%s: expected %d addresses, got: %d", c.addr, c.addrs, len(pi.Addrs))
+		}
+	}
+}
+
+func TestFilestoreTransitions(t *testing.T) {
+	if testing.Short() {
+		t.Skip("going online opens network listeners")
+	}
+
+	path := filepath.Join(os.TempDir(), "ipfs_cafs_test_transitions")
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		t.Fatalf("error creating temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(path)
+	if err := InitRepo(path, ""); err != nil {
+		t.Fatalf("error intializing repo: %s", err.Error())
+	}
+
+	statuses := make(chan Status, 10)
+	f, err := NewFilestore(func(c *StoreCfg) {
+		c.Online = false
+		c.FsRepoPath = path
+	}, OptStatusCallback(func(s Status, err error) {
+		if err != nil {
+			t.Errorf("unexpected transition error: %s", err)
+		}
+		statuses <- s
+	}))
+	if err != nil {
+		t.Fatalf("error creating filestore: %s", err.Error())
+	}
+	defer f.Close()
+
+	key, err := f.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gets must succeed while the store changes state
+	done := make(chan struct{})
+	getErrs := make(chan error, 1)
+	go func() {
+		defer close(getErrs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			file, err := f.Get(key)
+			if err == nil {
+				_, err = ioutil.ReadAll(file)
+			}
+			if err != nil {
+				getErrs <- err
+				return
+			}
+		}
+	}()
+
+	// an open adder is carried through the transition
+	adder, err := f.NewAdder(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adder.AddFile(cafs.NewMemfileBytes("b.txt", []byte("b"))); err != nil {
+		t.Fatal(err)
+	}
+	online := make(chan error)
+	go func() { online <- f.GoOnline() }()
+	if err := adder.Close(); err != nil {
+		t.Errorf("error closing adder: %s", err)
+	}
+	if err := <-online; err != nil {
+		t.Fatalf("error going online: %s", err)
+	}
+	if !f.Online() {
+		t.Error("expected store to be online")
+	}
+	if err := f.GoOnline(); err != nil {
+		t.Errorf("going online when online should be a no-op, got: %s", err)
+	}
+	if err := f.GoOffline(); err != nil {
+		t.Fatalf("error going offline: %s", err)
+	}
+	if f.Online() {
+		t.Error("expected store to be offline")
+	}
+
+	close(done)
+	if err := <-getErrs; err != nil {
+		t.Errorf("get failed during transition: %s", err)
+	}
+
+	expect := []Status{StatusGoingOnline, StatusOnline, StatusGoingOffline, StatusOffline}
+	close(statuses)
+	got := []Status{}
+	for s := range statuses {
+		got = append(got, s)
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expected statuses %v, got: %v", expect, got)
+	}
+	for i, s := range expect {
+		if got[i] != s {
+			t.Errorf("status %d: expected %s, got: %s", i, s, got[i])
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Get(key); !errors.Is(err, cafs.ErrClosed) {
+		t.Errorf("expected get on a closed store to return ErrClosed, got: %v", err)
+	}
+	if err := f.GoOnline(); !errors.Is(err, cafs.ErrClosed) {
+		t.Errorf("expected going online after close to return ErrClosed, got: %v", err)
+	}
 }
 
 func BenchmarkRead(b *testing.B) {
@@ -66,6 +532,7 @@ func BenchmarkRead(b *testing.B) {
 		b.Errorf("error creating filestore: %s", err.Error())
 		return
 	}
+	defer f.Close()
 
 	egFilePath := "testdata/complete.json"
 	data, err := ioutil.ReadFile(egFilePath)
@@ -0,0 +1,118 @@
+package ipfs_filestore
+
+import (
+	"context"
+	"fmt"
+
+	cafs "github.com/qri-io/cafs"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+)
+
+var _ cafs.Locator = (*Filestore)(nil)
+
+// Has checks the local blockstore for the block a key refers to, resolving
+// paths through local blocks only. Has never uses the network, and reports
+// false for content that isn't stored locally. Use HasRecursive to check the
+// entire DAG beneath a key, and Locate to check the network
+func (fs *Filestore) Has(key string) (exists bool, err error) {
+	return fs.hasLocal("has", key, false)
+}
+
+// HasRecursive checks the local blockstore for every block in the DAG a key
+// refers to, reporting false if any block is missing. Like Has, it never
+// uses the network
+func (fs *Filestore) HasRecursive(key string) (exists bool, err error) {
+	return fs.hasLocal("has", key, true)
+}
+
+func (fs *Filestore) hasLocal(op, key string, recursive bool) (bool, error) {
+	k, err := parseKey(op, key)
+	if err != nil {
+		return false, err
+	}
+	if err = fs.rlock(op, key); err != nil {
+		return false, err
+	}
+	defer fs.lk.RUnlock()
+
+	dag := offlineDAG(fs.node)
+	if recursive {
+		err = fetchGraph(fs.ctx, fs.node, dag, k)
+	} else {
+		_, err = resolve(fs.ctx, fs.node, dag, k)
+	}
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, keyError(op, key, err)
+	}
+	return true, nil
+}
+
+// Locate asks the network for up to max peers that can provide the root of
+// key. Sources are peer IDs that can be passed to Fetch. Locate requires an
+// online node, and returns cafs.ErrOffline otherwise. When ctx is done Locate
+// returns the sources found so far
+func (fs *Filestore) Locate(ctx context.Context, key string, max int) ([]cafs.Source, error) {
+	c, err := fs.routingCid("locate", key)
+	if err != nil {
+		return nil, err
+	}
+	if err = fs.rlock("locate", key); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+	if !fs.node.OnlineMode() {
+		return nil, cafs.NewKeyError("locate", key, cafs.ErrOffline)
+	}
+
+	sources := []cafs.Source{}
+	for pi := range fs.node.Routing.FindProvidersAsync(ctx, c, max) {
+		// the local node is a provider of content it stores
+		if pi.ID == fs.node.Identity {
+			continue
+		}
+		sources = append(sources, cafs.NewSource(pi.ID.Pretty()))
+	}
+	return sources, nil
+}
+
+// Provide announces to the network that the node can provide the root of
+// key. Provide requires an online node, and returns cafs.ErrOffline otherwise
+func (fs *Filestore) Provide(ctx context.Context, key string) error {
+	c, err := fs.routingCid("provide", key)
+	if err != nil {
+		return err
+	}
+	if err = fs.rlock("provide", key); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+	if !fs.node.OnlineMode() {
+		return cafs.NewKeyError("provide", key, cafs.ErrOffline)
+	}
+
+	if err := fs.node.Routing.Provide(ctx, c, true); err != nil {
+		return keyError("provide", key, err)
+	}
+	return nil
+}
+
+// routingCid returns the root content id of key, which identifies content to
+// the network. ipns names don't identify content, and must be resolved first
+func (fs *Filestore) routingCid(op, key string) (cid.Cid, error) {
+	k, err := parseKey(op, key)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if k.Prefix == ipnsPrefix {
+		return cid.Cid{}, cafs.NewKeyError(op, key, fmt.Errorf("%w: ipns names must be resolved to an /ipfs/ key", cafs.ErrInvalidKey))
+	}
+	c, err := cid.Decode(k.Hash)
+	if err != nil {
+		return cid.Cid{}, cafs.NewKeyError(op, key, cafs.ErrInvalidKey)
+	}
+	return c, nil
+}
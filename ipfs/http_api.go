@@ -9,16 +9,17 @@ import (
 	ipfs_corehttp "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/corehttp"
 )
 
-// serveAPI makes an IPFS node available over an HTTP api
-func (fs *Filestore) serveAPI() error {
-	if fs.node == nil {
+// serveAPI makes an IPFS node available over an HTTP api, returning when the
+// node is closed
+func (fs *Filestore) serveAPI(node *ipfs_core.IpfsNode) error {
+	if node == nil {
 		return fmt.Errorf("node is required to serve IPFS HTTP API")
 	}
 
 	cfg := fs.cfg
 	addr := ""
-	if cfg.Repo != nil {
-		if ipfscfg, err := cfg.Repo.Config(); err == nil {
+	if node.Repo != nil {
+		if ipfscfg, err := node.Repo.Config(); err == nil {
 			// TODO (b5): apparantly ipfs config supports multiple API multiaddrs?
 			// I dunno, for now just go with the most likely case of only assigning
 			// an address if one string is supplied
@@ -31,7 +32,7 @@ func (fs *Filestore) serveAPI() error {
 	opts := []ipfs_corehttp.ServeOption{
 		ipfs_corehttp.GatewayOption(true, "/ipfs", "/ipns"),
 		ipfs_corehttp.WebUIOption,
-		ipfs_corehttp.CommandsOption(cmdCtx(fs.node, cfg.FsRepoPath)),
+		ipfs_corehttp.CommandsOption(cmdCtx(node, cfg.FsRepoPath)),
 	}
 
 	// TODO (b5): I've added this fmt.Println because the corehttp package includes a println
@@ -39,7 +40,7 @@ func (fs *Filestore) serveAPI() error {
 	// users. We should chat with the protocol folks about making that print statement mutable
 	// or configurable
 	fmt.Println("starting IPFS HTTP API:")
-	return ipfs_corehttp.ListenAndServe(fs.node, addr, opts...)
+	return ipfs_corehttp.ListenAndServe(node, addr, opts...)
 }
 
 // extracted from github.com/ipfs/go-ipfs/cmd/ipfswatch/main.go
@@ -0,0 +1,128 @@
+package ipfs_filestore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	cafs "github.com/qri-io/cafs"
+
+	coreiface "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/coreapi/interface"
+	options "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/coreapi/interface/options"
+)
+
+var _ cafs.NameSystem = (*Filestore)(nil)
+
+// Publish publishes an IPNS record pointing the name controlled by keyName
+// at key. Offline stores keep records in the repo, where they can be
+// resolved locally, and publish them to the network once online
+func (fs *Filestore) Publish(ctx context.Context, keyName, key string, lifetime, ttl time.Duration) (string, error) {
+	if _, err := parseKey("publish", key); err != nil {
+		return "", err
+	}
+	if err := fs.rlock("publish", key); err != nil {
+		return "", err
+	}
+	defer fs.lk.RUnlock()
+	if fs.node.Namesys == nil {
+		return "", cafs.NewKeyError("publish", key, cafs.ErrNotSupported)
+	}
+
+	if exists, err := fs.hasNameKey(keyName); err != nil {
+		return "", cafs.NewKeyError("publish", keyName, err)
+	} else if !exists {
+		return "", cafs.NewKeyError("publish", keyName, cafs.ErrNotFound)
+	}
+
+	p, err := coreiface.ParsePath(key)
+	if err != nil {
+		return "", cafs.NewKeyError("publish", key, cafs.ErrInvalidKey)
+	}
+	if lifetime <= 0 {
+		lifetime = cafs.DefaultNameLifetime
+	}
+	opts := []options.NamePublishOption{
+		options.Name.Key(keyName),
+		options.Name.ValidTime(lifetime),
+	}
+	if ttl > 0 {
+		opts = append(opts, options.Name.TTL(ttl))
+	}
+
+	entry, err := fs.capi.Name().Publish(ctx, p, opts...)
+	if err != nil {
+		return "", keyError("publish", key, err)
+	}
+	return "/ipns/" + entry.Name(), nil
+}
+
+// Resolve returns the key an IPNS name points to. names must begin with
+// /ipns/. Offline stores only resolve records in the repo
+func (fs *Filestore) Resolve(ctx context.Context, name string) (string, error) {
+	if !strings.HasPrefix(name, "/ipns/") {
+		return "", cafs.NewKeyError("resolve", name, fmt.Errorf("%w: names must begin with /ipns/", cafs.ErrInvalidKey))
+	}
+	if err := fs.rlock("resolve", name); err != nil {
+		return "", err
+	}
+	defer fs.lk.RUnlock()
+	if fs.node.Namesys == nil {
+		return "", cafs.NewKeyError("resolve", name, cafs.ErrNotSupported)
+	}
+
+	p, err := fs.capi.Name().Resolve(ctx, name)
+	if err != nil {
+		return "", keyError("resolve", name, err)
+	}
+	return p.String(), nil
+}
+
+// GenerateKey creates a keypair in the repo keystore for publishing a new
+// name
+func (fs *Filestore) GenerateKey(ctx context.Context, keyName string) (cafs.NameKey, error) {
+	if err := fs.rlock("genkey", keyName); err != nil {
+		return cafs.NameKey{}, err
+	}
+	defer fs.lk.RUnlock()
+
+	if exists, err := fs.hasNameKey(keyName); err != nil {
+		return cafs.NameKey{}, cafs.NewKeyError("genkey", keyName, err)
+	} else if exists {
+		return cafs.NameKey{}, cafs.NewKeyError("genkey", keyName, cafs.ErrKeyExists)
+	}
+
+	k, err := fs.capi.Key().Generate(ctx, keyName)
+	if err != nil {
+		return cafs.NameKey{}, cafs.NewKeyError("genkey", keyName, err)
+	}
+	return cafs.NameKey{Name: k.Name(), ID: k.Path().String()}, nil
+}
+
+// ListKeys returns the node's identity, named "self", and the keys in the
+// repo keystore
+func (fs *Filestore) ListKeys(ctx context.Context) ([]cafs.NameKey, error) {
+	if err := fs.rlock("listkeys", ""); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	list, err := fs.capi.Key().List(ctx)
+	if err != nil {
+		return nil, cafs.NewKeyError("listkeys", "", err)
+	}
+	keys := make([]cafs.NameKey, len(list))
+	for i, k := range list {
+		keys[i] = cafs.NameKey{Name: k.Name(), ID: k.Path().String()}
+	}
+	return keys, nil
+}
+
+// hasNameKey checks if there's a key named keyName. callers must hold a read
+// lock
+func (fs *Filestore) hasNameKey(keyName string) (bool, error) {
+	if keyName == "self" {
+		return true, nil
+	}
+	return fs.node.Repo.Keystore().Has(keyName)
+}
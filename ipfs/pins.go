@@ -0,0 +1,151 @@
+package ipfs_filestore
+
+import (
+	"errors"
+
+	cafs "github.com/qri-io/cafs"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	merkledag "gx/ipfs/QmSei8kFMfqdJq7Q68d2LMnHbTWKKg2daA29ezUYFAUNgc/go-merkledag"
+	"gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/pin"
+)
+
+var _ cafs.PinTracker = (*Filestore)(nil)
+
+// ListPins returns pinned keys of the given kinds from the node's pinner.
+// Listing indirect pins walks the DAG beneath every recursive pin, reading
+// only local blocks
+func (fs *Filestore) ListPins(kinds cafs.PinKind) ([]cafs.Pin, error) {
+	if err := fs.rlock("listpins", ""); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	pins := []cafs.Pin{}
+	seen := cid.NewSet()
+	add := func(kind cafs.PinKind, cids []cid.Cid) {
+		for _, c := range cids {
+			if seen.Visit(c) && kinds&kind != 0 {
+				pins = append(pins, cafs.Pin{Key: pathFromHash(c.String()), Kind: kind})
+			}
+		}
+	}
+
+	recursive := fs.node.Pinning.RecursiveKeys()
+	add(cafs.PinRecursive, recursive)
+	add(cafs.PinDirect, fs.node.Pinning.DirectKeys())
+
+	if kinds&cafs.PinIndirect != 0 {
+		indirect := cid.NewSet()
+		getLinks := merkledag.GetLinksWithDAG(offlineDAG(fs.node))
+		for _, c := range recursive {
+			if err := merkledag.EnumerateChildren(fs.ctx, getLinks, c, indirect.Visit); err != nil {
+				return nil, keyError("listpins", pathFromHash(c.String()), err)
+			}
+		}
+		add(cafs.PinIndirect, indirect.Keys())
+	}
+	return pins, nil
+}
+
+// IsPinned reports whether key is pinned, and how. keys with a path are
+// resolved through local blocks
+func (fs *Filestore) IsPinned(key string) (cafs.PinKind, bool, error) {
+	if _, err := parseKey("ispinned", key); err != nil {
+		return 0, false, err
+	}
+	if err := fs.rlock("ispinned", key); err != nil {
+		return 0, false, err
+	}
+	defer fs.lk.RUnlock()
+
+	c, err := fs.localCid("ispinned", key)
+	if err != nil {
+		if errors.Is(err, cafs.ErrNotFound) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	reason, pinned, err := fs.node.Pinning.IsPinned(c)
+	if err != nil {
+		return 0, false, keyError("ispinned", key, err)
+	}
+	if !pinned {
+		return 0, false, nil
+	}
+	switch reason {
+	case "recursive":
+		return cafs.PinRecursive, true, nil
+	case "direct":
+		return cafs.PinDirect, true, nil
+	}
+	// other reasons are "indirect through <cid>", and "internal" for blocks
+	// the pinner stores pin sets in, which are kept the same way
+	return cafs.PinIndirect, true, nil
+}
+
+// PinUpdate moves a recursive pin from old to new, only walking the parts
+// of new that differ from old. Content for new is fetched if it isn't local
+func (fs *Filestore) PinUpdate(old, new string) error {
+	if _, err := parseKey("pinupdate", old); err != nil {
+		return err
+	}
+	k, err := parseKey("pinupdate", new)
+	if err != nil {
+		return err
+	}
+	if err := fs.rlock("pinupdate", old); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+
+	from, err := fs.localCid("pinupdate", old)
+	if err != nil {
+		if errors.Is(err, cafs.ErrNotFound) {
+			return cafs.NewKeyError("pinupdate", old, cafs.ErrNotPinned)
+		}
+		return err
+	}
+	nd, err := resolve(fs.ctx, fs.node, fs.node.DAG, k)
+	if err != nil {
+		return keyError("pinupdate", new, err)
+	}
+
+	defer fs.node.Blockstore.PinLock().Unlock()
+	if _, pinned, err := fs.node.Pinning.IsPinnedWithType(from, pin.Recursive); err != nil {
+		return keyError("pinupdate", old, err)
+	} else if !pinned {
+		return cafs.NewKeyError("pinupdate", old, cafs.ErrNotPinned)
+	}
+	if from.Equals(nd.Cid()) {
+		return nil
+	}
+
+	if err := fs.node.Pinning.Update(fs.ctx, from, nd.Cid(), true); err != nil {
+		return keyError("pinupdate", old, err)
+	}
+	if err := fs.node.Pinning.Flush(); err != nil {
+		return keyError("pinupdate", old, err)
+	}
+	fs.events.Emit(cafs.EventPin, new)
+	fs.events.Emit(cafs.EventUnpin, old)
+	return nil
+}
+
+// localCid returns the id of the block key refers to. keys with a path & ipns
+// names are resolved through local blocks, returning cafs.ErrNotFound if a
+// block on the path is missing. callers must hold a read lock
+func (fs *Filestore) localCid(op, key string) (cid.Cid, error) {
+	k, err := parseKey(op, key)
+	if err != nil {
+		return cid.Cid{}, err
+	}
+	if k.Path == "" && k.Prefix == prefix {
+		return fs.routingCid(op, key)
+	}
+	nd, err := resolve(fs.ctx, fs.node, offlineDAG(fs.node), k)
+	if err != nil {
+		return cid.Cid{}, keyError(op, key, err)
+	}
+	return nd.Cid(), nil
+}
@@ -0,0 +1,127 @@
+package ipfs_filestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	cafs "github.com/qri-io/cafs"
+
+	peer "gx/ipfs/QmY5Grm8pJdiSSVsYxx4uNRgweY72EmYwuSDbRnbFok3iY/go-libp2p-peer"
+)
+
+var _ cafs.PubSub = (*Filestore)(nil)
+
+// PubSubPublish publishes data to topic. PubSub requires an online node with
+// pubsub enabled (see OptEnablePubSub), returning cafs.ErrOffline when the
+// store is offline & cafs.ErrNotSupported when pubsub isn't enabled
+func (fs *Filestore) PubSubPublish(ctx context.Context, topic string, data []byte) error {
+	if topic == "" {
+		return cafs.NewKeyError("publish", topic, errEmptyTopic)
+	}
+	if err := fs.rlockPubSub("publish", topic); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+
+	if err := fs.node.Floodsub.Publish(topic, data); err != nil {
+		return cafs.NewKeyError("publish", topic, err)
+	}
+	return nil
+}
+
+// PubSubSubscribe returns a channel of messages published to topic. The
+// channel is closed when ctx is done, or when the node stops, which happens
+// when the store goes offline or closes
+func (fs *Filestore) PubSubSubscribe(ctx context.Context, topic string) (<-chan cafs.Message, error) {
+	if topic == "" {
+		return nil, cafs.NewKeyError("subscribe", topic, errEmptyTopic)
+	}
+	if err := fs.rlockPubSub("subscribe", topic); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	sub, err := fs.node.Floodsub.Subscribe(topic)
+	if err != nil {
+		return nil, cafs.NewKeyError("subscribe", topic, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	nodeDone := fs.node.Context().Done()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-nodeDone:
+			cancel()
+		}
+	}()
+
+	msgs := make(chan cafs.Message, 32)
+	go func() {
+		defer close(msgs)
+		defer cancel()
+		defer sub.Cancel()
+		for {
+			m, err := sub.Next(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Infof("pubsub subscription to %q ended: %s", topic, err)
+				}
+				return
+			}
+			msg := cafs.Message{From: peer.ID(m.GetFrom()).Pretty(), Topic: topic, Data: m.GetData()}
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return msgs, nil
+}
+
+// PubSubTopics lists the topics the node is subscribed to
+func (fs *Filestore) PubSubTopics(ctx context.Context) ([]string, error) {
+	if err := fs.rlockPubSub("topics", ""); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+	return fs.node.Floodsub.GetTopics(), nil
+}
+
+// PubSubPeers lists IDs of peers subscribed to topic, or all peers using
+// pubsub if topic is ""
+func (fs *Filestore) PubSubPeers(ctx context.Context, topic string) ([]string, error) {
+	if err := fs.rlockPubSub("peers", topic); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+
+	ids := fs.node.Floodsub.ListPeers(topic)
+	peers := make([]string, len(ids))
+	for i, id := range ids {
+		peers[i] = id.Pretty()
+	}
+	return peers, nil
+}
+
+// errEmptyTopic is returned when publishing or subscribing without a topic
+var errEmptyTopic = errors.New("topic is empty")
+
+// rlockPubSub acquires a read lock for a pubsub operation, checking the node
+// can use pubsub. callers must release the lock if err is nil
+func (fs *Filestore) rlockPubSub(op, topic string) error {
+	if err := fs.rlock(op, topic); err != nil {
+		return err
+	}
+	if !fs.node.OnlineMode() {
+		fs.lk.RUnlock()
+		return cafs.NewKeyError(op, topic, cafs.ErrOffline)
+	}
+	if fs.node.Floodsub == nil {
+		fs.lk.RUnlock()
+		return cafs.NewKeyError(op, topic, fmt.Errorf("%w: pubsub isn't enabled", cafs.ErrNotSupported))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package ipfs_filestore
+
+import (
+	"encoding/json"
+	"errors"
+
+	cafs "github.com/qri-io/cafs"
+
+	cid "gx/ipfs/QmPSQnBKM9g7BaUcZCvswUJVscQ1ipjmwxN5PXCjkp9EQ7/go-cid"
+	corerepo "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/corerepo"
+	ds "gx/ipfs/QmaRb5yNXKonhbkpNxNawoydk4N6es6b4fPj19sjEKsh5D/go-datastore"
+)
+
+// refsKey is the repo datastore key refs are saved under
+var refsKey = ds.NewKey("/cafs/refs")
+
+var _ cafs.Referencer = (*Filestore)(nil)
+
+// Ref returns the key a ref points to
+func (fs *Filestore) Ref(name string) (string, error) {
+	refs, err := fs.readRefs("ref", name)
+	if err != nil {
+		return "", err
+	}
+	return refs.Ref(name)
+}
+
+// UpdateRef points a ref at new if it currently points at old, saving refs
+// in the repo's datastore. Referenced content is kept by GC & Delete, as if
+// it were pinned. keys don't need to be stored locally, content that isn't
+// stored is kept once it's added
+func (fs *Filestore) UpdateRef(name, old, new string) error {
+	if new != "" {
+		if _, err := parseKey("updateref", new); err != nil {
+			return err
+		}
+	}
+	if err := fs.rlock("updateref", name); err != nil {
+		return err
+	}
+	defer fs.lk.RUnlock()
+	fs.refLk.Lock()
+	defer fs.refLk.Unlock()
+	// GC can't run while refs are changing
+	defer fs.node.Blockstore.PinLock().Unlock()
+
+	refs, err := fs.loadRefs()
+	if err != nil {
+		return cafs.NewKeyError("updateref", name, err)
+	}
+	next := refs.Clone()
+	if err := next.UpdateRef(name, old, new); err != nil {
+		return err
+	}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return cafs.NewKeyError("updateref", name, err)
+	}
+	if err := fs.node.Repo.Datastore().Put(refsKey, data); err != nil {
+		return cafs.NewKeyError("updateref", name, err)
+	}
+	fs.refs = next
+	return nil
+}
+
+// ListRefs returns refs with names beginning with prefix
+func (fs *Filestore) ListRefs(prefix string) ([]cafs.Ref, error) {
+	refs, err := fs.readRefs("listrefs", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return refs.ListRefs(prefix)
+}
+
+// RefHistory returns changes to a ref, newest first
+func (fs *Filestore) RefHistory(name string) ([]cafs.RefUpdate, error) {
+	refs, err := fs.readRefs("refhistory", name)
+	if err != nil {
+		return nil, err
+	}
+	return refs.RefHistory(name)
+}
+
+// readRefs returns the store's refs for a read-only operation
+func (fs *Filestore) readRefs(op, name string) (*cafs.Refs, error) {
+	if err := fs.rlock(op, name); err != nil {
+		return nil, err
+	}
+	defer fs.lk.RUnlock()
+	fs.refLk.Lock()
+	defer fs.refLk.Unlock()
+
+	refs, err := fs.loadRefs()
+	if err != nil {
+		return nil, cafs.NewKeyError(op, name, err)
+	}
+	return refs, nil
+}
+
+// loadRefs reads refs from the repo datastore the first time they're used.
+// callers must hold a read lock & refLk
+func (fs *Filestore) loadRefs() (*cafs.Refs, error) {
+	if fs.refs != nil {
+		return fs.refs, nil
+	}
+	refs := cafs.NewRefs()
+	data, err := fs.node.Repo.Datastore().Get(refsKey)
+	if err == nil {
+		if err = json.Unmarshal(data, refs); err != nil {
+			return nil, err
+		}
+	} else if err != ds.ErrNotFound {
+		return nil, err
+	}
+	fs.refs = refs
+	return refs, nil
+}
+
+// gcRoots returns the ids of blocks GC must keep in addition to pinned
+// content: the node's MFS root, and content refs point to. gc keeps blocks
+// beneath these roots that are stored locally, skipping missing ones.
+// callers must hold a read lock & refLk, and must acquire refLk before
+// taking blockstore locks
+func (fs *Filestore) gcRoots() ([]cid.Cid, error) {
+	var roots []cid.Cid
+	if fs.node.FilesRoot != nil {
+		var err error
+		if roots, err = corerepo.BestEffortRoots(fs.node.FilesRoot); err != nil {
+			return nil, err
+		}
+	}
+
+	refs, err := fs.loadRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range refs.Roots() {
+		c, err := fs.localCid("gc", key)
+		if err != nil {
+			if errors.Is(err, cafs.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		roots = append(roots, c)
+	}
+	return roots, nil
+}
@@ -0,0 +1,275 @@
+package ipfs_filestore
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cafs "github.com/qri-io/cafs"
+
+	coreapi "gx/ipfs/QmUJYo4etAQqFfSS2rarFAE97eNGB8ej64YkRT2SmsYD4r/go-ipfs/core/coreapi"
+)
+
+// Status describes the network state of a Filestore
+type Status int32
+
+const (
+	// StatusOffline means the node isn't connected to the network
+	StatusOffline Status = iota
+	// StatusGoingOnline means the store is replacing its offline node with an
+	// online one
+	StatusGoingOnline
+	// StatusOnline means the node is connected to the network
+	StatusOnline
+	// StatusGoingOffline means the store is replacing its online node with an
+	// offline one
+	StatusGoingOffline
+	// StatusClosed means the store has no node, either because it was closed
+	// or because a transition failed & the previous node couldn't be restored
+	StatusClosed
+)
+
+// String implements the fmt.Stringer interface
+func (s Status) String() string {
+	switch s {
+	case StatusOffline:
+		return "offline"
+	case StatusGoingOnline:
+		return "going online"
+	case StatusOnline:
+		return "online"
+	case StatusGoingOffline:
+		return "going offline"
+	case StatusClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("Status(%d)", s)
+}
+
+// Status returns the current network state of the store without waiting for
+// transitions to finish
+func (fs *Filestore) Status() Status {
+	return Status(atomic.LoadInt32(&fs.status))
+}
+
+// setStatus updates the store status, calling the configured status callback
+func (fs *Filestore) setStatus(s Status, err error) {
+	atomic.StoreInt32(&fs.status, int32(s))
+	if fs.cfg.StatusCallback != nil {
+		fs.cfg.StatusCallback(s, err)
+	}
+}
+
+// GoOnline connects the store to the network. See GoOffline for details of
+// how transitions affect operations in progress
+func (fs *Filestore) GoOnline() error {
+	return fs.transition(true)
+}
+
+// GoOffline disconnects the store from the network. The repo can only be held
+// by one node at a time, so a transition closes the current node & opens a new
+// one on the same repo. The transition first waits for open adders & files
+// returned by Get to be closed, read to the end or garbage collected, up to
+// StoreCfg.DrainTimeout, while calls continue to use the current node. Calls
+// in progress when the node is replaced finish first, and calls started
+// while it's replaced wait for the new node instead of failing. Adders &
+// files still open after the timeout fail.
+// Transitioning to the current state is a no-op. If the new node can't be
+// built the previous state is restored, and the transition error is returned.
+// If the previous node can't be restored either the store is closed
+func (fs *Filestore) GoOffline() error {
+	return fs.transition(false)
+}
+
+// transition replaces the store's node with one that's online or offline
+func (fs *Filestore) transition(online bool) error {
+	from, during, to := StatusOffline, StatusGoingOnline, StatusOnline
+	if !online {
+		from, during, to = StatusOnline, StatusGoingOffline, StatusOffline
+	}
+
+	// transitionLk serializes transitions. status callbacks are called
+	// without holding lk, so callbacks can use the store, but they're called
+	// holding transitionLk, so they can't start another transition
+	fs.transitionLk.Lock()
+	defer fs.transitionLk.Unlock()
+
+	switch fs.Status() {
+	case StatusClosed:
+		return cafs.ErrClosed
+	case to:
+		return nil
+	}
+	if !fs.ownsNode {
+		return fmt.Errorf("can't go %s with a node supplied by configuration", to)
+	}
+
+	fs.setStatus(during, nil)
+
+	// drain without holding lk so calls in progress, which hold a read lock,
+	// & calls that start while draining aren't held up by the wait. active is
+	// only replaced by transitions, so it's safe to read under transitionLk
+	if !fs.active.drain(fs.cfg.DrainTimeout) {
+		log.Infof("timed out after %s waiting for open files & adders before going %s", fs.cfg.DrainTimeout, to)
+	}
+
+	fs.lk.Lock()
+	err := fs.replaceNode(online)
+	if err != nil {
+		if rerr := fs.replaceNode(!online); rerr != nil {
+			err = fmt.Errorf("going %s: %s. restoring %s node: %s", to, err, from, rerr)
+			from = StatusClosed
+			// the store is left without a node, stop adders & end
+			// subscriptions as Close would
+			fs.cancel()
+			fs.events.Close()
+		}
+	}
+	fs.lk.Unlock()
+
+	if err != nil {
+		fs.setStatus(from, err)
+		return err
+	}
+	fs.setStatus(to, nil)
+	return nil
+}
+
+// replaceNode closes the current node & builds a new one on the same repo.
+// callers must hold the write lock
+func (fs *Filestore) replaceNode(online bool) error {
+	cfg := fs.cfg
+	if fs.node != nil {
+		if err := fs.node.Close(); err != nil {
+			return fmt.Errorf("error closing ipfs node: %s", err.Error())
+		}
+		if fs.apiDone != nil {
+			<-fs.apiDone
+			fs.apiDone = nil
+		}
+		// closing the node closed the repo
+		cfg.Repo = nil
+		fs.node = nil
+	}
+
+	cfg.BuildCfg.Online = online
+	if err := cfg.InitRepo(); err != nil {
+		return err
+	}
+	node, err := newNode(cfg)
+	if err != nil {
+		return err
+	}
+	fs.node = node
+	fs.capi = coreapi.NewCoreAPI(node)
+	fs.active = newActivity()
+
+	if online && cfg.EnableAPI {
+		fs.apiDone = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			if err := fs.serveAPI(node); err != nil {
+				log.Errorf("error serving IPFS HTTP api: %s", err)
+			}
+		}(fs.apiDone)
+	}
+	return nil
+}
+
+// activity counts open files & adders using a node
+type activity struct {
+	lk   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func newActivity() *activity {
+	idle := make(chan struct{})
+	close(idle)
+	return &activity{idle: idle}
+}
+
+// start records the beginning of an activity, returning a func that records
+// its end. the returned func is safe to call more than once
+func (a *activity) start() (done func()) {
+	a.lk.Lock()
+	if a.n == 0 {
+		a.idle = make(chan struct{})
+	}
+	a.n++
+	a.lk.Unlock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			a.lk.Lock()
+			a.n--
+			if a.n == 0 {
+				close(a.idle)
+			}
+			a.lk.Unlock()
+		})
+	}
+}
+
+// drain blocks until all activities are done, returning false if timeout
+// elapses first. files that are dropped without being closed end their
+// activity when they're garbage collected, so drain runs a collection if
+// anything is still active
+func (a *activity) drain(timeout time.Duration) bool {
+	a.lk.Lock()
+	idle := a.idle
+	n := a.n
+	a.lk.Unlock()
+
+	if n > 0 {
+		runtime.GC()
+	}
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// trackedFile is a file returned by Get that's active until it's closed,
+// read to the end, or garbage collected
+type trackedFile struct {
+	cafs.File
+	done func()
+}
+
+// newTrackedFile wraps f, calling done when f is finished with. done must be
+// safe to call more than once
+func newTrackedFile(f cafs.File, done func()) *trackedFile {
+	tf := &trackedFile{File: f, done: done}
+	// files that are dropped part way through reading are never closed
+	runtime.SetFinalizer(tf, func(tf *trackedFile) { tf.done() })
+	return tf
+}
+
+func (f *trackedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if err != nil {
+		f.done()
+	}
+	return n, err
+}
+
+// NextFile ends the activity of a directory once its files have been listed
+func (f *trackedFile) NextFile() (cafs.File, error) {
+	next, err := f.File.NextFile()
+	if err != nil {
+		f.done()
+	}
+	return next, err
+}
+
+func (f *trackedFile) Close() error {
+	f.done()
+	return f.File.Close()
+}
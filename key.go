@@ -0,0 +1,167 @@
+package cafs
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/jbenet/go-base58"
+	"github.com/multiformats/go-multihash"
+)
+
+const (
+	// CodecRaw is the multicodec for raw binary content
+	CodecRaw uint64 = 0x55
+	// CodecDagProtobuf is the multicodec for protobuf-encoded merkle-dag
+	// nodes, the implied codec of version 0 keys
+	CodecDagProtobuf uint64 = 0x70
+)
+
+// base32 multibase encoding used by CIDv1 strings: lowercase, no padding
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Key is a parsed content-addressed path of the form /[prefix]/[hash]/[path],
+// eg: /ipfs/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/data.json
+// Filestores continue to accept & return keys as strings, Key exists to give
+// keys a single, validated parsing
+type Key struct {
+	// Prefix identifies the store the key belongs to, eg: "ipfs", "map"
+	Prefix string
+	// Hash is the encoded content identifier, exactly as it appears in the key
+	Hash string
+	// Version is the CID version of the hash. version 0 hashes are a base58
+	// encoded multihash, version 1 hashes are multibase-encoded CIDs
+	Version uint64
+	// Codec is the multicodec of the content the hash identifies. version 0
+	// keys always report CodecDagProtobuf
+	Codec uint64
+	// Multihash is the decoded hash, which records the hash function used
+	Multihash multihash.Multihash
+	// Path is an optional path within the hashed content, with a leading
+	// slash. eg: "/data.json"
+	Path string
+}
+
+// NewKey creates a version 0 key from a prefix & multihash
+func NewKey(prefix string, mh multihash.Multihash) Key {
+	return Key{
+		Prefix:    prefix,
+		Hash:      mh.B58String(),
+		Codec:     CodecDagProtobuf,
+		Multihash: mh,
+	}
+}
+
+// ParseKey parses & validates a string key. Malformed keys return an error
+// that matches ErrInvalidKey. Trailing slashes are dropped, so a key with a
+// trailing slash is formatted by String without one
+func ParseKey(key string) (Key, error) {
+	if !strings.HasPrefix(key, "/") {
+		return Key{}, invalidKey(key, "keys must start with a '/'")
+	}
+
+	parts := strings.SplitN(key[1:], "/", 3)
+	if len(parts) < 2 || parts[1] == "" {
+		return Key{}, invalidKey(key, "keys must have the form /[prefix]/[hash]")
+	}
+	if parts[0] == "" {
+		return Key{}, invalidKey(key, "prefix is required")
+	}
+
+	k := Key{Prefix: parts[0], Hash: parts[1]}
+	if len(parts) == 3 && parts[2] != "" {
+		k.Path = "/" + strings.TrimSuffix(parts[2], "/")
+	}
+
+	if err := k.decodeHash(); err != nil {
+		return Key{}, invalidKey(key, err.Error())
+	}
+	return k, nil
+}
+
+// decodeHash populates version, codec & multihash fields from the hash string
+func (k *Key) decodeHash() error {
+	// multibase-prefixed CIDv1 strings are tried first, falling back to a
+	// base58 multihash. 'b' and 'z' are both valid base58 characters, so a
+	// failed CID parse isn't an error on its own
+	if v1, err := parseCIDv1(k.Hash); err == nil {
+		k.Version = 1
+		k.Codec = v1.codec
+		k.Multihash = v1.mh
+		return nil
+	}
+
+	mh, err := castMultihash(base58.Decode(k.Hash))
+	if err != nil {
+		return fmt.Errorf("hash %q is not a valid multihash or CID", k.Hash)
+	}
+	k.Version = 0
+	k.Codec = CodecDagProtobuf
+	k.Multihash = mh
+	return nil
+}
+
+type cidV1 struct {
+	codec uint64
+	mh    multihash.Multihash
+}
+
+func parseCIDv1(s string) (c cidV1, err error) {
+	if len(s) < 2 {
+		return c, fmt.Errorf("too short")
+	}
+
+	var data []byte
+	switch s[0] {
+	case 'b':
+		if data, err = base32Encoding.DecodeString(strings.ToUpper(s[1:])); err != nil {
+			return c, err
+		}
+	case 'z':
+		if data = base58.Decode(s[1:]); len(data) == 0 {
+			return c, fmt.Errorf("invalid base58")
+		}
+	default:
+		return c, fmt.Errorf("unsupported multibase prefix: %q", s[0])
+	}
+
+	version, n := binary.Uvarint(data)
+	if n <= 0 || version != 1 {
+		return c, fmt.Errorf("unsupported CID version")
+	}
+	data = data[n:]
+	codec, n := binary.Uvarint(data)
+	if n <= 0 {
+		return c, fmt.Errorf("invalid CID codec")
+	}
+	if c.mh, err = castMultihash(data[n:]); err != nil {
+		return c, err
+	}
+	c.codec = codec
+	return c, nil
+}
+
+// String returns the key in its canonical string form
+func (k Key) String() string {
+	return "/" + k.Prefix + "/" + k.Hash + k.Path
+}
+
+// Root returns a copy of the key without a path component
+func (k Key) Root() Key {
+	k.Path = ""
+	return k
+}
+
+// Join returns a copy of the key with path elements appended to the path
+func (k Key) Join(elems ...string) Key {
+	path := strings.Trim(strings.Join(elems, "/"), "/")
+	if path != "" {
+		k.Path = k.Path + "/" + path
+	}
+	return k
+}
+
+func invalidKey(key, reason string) error {
+	return NewKeyError("parse key", key, fmt.Errorf("%w: %s", ErrInvalidKey, reason))
+}
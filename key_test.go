@@ -0,0 +1,107 @@
+package cafs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+func TestParseKey(t *testing.T) {
+	cases := []struct {
+		key     string
+		prefix  string
+		hash    string
+		version uint64
+		codec   uint64
+		mhCode  uint64
+		path    string
+	}{
+		{"/ipfs/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S", "ipfs", "QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S", 0, CodecDagProtobuf, multihash.SHA2_256, ""},
+		{"/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/data.json", "map", "QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S", 0, CodecDagProtobuf, multihash.SHA2_256, "/data.json"},
+		{"/ipfs/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/a/b/c.txt", "ipfs", "QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S", 0, CodecDagProtobuf, multihash.SHA2_256, "/a/b/c.txt"},
+		{"/ipfs/bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", "ipfs", "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi", 1, CodecDagProtobuf, multihash.SHA2_256, ""},
+		{"/map/bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", "map", "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku", 1, CodecRaw, multihash.SHA2_256, ""},
+	}
+
+	for i, c := range cases {
+		k, err := ParseKey(c.key)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		if k.Prefix != c.prefix {
+			t.Errorf("case %d prefix mismatch. expected: %s, got: %s", i, c.prefix, k.Prefix)
+		}
+		if k.Hash != c.hash {
+			t.Errorf("case %d hash mismatch. expected: %s, got: %s", i, c.hash, k.Hash)
+		}
+		if k.Version != c.version {
+			t.Errorf("case %d version mismatch. expected: %d, got: %d", i, c.version, k.Version)
+		}
+		if k.Codec != c.codec {
+			t.Errorf("case %d codec mismatch. expected: %x, got: %x", i, c.codec, k.Codec)
+		}
+		dec, err := multihash.Decode(k.Multihash)
+		if err != nil {
+			t.Errorf("case %d error decoding multihash: %s", i, err.Error())
+		} else if dec.Code != c.mhCode {
+			t.Errorf("case %d multihash code mismatch. expected: %x, got: %x", i, c.mhCode, dec.Code)
+		}
+		if k.Path != c.path {
+			t.Errorf("case %d path mismatch. expected: %s, got: %s", i, c.path, k.Path)
+		}
+		if k.String() != c.key {
+			t.Errorf("case %d round trip mismatch. expected: %s, got: %s", i, c.key, k.String())
+		}
+	}
+}
+
+func TestParseKeyErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"no-match",
+		"/",
+		"/ipfs",
+		"/ipfs/",
+		"//QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S",
+		"ipfs/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S",
+		"/ipfs/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5",
+		"/ipfs/not-a-hash",
+		"/map/0OIl",
+	}
+
+	for i, c := range cases {
+		if _, err := ParseKey(c); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("case %d %q expected ErrInvalidKey, got: %v", i, c, err)
+		}
+	}
+}
+
+func TestKeyRootJoin(t *testing.T) {
+	k, err := ParseKey("/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := k.Root().String(); got != "/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S" {
+		t.Errorf("root mismatch. got: %s", got)
+	}
+	if got := k.Join("b", "c.txt").String(); got != "/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/a/b/c.txt" {
+		t.Errorf("join mismatch. got: %s", got)
+	}
+}
+
+func TestParseKeyTrailingSlash(t *testing.T) {
+	for _, key := range []string{
+		"/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/",
+		"/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S/a/",
+	} {
+		k, err := ParseKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := k.String(); got != key[:len(key)-1] {
+			t.Errorf("%s: expected trailing slash to be dropped, got: %s", key, got)
+		}
+	}
+}
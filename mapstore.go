@@ -2,12 +2,17 @@ package cafs
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/jbenet/go-base58"
 	"github.com/multiformats/go-multihash"
 )
 
@@ -16,6 +21,11 @@ func NewMapstore() *MapStore {
 	return &MapStore{
 		Network: make([]*MapStore, 0),
 		Files:   make(map[string]filer),
+		pins:    make(map[string]PinKind),
+		refs:    NewRefs(),
+		names:   make(map[string]nameRecord),
+		topics:  newTopics(),
+		events:  NewEvents(),
 	}
 }
 
@@ -23,16 +33,18 @@ func NewMapstore() *MapStore {
 //
 // An example pulled from tests will create a tree of "cafs"
 // with directories & cafs, with paths properly set:
-// NewMemdir("/a",
-// 	NewMemfileBytes("a.txt", []byte("foo")),
-// 	NewMemfileBytes("b.txt", []byte("bar")),
-// 	NewMemdir("/c",
-// 		NewMemfileBytes("d.txt", []byte("baz")),
-// 		NewMemdir("/e",
-// 			NewMemfileBytes("f.txt", []byte("bat")),
-// 		),
-// 	),
-// )
+//
+//	NewMemdir("/a",
+//		NewMemfileBytes("a.txt", []byte("foo")),
+//		NewMemfileBytes("b.txt", []byte("bar")),
+//		NewMemdir("/c",
+//			NewMemfileBytes("d.txt", []byte("baz")),
+//			NewMemdir("/e",
+//				NewMemfileBytes("f.txt", []byte("bat")),
+//			),
+//		),
+//	)
+//
 // File is an interface that provides functionality for handling
 // cafs/directories as values that can be supplied to commands.
 //
@@ -44,10 +56,50 @@ func NewMapstore() *MapStore {
 //
 // Network simulates IPFS-like behavior, where nodes can connect
 // to each other to retrieve data from other machines
+//
+// Setting Verify checks content returned by Get & Fetch hashes to the
+// requested key, which guards against misbehaving peers on the Network.
+// Reads of files that don't match return an *IntegrityError
+//
+// HashFunc & KeyEncoding configure the keys the store creates. Both must be
+// set before adding content, and connected stores should agree on them.
+// The zero values produce base58-encoded SHA2-256 keys
+//
+// MapStore implements Subscriber, emitting events from Put, Delete, Pin,
+// Unpin & adders
+//
+// MapStore implements PinTracker, recording pins for each key. Unlike IPFS,
+// keys can be pinned without the store having their content. Deleting a key
+// removes its pin
+//
+// The zero value of MapStore is usable, its files and tables for pins, refs
+// & names are allocated on first use
+//
+// MapStore implements Referencer, keeping refs in memory. MapStore has no
+// garbage collection, so refs don't affect Delete
+//
+// MapStore implements NameSystem in memory as a stand-in for IPNS. Names
+// look like /mapns/QmFoo, and resolve through stores on the Network
+//
+// MapStore implements PubSub, delivering messages to subscribers on the
+// store and on stores it's directly connected to. Messages are from the
+// store's ID, which is the hash of its self name
 type MapStore struct {
-	Pinned  bool
-	Network []*MapStore
-	Files   map[string]filer
+	// Deprecated: use IsPinned or ListPins. Pinned is set by Pin & cleared by
+	// Unpin once no keys are pinned
+	Pinned      bool
+	Verify      bool
+	HashFunc    uint64
+	KeyEncoding KeyEncoding
+	Network     []*MapStore
+	Files       map[string]filer
+
+	pins     map[string]PinKind
+	refs     *Refs
+	nameKeys map[string]string
+	names    map[string]nameRecord
+	topics   *topics
+	events   *Events
 }
 
 // PathPrefix returns the prefix on paths in the store
@@ -85,12 +137,16 @@ func (m *MapStore) AddConnection(other *MapStore) {
 // Print converts the store to a string
 func (m MapStore) Print() (string, error) {
 	buf := &bytes.Buffer{}
-	for key, file := range m.Files {
-		data, err := ioutil.ReadAll(file.File())
+	for key, fr := range m.Files {
+		file, err := fr.File()
 		if err != nil {
 			return "", err
 		}
-		fmt.Fprintf(buf, "%s:%s\n\t%s\n", key, file.File().FileName(), string(data))
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(buf, "%s:%s\n\t%s\n", key, file.FileName(), string(data))
 	}
 
 	return buf.String(), nil
@@ -98,6 +154,22 @@ func (m MapStore) Print() (string, error) {
 
 // Put adds a file to the store
 func (m *MapStore) Put(file File, pin bool) (key string, err error) {
+	if key, err = m.put(file, pin, nil); err != nil {
+		return key, err
+	}
+	m.events.Emit(EventAdd, key)
+	if pin {
+		m.setPin(key, PinRecursive)
+	}
+	return key, nil
+}
+
+// put adds a file to the store, calling added for each node in the file tree
+// if it's non-nil. nodes are reported children-first, the root last
+func (m *MapStore) put(file File, pin bool, added func(AddedFile)) (key string, err error) {
+	if m.Files == nil {
+		m.Files = map[string]filer{}
+	}
 	if file.IsDirectory() {
 		buf := bytes.NewBuffer(nil)
 		dir := fsDir{
@@ -109,24 +181,25 @@ func (m *MapStore) Put(file File, pin bool) (key string, err error) {
 		for {
 			f, e := file.NextFile()
 			if e != nil {
-				if e.Error() == "EOF" {
-					dirhash, e := hashBytes(buf.Bytes())
-					if err != nil {
-						err = fmt.Errorf("error hashing file data: %s", e.Error())
+				if e == io.EOF {
+					key, e = m.key(buf.Bytes())
+					if e != nil {
+						err = fmt.Errorf("error hashing file data: %w", e)
 						return
 					}
-
-					key = "/map/" + dirhash
 					m.Files[key] = dir
+					if added != nil {
+						added(AddedFile{Path: key, Name: file.FileName(), Hash: key})
+					}
 					return
 				}
-				err = fmt.Errorf("error getting next file: %s", err.Error())
+				err = fmt.Errorf("error getting next file: %w", e)
 				return
 			}
 
-			hash, e := m.Put(f, pin)
+			hash, e := m.put(f, pin, added)
 			if e != nil {
-				err = fmt.Errorf("error putting file: %s", e.Error())
+				err = fmt.Errorf("error putting file: %w", e)
 				return
 			}
 			key = hash
@@ -141,58 +214,97 @@ func (m *MapStore) Put(file File, pin bool) (key string, err error) {
 	} else {
 		data, e := ioutil.ReadAll(file)
 		if e != nil {
-			err = fmt.Errorf("error reading from file: %s", e.Error())
+			err = fmt.Errorf("error reading from file: %w", e)
 			return
 		}
-		hash, e := hashBytes(data)
-		if e != nil {
-			err = fmt.Errorf("error hashing file data: %s", e.Error())
+		if key, e = m.key(data); e != nil {
+			err = fmt.Errorf("error hashing file data: %w", e)
 			return
 		}
-		key = "/map/" + hash
 		m.Files[key] = fsFile{name: file.FileName(), path: file.FullPath(), data: data}
+		if added != nil {
+			added(AddedFile{Path: key, Name: file.FileName(), Hash: key, Bytes: int64(len(data))})
+		}
 		return
 	}
-	return
+}
+
+// parseKey validates a key belongs to this store, returning the root key
+// string the store indexes files by
+func (m MapStore) parseKey(op, key string) (string, error) {
+	k, err := ParseKey(key)
+	if err != nil {
+		return "", err
+	}
+	if k.Prefix != m.PathPrefix() {
+		return "", NewKeyError(op, key, fmt.Errorf("%w: prefix %q doesn't match store prefix %q", ErrInvalidKey, k.Prefix, m.PathPrefix()))
+	}
+	// key may be of the form /map/QmFoo/file.json but MapStore indexes its maps
+	// using keys like /map/QmFoo
+	return k.Root().String(), nil
 }
 
 // Get returns a File from the store
 func (m *MapStore) Get(key string) (File, error) {
-	// key may be of the form /map/QmFoo/file.json but MapStore indexes its maps
-	// using keys like /map/QmFoo. Trim after the second part of the key.
-	parts := strings.Split(key, "/")
-	if len(parts) > 2 {
-		prefix := strings.Join([]string{"", parts[1], parts[2]}, "/")
-		key = prefix
+	key, err := m.parseKey("get", key)
+	if err != nil {
+		return nil, err
 	}
 	// Check if the local MapStore has the file.
-	f, err := m.getLocal(key)
+	fr, err := m.getLocal(key)
 	if err == nil {
-		return f, nil
-	} else if err != ErrNotFound {
-		return nil, err
+		return m.file(key, fr)
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, NewKeyError("get", key, err)
 	}
 	// Check if the anyone connected on the mock Network has the file.
 	for _, connect := range m.Network {
-		f, err := connect.getLocal(key)
+		fr, err := connect.getLocal(key)
 		if err == nil {
-			return f, nil
-		} else if err != ErrNotFound {
-			return nil, err
+			return m.file(key, fr)
+		} else if !errors.Is(err, ErrNotFound) {
+			return nil, NewKeyError("get", key, err)
 		}
 	}
-	return nil, ErrNotFound
+	return nil, NewKeyError("get", key, ErrNotFound)
 }
 
-func (m *MapStore) getLocal(key string) (File, error) {
+func (m *MapStore) getLocal(key string) (filer, error) {
 	if m.Files[key] == nil {
 		return nil, ErrNotFound
 	}
-	return m.Files[key].File(), nil
+	return m.Files[key], nil
+}
+
+// file converts a stored value to a File, verifying contents if the store is
+// configured to
+func (m *MapStore) file(key string, fr filer) (File, error) {
+	if !m.Verify {
+		return fr.File()
+	}
+
+	switch f := fr.(type) {
+	case fsFile:
+		file, err := f.File()
+		if err != nil {
+			return nil, err
+		}
+		return VerifyFile(file, key)
+	case fsDir:
+		if err := f.verify(key); err != nil {
+			return nil, err
+		}
+		// resolve children through this store so they're verified as well
+		return f.resolve(m)
+	}
+	return fr.File()
 }
 
 // Has returns whether the store has a File with the key
 func (m MapStore) Has(key string) (exists bool, err error) {
+	if key, err = m.parseKey("has", key); err != nil {
+		return false, err
+	}
 	if m.Files[key] == nil {
 		return false, nil
 	}
@@ -201,94 +313,525 @@ func (m MapStore) Has(key string) (exists bool, err error) {
 
 // Delete removes the file from the store with the key
 func (m MapStore) Delete(key string) error {
+	key, err := m.parseKey("delete", key)
+	if err != nil {
+		return err
+	}
 	delete(m.Files, key)
+	if m.pins[key] != 0 {
+		delete(m.pins, key)
+		m.events.Emit(EventUnpin, key)
+	}
+	m.events.Emit(EventDelete, key)
 	return nil
 }
 
 // NewAdder returns an Adder for the store
-func (m MapStore) NewAdder(pin, wrap bool) (Adder, error) {
-	addedOut := make(chan AddedFile, 9)
-	return &adder{
-		mapstore: m,
-		out:      addedOut,
-	}, nil
+func (m *MapStore) NewAdder(pin, wrap bool) (Adder, error) {
+	return newAdder(m, pin), nil
+}
+
+// NewHashAdder returns an Adder that computes keys for added files without
+// writing to the store. Content is added to a scratch store that's discarded
+// along with the adder
+func (m MapStore) NewHashAdder(wrap bool) (Adder, error) {
+	scratch := NewMapstore()
+	scratch.HashFunc = m.HashFunc
+	scratch.KeyEncoding = m.KeyEncoding
+	return scratch.NewAdder(false, wrap)
 }
 
 var _ Fetcher = (*MapStore)(nil)
-var _ Pinner = (*MapStore)(nil)
+var _ PinTracker = (*MapStore)(nil)
+var _ Hasher = (*MapStore)(nil)
+var _ Subscriber = (*MapStore)(nil)
+var _ Closer = (*MapStore)(nil)
+var _ Referencer = (*MapStore)(nil)
+var _ NameSystem = (*MapStore)(nil)
+var _ PubSub = (*MapStore)(nil)
+
+// Subscribe returns a channel of store events. Stores that weren't created
+// with NewMapstore must subscribe before being used concurrently
+func (m *MapStore) Subscribe(ctx context.Context, buffer int) <-chan Event {
+	if m.events == nil {
+		m.events = NewEvents()
+	}
+	return m.events.Subscribe(ctx, buffer)
+}
+
+// Close ends all event & topic subscriptions
+func (m *MapStore) Close() error {
+	m.topics.close()
+	return m.events.Close()
+}
 
 // Fetch returns a File from the store
 func (m *MapStore) Fetch(source Source, key string) (File, error) {
 	// TODO: Perhaps Fetch should hit the network but Get should not?
 	// Also, see comment in ./ipfs/filestore.go about local lists and integrating Fetch.
+	if source.Address() == SourceLocal.Address() {
+		key, err := m.parseKey("fetch", key)
+		if err != nil {
+			return nil, err
+		}
+		fr, err := m.getLocal(key)
+		if err != nil {
+			return nil, NewKeyError("fetch", key, err)
+		}
+		return m.file(key, fr)
+	}
 	if len(m.Network) == 0 {
 		// TODO: Fetch only local files in this case. Fix test that depends on this.
-		return nil, fmt.Errorf("this store cannot fetch from remote sources")
+		return nil, NewKeyError("fetch", key, ErrOffline)
 	}
 	return m.Get(key)
 }
 
 // Pin pins a File with the given key
 func (m *MapStore) Pin(key string, recursive bool) error {
-	if m.Pinned {
-		return fmt.Errorf("already pinned")
+	key, err := m.parseKey("pin", key)
+	if err != nil {
+		return err
 	}
-	m.Pinned = true
+	kind := PinDirect
+	if recursive {
+		kind = PinRecursive
+	}
+	if current := m.pins[key]; current == kind || current == PinRecursive {
+		return NewKeyError("pin", key, ErrAlreadyPinned)
+	}
+	m.setPin(key, kind)
 	return nil
 }
 
-// Unpin unpins a File with the given key
+// Unpin unpins a File with the given key. Recursive pins can only be
+// removed by a recursive unpin
 func (m *MapStore) Unpin(key string, recursive bool) error {
-	if !m.Pinned {
-		return fmt.Errorf("not pinned")
+	key, err := m.parseKey("unpin", key)
+	if err != nil {
+		return err
+	}
+	switch m.pins[key] {
+	case 0:
+		return NewKeyError("unpin", key, ErrNotPinned)
+	case PinRecursive:
+		if !recursive {
+			return NewKeyError("unpin", key, ErrPinnedRecursively)
+		}
+	}
+	delete(m.pins, key)
+	m.Pinned = len(m.pins) > 0
+	m.events.Emit(EventUnpin, key)
+	return nil
+}
+
+// setPin records a pin & emits EventPin, allocating the pin table for stores
+// that weren't created with NewMapstore
+func (m *MapStore) setPin(key string, kind PinKind) {
+	if m.pins == nil {
+		m.pins = map[string]PinKind{}
+	}
+	m.pins[key] = kind
+	m.Pinned = true
+	m.events.Emit(EventPin, key)
+}
+
+// ListPins returns pinned keys of the given kinds, sorted by key
+func (m *MapStore) ListPins(kinds PinKind) ([]Pin, error) {
+	pins := []Pin{}
+	for key, kind := range m.pins {
+		if kinds&kind != 0 {
+			pins = append(pins, Pin{Key: key, Kind: kind})
+		}
+	}
+	if kinds&PinIndirect != 0 {
+		for key := range m.indirectPins() {
+			if m.pins[key] == 0 {
+				pins = append(pins, Pin{Key: key, Kind: PinIndirect})
+			}
+		}
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Key < pins[j].Key })
+	return pins, nil
+}
+
+// IsPinned reports whether key is pinned, and how
+func (m *MapStore) IsPinned(key string) (PinKind, bool, error) {
+	key, err := m.parseKey("ispinned", key)
+	if err != nil {
+		return 0, false, err
+	}
+	if kind := m.pins[key]; kind != 0 {
+		return kind, true, nil
+	}
+	if m.indirectPins()[key] {
+		return PinIndirect, true, nil
+	}
+	return 0, false, nil
+}
+
+// PinUpdate moves a recursive pin from old to new
+func (m *MapStore) PinUpdate(old, new string) error {
+	old, err := m.parseKey("pinupdate", old)
+	if err != nil {
+		return err
+	}
+	if new, err = m.parseKey("pinupdate", new); err != nil {
+		return err
+	}
+	if m.pins[old] != PinRecursive {
+		return NewKeyError("pinupdate", old, ErrNotPinned)
+	}
+	if old == new {
+		return nil
+	}
+	delete(m.pins, old)
+	m.setPin(new, PinRecursive)
+	m.events.Emit(EventUnpin, old)
+	return nil
+}
+
+// indirectPins returns the keys of stored files beneath recursively pinned
+// directories
+func (m *MapStore) indirectPins() map[string]bool {
+	indirect := map[string]bool{}
+	var visit func(key string)
+	visit = func(key string) {
+		dir, ok := m.Files[key].(fsDir)
+		if !ok {
+			return
+		}
+		for _, child := range dir.files {
+			if !indirect[child] {
+				indirect[child] = true
+				visit(child)
+			}
+		}
+	}
+	for key, kind := range m.pins {
+		if kind == PinRecursive {
+			visit(key)
+		}
+	}
+	return indirect
+}
+
+// Ref returns the key a ref points to
+func (m *MapStore) Ref(name string) (string, error) {
+	return m.refTable().Ref(name)
+}
+
+// UpdateRef points a ref at new if it currently points at old. keys must
+// belong to the store, but their content doesn't need to be stored
+func (m *MapStore) UpdateRef(name, old, new string) error {
+	if new != "" {
+		if _, err := m.parseKey("updateref", new); err != nil {
+			return err
+		}
+	}
+	return m.refTable().UpdateRef(name, old, new)
+}
+
+// ListRefs returns refs with names beginning with prefix
+func (m *MapStore) ListRefs(prefix string) ([]Ref, error) {
+	return m.refTable().ListRefs(prefix)
+}
+
+// RefHistory returns changes to a ref, newest first
+func (m *MapStore) RefHistory(name string) ([]RefUpdate, error) {
+	return m.refTable().RefHistory(name)
+}
+
+// refTable returns the store's refs, allocating them for stores that weren't
+// created with NewMapstore
+func (m *MapStore) refTable() *Refs {
+	if m.refs == nil {
+		m.refs = NewRefs()
+	}
+	return m.refs
+}
+
+// nameRecord is a published name
+type nameRecord struct {
+	key     string
+	expires time.Time
+}
+
+// namePrefix is the prefix on MapStore names
+const namePrefix = "mapns"
+
+// newNameID creates a random name
+func newNameID() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("error generating name: %w", err)
+	}
+	mh, err := Sum(data, multihash.SHA2_256)
+	if err != nil {
+		return "", fmt.Errorf("error generating name: %w", err)
+	}
+	return NewKey(namePrefix, mh).String(), nil
+}
+
+// nameKeyTable returns the store's name keys, allocating them & generating
+// the self key on first use
+func (m *MapStore) nameKeyTable() (map[string]string, error) {
+	if m.nameKeys == nil {
+		m.nameKeys = map[string]string{}
+	}
+	if _, ok := m.nameKeys["self"]; !ok {
+		id, err := newNameID()
+		if err != nil {
+			return nil, err
+		}
+		m.nameKeys["self"] = id
+	}
+	return m.nameKeys, nil
+}
+
+// Publish points a name at key. ttl is ignored, MapStore doesn't cache
+// names
+func (m *MapStore) Publish(ctx context.Context, keyName, key string, lifetime, ttl time.Duration) (string, error) {
+	if _, err := m.parseKey("publish", key); err != nil {
+		return "", err
+	}
+	nameKeys, err := m.nameKeyTable()
+	if err != nil {
+		return "", NewKeyError("publish", keyName, err)
+	}
+	name, ok := nameKeys[keyName]
+	if !ok {
+		return "", NewKeyError("publish", keyName, ErrNotFound)
+	}
+	if lifetime <= 0 {
+		lifetime = DefaultNameLifetime
+	}
+	if m.names == nil {
+		m.names = map[string]nameRecord{}
+	}
+	m.names[name] = nameRecord{key: key, expires: time.Now().Add(lifetime)}
+	return name, nil
+}
+
+// Resolve returns the key a name points to, checking the store then stores
+// on the Network. Expired names aren't resolved. A path on the name is
+// appended to the resolved key, eg: /mapns/QmName/a.txt resolves to
+// /map/QmFoo/a.txt
+func (m *MapStore) Resolve(ctx context.Context, name string) (string, error) {
+	k, err := ParseKey(name)
+	if err != nil {
+		return "", err
+	}
+	if k.Prefix != namePrefix {
+		return "", NewKeyError("resolve", name, fmt.Errorf("%w: names must have the prefix %q", ErrInvalidKey, namePrefix))
+	}
+	root := k.Root().String()
+
+	now := time.Now()
+	for _, store := range append([]*MapStore{m}, m.Network...) {
+		if rec, ok := store.names[root]; ok && rec.expires.After(now) {
+			// paths beneath the name are paths beneath the key it points to
+			return rec.key + k.Path, nil
+		}
+	}
+	return "", NewKeyError("resolve", name, ErrNotFound)
+}
+
+// GenerateKey creates a key for publishing a new name
+func (m *MapStore) GenerateKey(ctx context.Context, keyName string) (NameKey, error) {
+	if keyName == "" {
+		return NameKey{}, NewKeyError("genkey", keyName, fmt.Errorf("key name is empty"))
+	}
+	nameKeys, err := m.nameKeyTable()
+	if err != nil {
+		return NameKey{}, NewKeyError("genkey", keyName, err)
+	}
+	if _, ok := nameKeys[keyName]; ok {
+		return NameKey{}, NewKeyError("genkey", keyName, ErrKeyExists)
+	}
+	id, err := newNameID()
+	if err != nil {
+		return NameKey{}, NewKeyError("genkey", keyName, err)
+	}
+	nameKeys[keyName] = id
+	return NameKey{Name: keyName, ID: id}, nil
+}
+
+// ListKeys returns the store's keys, sorted by name
+func (m *MapStore) ListKeys(ctx context.Context) ([]NameKey, error) {
+	nameKeys, err := m.nameKeyTable()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]NameKey, 0, len(nameKeys))
+	for name, id := range nameKeys {
+		keys = append(keys, NameKey{Name: name, ID: id})
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+// ID identifies the store as the sender of pubsub messages. ID is empty if
+// the store's self key couldn't be generated
+func (m *MapStore) ID() string {
+	nameKeys, err := m.nameKeyTable()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(nameKeys["self"], "/"+namePrefix+"/")
+}
+
+// PubSubPublish delivers a message to subscribers of topic on the store and
+// the stores it's connected to
+func (m *MapStore) PubSubPublish(ctx context.Context, topic string, data []byte) error {
+	if err := checkTopic("publish", topic); err != nil {
+		return err
+	}
+	if _, err := m.nameKeyTable(); err != nil {
+		return NewKeyError("publish", topic, err)
+	}
+	msg := Message{From: m.ID(), Topic: topic, Data: data}
+	for _, store := range append([]*MapStore{m}, m.Network...) {
+		store.topics.deliver(msg)
 	}
-	m.Pinned = false
 	return nil
 }
 
+// PubSubSubscribe returns a channel of messages published to topic, which
+// is closed when ctx is done or the store is closed. Stores that weren't
+// created with NewMapstore must subscribe before being used concurrently
+func (m *MapStore) PubSubSubscribe(ctx context.Context, topic string) (<-chan Message, error) {
+	if err := checkTopic("subscribe", topic); err != nil {
+		return nil, err
+	}
+	if m.topics == nil {
+		m.topics = newTopics()
+	}
+	return m.topics.subscribe(ctx, topic), nil
+}
+
+// PubSubTopics lists topics the store is subscribed to, sorted
+func (m *MapStore) PubSubTopics(ctx context.Context) ([]string, error) {
+	return m.topics.list(), nil
+}
+
+// PubSubPeers lists IDs of connected stores subscribed to topic, or all
+// connected stores if topic is ""
+func (m *MapStore) PubSubPeers(ctx context.Context, topic string) ([]string, error) {
+	peers := []string{}
+	for _, store := range m.Network {
+		if topic == "" || store.topics.subscribed(topic) {
+			peers = append(peers, store.ID())
+		}
+	}
+	return peers, nil
+}
+
 // Adder wraps a coreunix adder to conform to the cafs adder interface
 type adder struct {
-	mapstore MapStore
+	mapstore *MapStore
 	pin      bool
 	out      chan AddedFile
+
+	// nodes added to the store are queued until they're sent on out, so
+	// AddFile never blocks on callers that read Added after adding
+	lk      sync.Mutex
+	queue   []AddedFile
+	closed  bool
+	pending chan struct{}
+}
+
+func newAdder(m *MapStore, pin bool) *adder {
+	a := &adder{
+		mapstore: m,
+		pin:      pin,
+		out:      make(chan AddedFile, 9),
+		pending:  make(chan struct{}, 1),
+	}
+	go a.send()
+	return a
+}
+
+// send delivers queued nodes on out, closing it once the adder is closed &
+// the queue is empty
+func (a *adder) send() {
+	for range a.pending {
+		a.lk.Lock()
+		queue, closed := a.queue, a.closed
+		a.queue = nil
+		a.lk.Unlock()
+
+		for _, added := range queue {
+			a.out <- added
+		}
+		if closed {
+			close(a.out)
+			return
+		}
+	}
+}
+
+// notify wakes send without blocking
+func (a *adder) notify() {
+	select {
+	case a.pending <- struct{}{}:
+	default:
+	}
 }
 
 func (a *adder) AddFile(f File) error {
-	path, err := a.mapstore.Put(f, a.pin)
+	var nodes []AddedFile
+	key, err := a.mapstore.put(f, a.pin, func(added AddedFile) {
+		nodes = append(nodes, added)
+	})
 	if err != nil {
-		fmt.Errorf("error putting file in mapstore: %s", err.Error())
-		return err
+		return fmt.Errorf("error putting file in mapstore: %w", err)
 	}
-	a.out <- AddedFile{
-		Path:  path,
-		Name:  f.FileName(),
-		Bytes: 0,
-		Hash:  path,
+	a.mapstore.events.Emit(EventAdd, key)
+	if a.pin {
+		a.mapstore.setPin(key, PinRecursive)
 	}
+
+	a.lk.Lock()
+	a.queue = append(a.queue, nodes...)
+	a.lk.Unlock()
+	a.notify()
 	return nil
 }
 
 func (a *adder) Added() chan AddedFile {
 	return a.out
 }
+
+// Close finishes adding. Added is closed once every added node has been read
 func (a *adder) Close() error {
-	close(a.out)
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if !a.closed {
+		a.closed = true
+		a.notify()
+	}
 	return nil
 }
 
-func hashBytes(data []byte) (hash string, err error) {
-	h := sha256.New()
-	if _, err = h.Write(data); err != nil {
-		err = fmt.Errorf("error writing hash data: %s", err.Error())
-		return
+// key hashes data, returning a key in the store's configured format
+func (m MapStore) key(data []byte) (string, error) {
+	code := m.HashFunc
+	if code == 0 {
+		code = multihash.SHA2_256
 	}
-	mhBuf, err := multihash.Encode(h.Sum(nil), multihash.SHA2_256)
+	mh, err := Sum(data, code)
 	if err != nil {
-		err = fmt.Errorf("error encoding hash: %s", err.Error())
-		return
+		return "", err
 	}
-	hash = base58.Encode(mhBuf)
-	return
+
+	switch m.KeyEncoding {
+	case EncodingBase58:
+		return NewKey(m.PathPrefix(), mh).String(), nil
+	case EncodingCIDv1Base32:
+		return NewCIDv1Key(m.PathPrefix(), CodecRaw, mh).String(), nil
+	}
+	return "", fmt.Errorf("unsupported key encoding: %s", m.KeyEncoding)
 }
 
 type fsFile struct {
@@ -297,12 +840,12 @@ type fsFile struct {
 	data []byte
 }
 
-func (f fsFile) File() File {
+func (f fsFile) File() (File, error) {
 	return &Memfile{
 		name: f.name,
 		path: f.path,
 		buf:  bytes.NewBuffer(f.data),
-	}
+	}, nil
 }
 
 type fsDir struct {
@@ -311,12 +854,19 @@ type fsDir struct {
 	files []string
 }
 
-func (f fsDir) File() File {
+// File resolves the directory's children, returning an error if any child
+// can't be read from the store
+func (f fsDir) File() (File, error) {
+	return f.resolve(f.store)
+}
+
+// resolve constructs a directory, getting child files from store
+func (f fsDir) resolve(store *MapStore) (File, error) {
 	files := make([]File, len(f.files))
 	for i, path := range f.files {
-		file, err := f.store.Get(path)
+		file, err := store.Get(path)
 		if err != nil {
-			panic(path)
+			return nil, err
 		}
 		files[i] = file
 	}
@@ -324,9 +874,28 @@ func (f fsDir) File() File {
 	return &Memdir{
 		path:  f.path,
 		links: files,
+	}, nil
+}
+
+// verify checks the list of child keys hashes to key
+func (f fsDir) verify(key string) error {
+	buf := &bytes.Buffer{}
+	for _, path := range f.files {
+		buf.WriteString(path + "\n")
+	}
+	k, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+	r, err := NewVerifyingReader(buf, k)
+	if err != nil {
+		return err
 	}
+	_, err = ioutil.ReadAll(r)
+	return err
 }
 
+// filer is a stored value that can be converted to a File
 type filer interface {
-	File() File
+	File() (File, error)
 }
@@ -0,0 +1,337 @@
+package cafs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are upper bounds in seconds for operation latency histograms
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Span describes a single timed store operation, modeled on OpenTelemetry
+// spans so they can be forwarded to a tracing system
+type Span struct {
+	// Name is the operation, prefixed with "cafs.", eg: "cafs.get"
+	Name  string
+	Start time.Time
+	// Duration is the time the operation took. For Get & Fetch this excludes
+	// reading the returned file
+	Duration time.Duration
+	// Attributes describe the operation. "cafs.store" is always set to the
+	// store's PathPrefix, "cafs.key" is set when an operation has a key
+	Attributes map[string]string
+	// Err is the error the operation returned, if any
+	Err error
+}
+
+// MetricsOption adjusts instrumented store configuration
+type MetricsOption func(m *InstrumentedStore)
+
+// OptMetricsSpans calls fn with a span for every completed operation. fn is
+// called synchronously, and must not block
+func OptMetricsSpans(fn func(Span)) MetricsOption {
+	return func(m *InstrumentedStore) {
+		m.onSpan = fn
+	}
+}
+
+// InstrumentedStore is a Filestore that records latency, byte & error
+// metrics for every operation on the store it wraps, including Adder,
+// Fetcher, Pinner and Hasher calls. Metrics are exposed in the prometheus
+// text format by WritePrometheus & ServeHTTP
+type InstrumentedStore struct {
+	store  Filestore
+	onSpan func(Span)
+
+	bytesRead    int64
+	bytesWritten int64
+
+	lk  sync.Mutex
+	ops map[string]*opMetrics
+}
+
+// opMetrics tracks a single operation
+type opMetrics struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+	errors  uint64
+}
+
+var (
+	_ Filestore = (*InstrumentedStore)(nil)
+	_ Fetcher   = (*InstrumentedStore)(nil)
+	_ Pinner    = (*InstrumentedStore)(nil)
+	_ Hasher    = (*InstrumentedStore)(nil)
+	_ Closer    = (*InstrumentedStore)(nil)
+)
+
+// NewInstrumentedStore wraps a store with metrics
+func NewInstrumentedStore(store Filestore, opts ...MetricsOption) *InstrumentedStore {
+	m := &InstrumentedStore{
+		store: store,
+		ops:   map[string]*opMetrics{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// observe records a completed operation
+func (m *InstrumentedStore) observe(op, key string, start time.Time, err error, attrs ...string) {
+	dur := time.Since(start)
+
+	m.lk.Lock()
+	om, ok := m.ops[op]
+	if !ok {
+		om = &opMetrics{buckets: make([]uint64, len(latencyBuckets))}
+		m.ops[op] = om
+	}
+	secs := dur.Seconds()
+	for i, le := range latencyBuckets {
+		if secs <= le {
+			om.buckets[i]++
+		}
+	}
+	om.count++
+	om.sum += secs
+	if err != nil {
+		om.errors++
+	}
+	m.lk.Unlock()
+
+	if m.onSpan != nil {
+		s := Span{
+			Name:       "cafs." + op,
+			Start:      start,
+			Duration:   dur,
+			Attributes: map[string]string{"cafs.store": m.store.PathPrefix()},
+			Err:        err,
+		}
+		if key != "" {
+			s.Attributes["cafs.key"] = key
+		}
+		for i := 0; i+1 < len(attrs); i += 2 {
+			s.Attributes[attrs[i]] = attrs[i+1]
+		}
+		m.onSpan(s)
+	}
+}
+
+// BytesRead returns the number of content bytes read from files returned by
+// Get & Fetch
+func (m *InstrumentedStore) BytesRead() int64 {
+	return atomic.LoadInt64(&m.bytesRead)
+}
+
+// BytesWritten returns the number of content bytes written by Put & Adders
+func (m *InstrumentedStore) BytesWritten() int64 {
+	return atomic.LoadInt64(&m.bytesWritten)
+}
+
+// WritePrometheus writes metrics in the prometheus text exposition format
+func (m *InstrumentedStore) WritePrometheus(w io.Writer) error {
+	store := strconv.Quote(m.store.PathPrefix())
+
+	m.lk.Lock()
+	ops := make([]string, 0, len(m.ops))
+	for op := range m.ops {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	snapshot := make([]opMetrics, len(ops))
+	for i, op := range ops {
+		om := *m.ops[op]
+		om.buckets = append([]uint64(nil), om.buckets...)
+		snapshot[i] = om
+	}
+	m.lk.Unlock()
+
+	ew := &errWriter{w: w}
+	ew.printf("# HELP cafs_operation_duration_seconds Latency of filestore operations.\n")
+	ew.printf("# TYPE cafs_operation_duration_seconds histogram\n")
+	for i, op := range ops {
+		om := snapshot[i]
+		for j, le := range latencyBuckets {
+			ew.printf("cafs_operation_duration_seconds_bucket{store=%s,op=%q,le=%q} %d\n", store, op, strconv.FormatFloat(le, 'g', -1, 64), om.buckets[j])
+		}
+		ew.printf("cafs_operation_duration_seconds_bucket{store=%s,op=%q,le=\"+Inf\"} %d\n", store, op, om.count)
+		ew.printf("cafs_operation_duration_seconds_sum{store=%s,op=%q} %s\n", store, op, strconv.FormatFloat(om.sum, 'g', -1, 64))
+		ew.printf("cafs_operation_duration_seconds_count{store=%s,op=%q} %d\n", store, op, om.count)
+	}
+
+	ew.printf("# HELP cafs_operation_errors_total Filestore operations that returned an error.\n")
+	ew.printf("# TYPE cafs_operation_errors_total counter\n")
+	for i, op := range ops {
+		ew.printf("cafs_operation_errors_total{store=%s,op=%q} %d\n", store, op, snapshot[i].errors)
+	}
+
+	ew.printf("# HELP cafs_bytes_read_total Content bytes read from the filestore.\n")
+	ew.printf("# TYPE cafs_bytes_read_total counter\n")
+	ew.printf("cafs_bytes_read_total{store=%s} %d\n", store, m.BytesRead())
+	ew.printf("# HELP cafs_bytes_written_total Content bytes written to the filestore.\n")
+	ew.printf("# TYPE cafs_bytes_written_total counter\n")
+	ew.printf("cafs_bytes_written_total{store=%s} %d\n", store, m.BytesWritten())
+	return ew.err
+}
+
+// ServeHTTP serves metrics in the prometheus text format
+func (m *InstrumentedStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WritePrometheus(w)
+}
+
+// errWriter keeps the first error encountered while printing
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err == nil {
+		_, ew.err = fmt.Fprintf(ew.w, format, args...)
+	}
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (m *InstrumentedStore) PathPrefix() string {
+	return m.store.PathPrefix()
+}
+
+// Put writes to the wrapped store
+func (m *InstrumentedStore) Put(file File, pin bool) (key string, err error) {
+	start := time.Now()
+	var n int64
+	key, err = m.store.Put(newCountingFile(file, &n), pin)
+	atomic.AddInt64(&m.bytesWritten, n)
+	m.observe("put", key, start, err, "cafs.pin", strconv.FormatBool(pin), "cafs.bytes", strconv.FormatInt(n, 10))
+	return key, err
+}
+
+// Get reads from the wrapped store
+func (m *InstrumentedStore) Get(key string) (File, error) {
+	start := time.Now()
+	f, err := m.store.Get(key)
+	m.observe("get", key, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return newCountingFile(f, &m.bytesRead), nil
+}
+
+// Fetch fetches from the wrapped store
+func (m *InstrumentedStore) Fetch(source Source, key string) (File, error) {
+	start := time.Now()
+	f, err := fetch(m.store, source, key)
+	m.observe("fetch", key, start, err, "cafs.source", source.Address())
+	if err != nil {
+		return nil, err
+	}
+	return newCountingFile(f, &m.bytesRead), nil
+}
+
+// Has checks the wrapped store for a key
+func (m *InstrumentedStore) Has(key string) (exists bool, err error) {
+	start := time.Now()
+	exists, err = m.store.Has(key)
+	m.observe("has", key, start, err, "cafs.exists", strconv.FormatBool(exists))
+	return exists, err
+}
+
+// Delete removes a key from the wrapped store
+func (m *InstrumentedStore) Delete(key string) error {
+	start := time.Now()
+	err := m.store.Delete(key)
+	m.observe("delete", key, start, err)
+	return err
+}
+
+// NewAdder creates an instrumented adder for the wrapped store
+func (m *InstrumentedStore) NewAdder(pin, wrap bool) (Adder, error) {
+	start := time.Now()
+	a, err := m.store.NewAdder(pin, wrap)
+	m.observe("new_adder", "", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedAdder{Adder: a, m: m}, nil
+}
+
+// NewHashAdder creates an instrumented hash adder for the wrapped store
+func (m *InstrumentedStore) NewHashAdder(wrap bool) (Adder, error) {
+	start := time.Now()
+	h, ok := m.store.(Hasher)
+	if !ok {
+		err := NewKeyError("hash", "", ErrNotSupported)
+		m.observe("new_hash_adder", "", start, err)
+		return nil, err
+	}
+	a, err := h.NewHashAdder(wrap)
+	m.observe("new_hash_adder", "", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedAdder{Adder: a, m: m, hash: true}, nil
+}
+
+// Pin pins a key in the wrapped store
+func (m *InstrumentedStore) Pin(key string, recursive bool) error {
+	start := time.Now()
+	err := pin(m.store, key, recursive)
+	m.observe("pin", key, start, err, "cafs.recursive", strconv.FormatBool(recursive))
+	return err
+}
+
+// Unpin unpins a key in the wrapped store
+func (m *InstrumentedStore) Unpin(key string, recursive bool) error {
+	start := time.Now()
+	err := unpin(m.store, key, recursive)
+	m.observe("unpin", key, start, err, "cafs.recursive", strconv.FormatBool(recursive))
+	return err
+}
+
+// Close closes the wrapped store
+func (m *InstrumentedStore) Close() error {
+	return Close(m.store)
+}
+
+// instrumentedAdder records AddFile & Close calls
+type instrumentedAdder struct {
+	Adder
+	m *InstrumentedStore
+	// hash adders don't write content, & aren't counted toward bytes written
+	hash bool
+}
+
+func (a instrumentedAdder) AddFile(f File) error {
+	op := "adder_add_file"
+	if a.hash {
+		op = "hash_adder_add_file"
+	}
+	start := time.Now()
+	var n int64
+	err := a.Adder.AddFile(newCountingFile(f, &n))
+	if !a.hash {
+		atomic.AddInt64(&a.m.bytesWritten, n)
+	}
+	a.m.observe(op, "", start, err, "cafs.name", f.FileName(), "cafs.bytes", strconv.FormatInt(n, 10))
+	return err
+}
+
+func (a instrumentedAdder) Close() error {
+	op := "adder_close"
+	if a.hash {
+		op = "hash_adder_close"
+	}
+	start := time.Now()
+	err := a.Adder.Close()
+	a.m.observe(op, "", start, err)
+	return err
+}
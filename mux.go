@@ -0,0 +1,143 @@
+package cafs
+
+import (
+	"fmt"
+)
+
+// Mux is a Filestore that routes operations to one of a number of stores
+// based on the PathPrefix of keys. Keys like /ipfs/... are handled by the
+// store with the "ipfs" prefix, /map/... by the "map" store, and so on.
+// New content is written to the default store
+type Mux struct {
+	def    Filestore
+	stores map[string]Filestore
+}
+
+var (
+	_ Filestore = (*Mux)(nil)
+	_ Fetcher   = (*Mux)(nil)
+	_ Pinner    = (*Mux)(nil)
+	_ Hasher    = (*Mux)(nil)
+	_ Closer    = (*Mux)(nil)
+)
+
+// NewMux creates a Mux that writes to def. Every store must have a distinct
+// PathPrefix
+func NewMux(def Filestore, stores ...Filestore) (*Mux, error) {
+	m := &Mux{
+		def:    def,
+		stores: map[string]Filestore{def.PathPrefix(): def},
+	}
+	for _, s := range stores {
+		if _, exists := m.stores[s.PathPrefix()]; exists {
+			return nil, fmt.Errorf("multiple stores with path prefix %q", s.PathPrefix())
+		}
+		m.stores[s.PathPrefix()] = s
+	}
+	return m, nil
+}
+
+// Filestore returns the store for a prefix, nil if none exists
+func (m *Mux) Filestore(prefix string) Filestore {
+	return m.stores[prefix]
+}
+
+// store returns the store responsible for a key
+func (m *Mux) store(op, key string) (Filestore, error) {
+	k, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := m.stores[k.Prefix]
+	if !ok {
+		return nil, NewKeyError(op, key, fmt.Errorf("%w: no store for prefix %q", ErrInvalidKey, k.Prefix))
+	}
+	return s, nil
+}
+
+// PathPrefix returns the prefix of the default store
+func (m *Mux) PathPrefix() string {
+	return m.def.PathPrefix()
+}
+
+// Put adds a file to the default store
+func (m *Mux) Put(file File, pin bool) (key string, err error) {
+	return m.def.Put(file, pin)
+}
+
+// Get routes to the store for key
+func (m *Mux) Get(key string) (File, error) {
+	s, err := m.store("get", key)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(key)
+}
+
+// Has routes to the store for key
+func (m *Mux) Has(key string) (exists bool, err error) {
+	s, err := m.store("has", key)
+	if err != nil {
+		return false, err
+	}
+	return s.Has(key)
+}
+
+// Delete routes to the store for key
+func (m *Mux) Delete(key string) error {
+	s, err := m.store("delete", key)
+	if err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+// NewAdder returns an adder for the default store
+func (m *Mux) NewAdder(pin, wrap bool) (Adder, error) {
+	return m.def.NewAdder(pin, wrap)
+}
+
+// NewHashAdder returns a hash adder for the default store
+func (m *Mux) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := m.def.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return h.NewHashAdder(wrap)
+}
+
+// Fetch routes to the store for key
+func (m *Mux) Fetch(source Source, key string) (File, error) {
+	s, err := m.store("fetch", key)
+	if err != nil {
+		return nil, err
+	}
+	return fetch(s, source, key)
+}
+
+// Pin routes to the store for key
+func (m *Mux) Pin(key string, recursive bool) error {
+	s, err := m.store("pin", key)
+	if err != nil {
+		return err
+	}
+	return pin(s, key, recursive)
+}
+
+// Unpin routes to the store for key
+func (m *Mux) Unpin(key string, recursive bool) error {
+	s, err := m.store("unpin", key)
+	if err != nil {
+		return err
+	}
+	return unpin(s, key, recursive)
+}
+
+// Close closes all stores
+func (m *Mux) Close() error {
+	stores := make([]Filestore, 0, len(m.stores))
+	for _, s := range m.stores {
+		stores = append(stores, s)
+	}
+	return closeAll(stores...)
+}
@@ -0,0 +1,38 @@
+package cafs
+
+import (
+	"context"
+	"time"
+)
+
+// NameSystem is implemented by Filestores that can publish mutable names
+// that point to keys, like IPNS. A name is controlled by a keypair the store
+// manages, which is referred to by a local key name. Every store has a key
+// named "self"
+type NameSystem interface {
+	// Publish points the name controlled by keyName at key, returning the
+	// name. lifetime is how long the record is valid, and ttl is how long
+	// resolvers may cache it. zero values use the store's defaults. Publish
+	// returns ErrNotFound if there's no key named keyName
+	Publish(ctx context.Context, keyName, key string, lifetime, ttl time.Duration) (name string, err error)
+	// Resolve returns the key a name points to, or ErrNotFound if no valid
+	// record can be found
+	Resolve(ctx context.Context, name string) (key string, err error)
+	// GenerateKey creates a keypair for publishing a new name, returning
+	// ErrKeyExists if there's already a key named keyName
+	GenerateKey(ctx context.Context, keyName string) (NameKey, error)
+	// ListKeys returns every key the store can publish with
+	ListKeys(ctx context.Context) ([]NameKey, error)
+}
+
+// NameKey is a keypair used to publish a name
+type NameKey struct {
+	// Name is the local name of the key, eg: "self"
+	Name string
+	// ID is the name the key publishes, eg: /ipns/QmFoo
+	ID string
+}
+
+// DefaultNameLifetime is how long published names are valid when Publish
+// isn't given a lifetime
+const DefaultNameLifetime = time.Hour * 24
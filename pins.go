@@ -0,0 +1,63 @@
+package cafs
+
+import "strings"
+
+// PinKind describes how content is pinned. Kinds are flags that can be
+// combined to select pins with ListPins
+type PinKind int
+
+const (
+	// PinDirect pins a single key, without the content beneath it
+	PinDirect PinKind = 1 << iota
+	// PinRecursive pins a key & all content beneath it
+	PinRecursive
+	// PinIndirect is content beneath a recursively pinned key
+	PinIndirect
+
+	// PinAny selects pins of every kind
+	PinAny = PinDirect | PinRecursive | PinIndirect
+)
+
+// String implements the stringer interface
+func (k PinKind) String() string {
+	var kinds []string
+	for _, kind := range []PinKind{PinDirect, PinRecursive, PinIndirect} {
+		if k&kind == 0 {
+			continue
+		}
+		switch kind {
+		case PinDirect:
+			kinds = append(kinds, "direct")
+		case PinRecursive:
+			kinds = append(kinds, "recursive")
+		case PinIndirect:
+			kinds = append(kinds, "indirect")
+		}
+	}
+	if len(kinds) == 0 {
+		return "none"
+	}
+	return strings.Join(kinds, "|")
+}
+
+// Pin is an entry in a store's set of pinned content
+type Pin struct {
+	Key  string
+	Kind PinKind
+}
+
+// PinTracker is implemented by Pinners that can report exactly what's
+// pinned. Content pinned more than one way is reported as its strongest kind
+// of pin: recursive, then direct, then indirect
+type PinTracker interface {
+	Pinner
+	// ListPins returns pinned keys of the given kinds. Each key is listed
+	// once
+	ListPins(kinds PinKind) ([]Pin, error)
+	// IsPinned reports whether key is pinned, and how
+	IsPinned(key string) (kind PinKind, pinned bool, err error)
+	// PinUpdate moves a recursive pin from old to new, which is faster than
+	// pinning new & unpinning old when they share content. PinUpdate returns
+	// ErrNotPinned if old isn't pinned recursively
+	PinUpdate(old, new string) error
+}
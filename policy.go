@@ -0,0 +1,366 @@
+package cafs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrReadOnly is returned when writing to a read-only store
+	ErrReadOnly = errors.New("cafs: store is read-only")
+	// ErrNotAllowed is returned when accessing a key outside of a store's
+	// allow-list
+	ErrNotAllowed = errors.New("cafs: key not allowed")
+	// ErrByteLimit is returned when adding content would exceed a store's
+	// byte limit
+	ErrByteLimit = errors.New("cafs: byte limit exceeded")
+)
+
+// ReadOnlyStore is a Filestore view that rejects all writes with ErrReadOnly.
+// Hash adders are allowed, since they don't write content
+type ReadOnlyStore struct {
+	store Filestore
+}
+
+var (
+	_ Filestore = (*ReadOnlyStore)(nil)
+	_ Fetcher   = (*ReadOnlyStore)(nil)
+	_ Pinner    = (*ReadOnlyStore)(nil)
+	_ Hasher    = (*ReadOnlyStore)(nil)
+	_ Closer    = (*ReadOnlyStore)(nil)
+)
+
+// NewReadOnlyStore creates a read-only view of a store
+func NewReadOnlyStore(store Filestore) *ReadOnlyStore {
+	return &ReadOnlyStore{store: store}
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (r *ReadOnlyStore) PathPrefix() string {
+	return r.store.PathPrefix()
+}
+
+// Put returns ErrReadOnly
+func (r *ReadOnlyStore) Put(file File, pin bool) (key string, err error) {
+	return "", NewKeyError("put", "", ErrReadOnly)
+}
+
+// Get reads from the wrapped store
+func (r *ReadOnlyStore) Get(key string) (File, error) {
+	return r.store.Get(key)
+}
+
+// Fetch forwards to the wrapped store. Fetching may store content locally,
+// but doesn't change what content the store can serve
+func (r *ReadOnlyStore) Fetch(source Source, key string) (File, error) {
+	return fetch(r.store, source, key)
+}
+
+// Has checks the wrapped store for a key
+func (r *ReadOnlyStore) Has(key string) (exists bool, err error) {
+	return r.store.Has(key)
+}
+
+// Delete returns ErrReadOnly
+func (r *ReadOnlyStore) Delete(key string) error {
+	return NewKeyError("delete", key, ErrReadOnly)
+}
+
+// NewAdder returns ErrReadOnly
+func (r *ReadOnlyStore) NewAdder(pin, wrap bool) (Adder, error) {
+	return nil, NewKeyError("add", "", ErrReadOnly)
+}
+
+// NewHashAdder forwards to the wrapped store
+func (r *ReadOnlyStore) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := r.store.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return h.NewHashAdder(wrap)
+}
+
+// Pin returns ErrReadOnly
+func (r *ReadOnlyStore) Pin(key string, recursive bool) error {
+	return NewKeyError("pin", key, ErrReadOnly)
+}
+
+// Unpin returns ErrReadOnly
+func (r *ReadOnlyStore) Unpin(key string, recursive bool) error {
+	return NewKeyError("unpin", key, ErrReadOnly)
+}
+
+// Close closes the wrapped store
+func (r *ReadOnlyStore) Close() error {
+	return Close(r.store)
+}
+
+// AllowListStore is a Filestore view that restricts access to a set of root
+// keys and paths within them. Operations on other keys return ErrNotAllowed.
+// Content written through the view is added to the allow-list
+type AllowListStore struct {
+	store Filestore
+
+	lk      sync.RWMutex
+	allowed map[string]bool
+}
+
+var (
+	_ Filestore = (*AllowListStore)(nil)
+	_ Fetcher   = (*AllowListStore)(nil)
+	_ Pinner    = (*AllowListStore)(nil)
+	_ Hasher    = (*AllowListStore)(nil)
+	_ Closer    = (*AllowListStore)(nil)
+)
+
+// NewAllowListStore creates a view of store that can only access roots.
+// keys with a path are allowed by their root
+func NewAllowListStore(store Filestore, roots ...string) (*AllowListStore, error) {
+	a := &AllowListStore{store: store, allowed: map[string]bool{}}
+	if err := a.Allow(roots...); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Allow adds keys to the allow-list
+func (a *AllowListStore) Allow(keys ...string) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	for _, key := range keys {
+		k, err := ParseKey(key)
+		if err != nil {
+			return err
+		}
+		a.allowed[k.Root().String()] = true
+	}
+	return nil
+}
+
+// check returns an error if key isn't allowed
+func (a *AllowListStore) check(op, key string) error {
+	k, err := ParseKey(key)
+	if err != nil {
+		return err
+	}
+	a.lk.RLock()
+	defer a.lk.RUnlock()
+	if !a.allowed[k.Root().String()] {
+		return NewKeyError(op, key, ErrNotAllowed)
+	}
+	return nil
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (a *AllowListStore) PathPrefix() string {
+	return a.store.PathPrefix()
+}
+
+// Put writes to the wrapped store, allowing access to the written key
+func (a *AllowListStore) Put(file File, pin bool) (key string, err error) {
+	if key, err = a.store.Put(file, pin); err != nil {
+		return key, err
+	}
+	return key, a.Allow(key)
+}
+
+// Get reads an allowed key from the wrapped store
+func (a *AllowListStore) Get(key string) (File, error) {
+	if err := a.check("get", key); err != nil {
+		return nil, err
+	}
+	return a.store.Get(key)
+}
+
+// Fetch fetches an allowed key
+func (a *AllowListStore) Fetch(source Source, key string) (File, error) {
+	if err := a.check("fetch", key); err != nil {
+		return nil, err
+	}
+	return fetch(a.store, source, key)
+}
+
+// Has checks the wrapped store for an allowed key
+func (a *AllowListStore) Has(key string) (exists bool, err error) {
+	if err := a.check("has", key); err != nil {
+		return false, err
+	}
+	return a.store.Has(key)
+}
+
+// Delete removes an allowed key from the wrapped store
+func (a *AllowListStore) Delete(key string) error {
+	if err := a.check("delete", key); err != nil {
+		return err
+	}
+	return a.store.Delete(key)
+}
+
+// NewAdder creates an adder that allows access to the keys it writes
+func (a *AllowListStore) NewAdder(pin, wrap bool) (Adder, error) {
+	return newPutAdder(func(f File) (string, error) {
+		return a.Put(f, pin)
+	}), nil
+}
+
+// NewHashAdder forwards to the wrapped store
+func (a *AllowListStore) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := a.store.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return h.NewHashAdder(wrap)
+}
+
+// Pin pins an allowed key
+func (a *AllowListStore) Pin(key string, recursive bool) error {
+	if err := a.check("pin", key); err != nil {
+		return err
+	}
+	return pin(a.store, key, recursive)
+}
+
+// Unpin unpins an allowed key
+func (a *AllowListStore) Unpin(key string, recursive bool) error {
+	if err := a.check("unpin", key); err != nil {
+		return err
+	}
+	return unpin(a.store, key, recursive)
+}
+
+// Close closes the wrapped store
+func (a *AllowListStore) Close() error {
+	return Close(a.store)
+}
+
+// ByteLimitStore is a Filestore view that caps the total number of content
+// bytes a caller may add. Writes that would exceed the limit fail with
+// ErrByteLimit. Bytes are counted as they're read from added files, before
+// any deduplication by the wrapped store
+type ByteLimitStore struct {
+	store Filestore
+	limit int64
+	added int64
+}
+
+var (
+	_ Filestore = (*ByteLimitStore)(nil)
+	_ Fetcher   = (*ByteLimitStore)(nil)
+	_ Pinner    = (*ByteLimitStore)(nil)
+	_ Hasher    = (*ByteLimitStore)(nil)
+	_ Closer    = (*ByteLimitStore)(nil)
+)
+
+// NewByteLimitStore creates a view of store that accepts at most limit bytes
+func NewByteLimitStore(store Filestore, limit int64) *ByteLimitStore {
+	return &ByteLimitStore{store: store, limit: limit}
+}
+
+// Added returns the number of bytes added so far
+func (b *ByteLimitStore) Added() int64 {
+	return atomic.LoadInt64(&b.added)
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (b *ByteLimitStore) PathPrefix() string {
+	return b.store.PathPrefix()
+}
+
+// Put writes to the wrapped store if the file fits within the byte limit.
+// Bytes are reserved as the wrapped store reads them, so a write is stopped
+// as soon as it exceeds the limit
+func (b *ByteLimitStore) Put(file File, pin bool) (key string, err error) {
+	var (
+		lk       sync.Mutex
+		reserved int64
+		limitErr error
+	)
+	key, err = b.store.Put(newReservingFile(file, func(n int64) error {
+		lk.Lock()
+		defer lk.Unlock()
+		if limitErr == nil {
+			if limitErr = b.reserve(n); limitErr == nil {
+				reserved += n
+			}
+		}
+		return limitErr
+	}), pin)
+
+	if err != nil || limitErr != nil {
+		atomic.AddInt64(&b.added, -reserved)
+		if limitErr != nil {
+			// wrapped stores may not preserve the read error
+			return "", NewKeyError("put", "", limitErr)
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+// reserve counts n bytes toward the limit if they fit. concurrent puts
+// reserve bytes atomically, so they can't overshoot the limit together
+func (b *ByteLimitStore) reserve(n int64) error {
+	for {
+		added := atomic.LoadInt64(&b.added)
+		if added+n > b.limit {
+			return fmt.Errorf("%w: adding %d bytes to %d of %d", ErrByteLimit, n, added, b.limit)
+		}
+		if atomic.CompareAndSwapInt64(&b.added, added, added+n) {
+			return nil
+		}
+	}
+}
+
+// Get reads from the wrapped store
+func (b *ByteLimitStore) Get(key string) (File, error) {
+	return b.store.Get(key)
+}
+
+// Fetch forwards to the wrapped store
+func (b *ByteLimitStore) Fetch(source Source, key string) (File, error) {
+	return fetch(b.store, source, key)
+}
+
+// Has checks the wrapped store for a key
+func (b *ByteLimitStore) Has(key string) (exists bool, err error) {
+	return b.store.Has(key)
+}
+
+// Delete removes a key from the wrapped store. Deleting doesn't free bytes
+// toward the limit
+func (b *ByteLimitStore) Delete(key string) error {
+	return b.store.Delete(key)
+}
+
+// NewAdder creates an adder that enforces the byte limit
+func (b *ByteLimitStore) NewAdder(pin, wrap bool) (Adder, error) {
+	return newPutAdder(func(f File) (string, error) {
+		return b.Put(f, pin)
+	}), nil
+}
+
+// NewHashAdder forwards to the wrapped store
+func (b *ByteLimitStore) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := b.store.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return h.NewHashAdder(wrap)
+}
+
+// Pin forwards to the wrapped store
+func (b *ByteLimitStore) Pin(key string, recursive bool) error {
+	return pin(b.store, key, recursive)
+}
+
+// Unpin forwards to the wrapped store
+func (b *ByteLimitStore) Unpin(key string, recursive bool) error {
+	return unpin(b.store, key, recursive)
+}
+
+// Close closes the wrapped store
+func (b *ByteLimitStore) Close() error {
+	return Close(b.store)
+}
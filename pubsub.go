@@ -0,0 +1,163 @@
+package cafs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PubSub is implemented by Filestores that can exchange messages with other
+// stores on named topics. Delivery is best-effort: messages aren't stored,
+// only current subscribers receive them, and subscribers that fall behind
+// miss messages
+type PubSub interface {
+	// PubSubPublish sends data to subscribers of topic
+	PubSubPublish(ctx context.Context, topic string, data []byte) error
+	// PubSubSubscribe returns a channel of messages published to topic,
+	// which is closed when ctx is done or the store stops receiving messages
+	PubSubSubscribe(ctx context.Context, topic string) (<-chan Message, error)
+	// PubSubTopics lists the topics the store is subscribed to
+	PubSubTopics(ctx context.Context) ([]string, error)
+	// PubSubPeers lists connected peers subscribed to topic, or all peers
+	// using pubsub if topic is ""
+	PubSubPeers(ctx context.Context, topic string) ([]string, error)
+}
+
+// Message is a message received on a topic
+type Message struct {
+	// From identifies the sender, eg: an IPFS peer ID
+	From  string
+	Topic string
+	Data  []byte
+}
+
+// messageBuffer is the number of messages held for a subscriber that isn't
+// reading
+const messageBuffer = 32
+
+// checkTopic validates a topic name
+func checkTopic(op, topic string) error {
+	if topic == "" {
+		return NewKeyError(op, topic, fmt.Errorf("topic is empty"))
+	}
+	return nil
+}
+
+// topics delivers messages to subscribers by topic, implementing PubSub for
+// in-memory stores. A nil *topics has no subscribers & discards messages
+type topics struct {
+	lk   sync.Mutex
+	subs map[string]map[chan Message]struct{}
+	// done is closed by close
+	done chan struct{}
+}
+
+func newTopics() *topics {
+	return &topics{
+		subs: map[string]map[chan Message]struct{}{},
+		done: make(chan struct{}),
+	}
+}
+
+// subscribe adds a subscriber to topic until ctx is done or topics closes
+func (t *topics) subscribe(ctx context.Context, topic string) <-chan Message {
+	ch := make(chan Message, messageBuffer)
+
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	select {
+	case <-t.done:
+		close(ch)
+		return ch
+	default:
+	}
+	if t.subs[topic] == nil {
+		t.subs[topic] = map[chan Message]struct{}{}
+	}
+	t.subs[topic][ch] = struct{}{}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-t.done:
+		}
+		t.lk.Lock()
+		t.unsubscribe(topic, ch)
+		t.lk.Unlock()
+	}()
+	return ch
+}
+
+// unsubscribe removes a subscriber & closes its channel if it hasn't been
+// already. callers must hold the lock
+func (t *topics) unsubscribe(topic string, ch chan Message) {
+	if _, ok := t.subs[topic][ch]; ok {
+		delete(t.subs[topic], ch)
+		close(ch)
+		if len(t.subs[topic]) == 0 {
+			delete(t.subs, topic)
+		}
+	}
+}
+
+// deliver sends a message to subscribers of its topic without blocking,
+// dropping it for subscribers with full buffers
+func (t *topics) deliver(msg Message) {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	for ch := range t.subs[msg.Topic] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// list returns topics with subscribers, sorted
+func (t *topics) list() []string {
+	if t == nil {
+		return []string{}
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	list := make([]string, 0, len(t.subs))
+	for topic := range t.subs {
+		list = append(list, topic)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// subscribed reports whether topic has subscribers
+func (t *topics) subscribed(topic string) bool {
+	if t == nil {
+		return false
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return len(t.subs[topic]) > 0
+}
+
+// close ends all subscriptions
+func (t *topics) close() {
+	if t == nil {
+		return
+	}
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	close(t.done)
+	for topic, subs := range t.subs {
+		for ch := range subs {
+			t.unsubscribe(topic, ch)
+		}
+	}
+}
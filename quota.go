@@ -0,0 +1,574 @@
+package cafs
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// ErrQuotaExceeded is returned when writing content would exceed a quota
+var ErrQuotaExceeded = errors.New("cafs: quota exceeded")
+
+// QuotaConfig configures a QuotaStore. Zero values mean no limit
+type QuotaConfig struct {
+	// MaxBytes limits the number of distinct content bytes the store may hold.
+	// content shared between roots counts once
+	MaxBytes int64
+	// MaxRootBytes limits the size of a single root, including content it
+	// shares with other roots
+	MaxRootBytes int64
+}
+
+// QuotaOption adjusts quota configuration
+type QuotaOption func(cfg *QuotaConfig)
+
+// OptQuotaMaxBytes sets the number of bytes a store may hold
+func OptQuotaMaxBytes(size int64) QuotaOption {
+	return func(cfg *QuotaConfig) {
+		cfg.MaxBytes = size
+	}
+}
+
+// OptQuotaMaxRootBytes sets the largest root that may be added
+func OptQuotaMaxRootBytes(size int64) QuotaOption {
+	return func(cfg *QuotaConfig) {
+		cfg.MaxRootBytes = size
+	}
+}
+
+// RootUsage reports storage used by a root
+type RootUsage struct {
+	// Bytes is the total size of content in the root
+	Bytes int64
+	// Unique is the number of bytes no other root shares, the amount of space
+	// deleting the root would free
+	Unique int64
+}
+
+// QuotaStore is a Filestore that accounts for the bytes stored by content
+// written through it and enforces quotas. Files are deduplicated by content,
+// so identical files in different roots, or within one root, are counted
+// once toward the store's usage, and only freed when every root referencing
+// them has been deleted.
+//
+// Content is accounted for as the wrapped store reads it, so writes that
+// exceed a quota are stopped without buffering them. Accounting follows what
+// the wrapped store actually removes: when the wrapped store implements
+// Hasher, unreferenced content stays counted until the store no longer has
+// it, eg: MapStore keeps the files of a deleted directory.
+//
+// Accounting is kept in memory & only covers roots written through the
+// store or registered with Track
+type QuotaStore struct {
+	cfg   *QuotaConfig
+	store Filestore
+
+	lk   sync.Mutex
+	used int64
+	// largest is the size of the largest file accounted for. files that
+	// don't fit as new content are read until they're larger than this, as
+	// they might be duplicates
+	largest int64
+	// blocks maps content hashes to their size & reference count
+	blocks map[string]*quotaBlock
+	// roots maps root keys to the content they reference
+	roots map[string]*quotaRoot
+}
+
+type quotaBlock struct {
+	size int64
+	refs int
+	// key is the key the content is stored under in the wrapped store, if
+	// known. unreferenced content with a key is kept until the store no
+	// longer has it
+	key string
+}
+
+// quotaRoot records the content a root references
+type quotaRoot struct {
+	// hashes maps content hashes to their size
+	hashes map[string]int64
+	// total is the size of the root, counting duplicate files
+	total int64
+}
+
+var (
+	_ Filestore = (*QuotaStore)(nil)
+	_ Fetcher   = (*QuotaStore)(nil)
+	_ Pinner    = (*QuotaStore)(nil)
+	_ Hasher    = (*QuotaStore)(nil)
+	_ Closer    = (*QuotaStore)(nil)
+)
+
+// NewQuotaStore wraps a store with accounting & quotas
+func NewQuotaStore(store Filestore, opts ...QuotaOption) *QuotaStore {
+	cfg := &QuotaConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &QuotaStore{
+		cfg:    cfg,
+		store:  store,
+		blocks: map[string]*quotaBlock{},
+		roots:  map[string]*quotaRoot{},
+	}
+}
+
+// Usage returns the number of distinct content bytes held by tracked roots
+func (q *QuotaStore) Usage() int64 {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	return q.used
+}
+
+// RootUsage returns storage used by a tracked root
+func (q *QuotaStore) RootUsage(key string) (RootUsage, error) {
+	k, err := ParseKey(key)
+	if err != nil {
+		return RootUsage{}, err
+	}
+
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	r, ok := q.roots[k.Root().String()]
+	if !ok {
+		return RootUsage{}, NewKeyError("usage", key, ErrNotFound)
+	}
+	u := RootUsage{Bytes: r.total}
+	for h, size := range r.hashes {
+		if q.blocks[h].refs == 1 {
+			u.Unique += size
+		}
+	}
+	return u, nil
+}
+
+// Roots returns the keys of all tracked roots
+func (q *QuotaStore) Roots() []string {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	keys := make([]string, 0, len(q.roots))
+	for key := range q.roots {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Track adds accounting for roots that already exist in the wrapped store.
+// Tracking ignores quotas
+func (q *QuotaStore) Track(keys ...string) error {
+	for _, key := range keys {
+		f, err := q.store.Get(key)
+		if err != nil {
+			return err
+		}
+		a := q.newAccount("track", false)
+		if err = a.finish(drain(a.file(f))); err != nil {
+			return err
+		}
+		q.lk.Lock()
+		orphans := q.setRoot(key, a.root)
+		q.lk.Unlock()
+		q.prune(orphans)
+	}
+	return nil
+}
+
+// PathPrefix returns the prefix of the wrapped store
+func (q *QuotaStore) PathPrefix() string {
+	return q.store.PathPrefix()
+}
+
+// Put writes a file if it fits within quotas. The write is stopped as soon as
+// the content read so far can't fit
+func (q *QuotaStore) Put(file File, pin bool) (key string, err error) {
+	a := q.newAccount("put", true)
+	key, err = q.store.Put(a.file(file), pin)
+	if err = a.finish(err); err != nil {
+		return "", err
+	}
+
+	q.lk.Lock()
+	var orphans []string
+	if _, exists := q.roots[key]; exists {
+		// content was already tracked under this key
+		orphans = q.release(a.root)
+	} else {
+		orphans = q.setRoot(key, a.root)
+	}
+	q.lk.Unlock()
+	q.prune(orphans)
+	return key, nil
+}
+
+// Get reads from the wrapped store
+func (q *QuotaStore) Get(key string) (File, error) {
+	return q.store.Get(key)
+}
+
+// Fetch forwards to the wrapped store. Fetched content isn't accounted for
+func (q *QuotaStore) Fetch(source Source, key string) (File, error) {
+	return fetch(q.store, source, key)
+}
+
+// Has checks the wrapped store for a key
+func (q *QuotaStore) Has(key string) (exists bool, err error) {
+	return q.store.Has(key)
+}
+
+// Delete removes a key from the wrapped store, freeing content no other root
+// references that the store no longer has. Deleting a key that isn't a
+// tracked root frees unreferenced content stored under it
+func (q *QuotaStore) Delete(key string) error {
+	if err := q.store.Delete(key); err != nil {
+		return err
+	}
+
+	q.lk.Lock()
+	var orphans []string
+	if r, ok := q.roots[key]; ok {
+		orphans = q.release(r)
+		delete(q.roots, key)
+	} else {
+		for h, b := range q.blocks {
+			if b.refs <= 0 && b.key == key {
+				orphans = append(orphans, h)
+			}
+		}
+	}
+	q.lk.Unlock()
+	q.prune(orphans)
+	return nil
+}
+
+// NewAdder creates an adder that enforces quotas
+func (q *QuotaStore) NewAdder(pin, wrap bool) (Adder, error) {
+	return newPutAdder(func(f File) (string, error) {
+		return q.Put(f, pin)
+	}), nil
+}
+
+// NewHashAdder forwards to the wrapped store
+func (q *QuotaStore) NewHashAdder(wrap bool) (Adder, error) {
+	h, ok := q.store.(Hasher)
+	if !ok {
+		return nil, NewKeyError("hash", "", ErrNotSupported)
+	}
+	return h.NewHashAdder(wrap)
+}
+
+// Pin forwards to the wrapped store
+func (q *QuotaStore) Pin(key string, recursive bool) error {
+	return pin(q.store, key, recursive)
+}
+
+// Unpin forwards to the wrapped store
+func (q *QuotaStore) Unpin(key string, recursive bool) error {
+	return unpin(q.store, key, recursive)
+}
+
+// Close closes the wrapped store
+func (q *QuotaStore) Close() error {
+	return Close(q.store)
+}
+
+// release drops a reference to each hash in a root, freeing content that's
+// no longer referenced unless its key is known. hashes of unreferenced
+// content with a key are returned to be pruned. callers must hold the lock
+func (q *QuotaStore) release(r *quotaRoot) (orphans []string) {
+	for h := range r.hashes {
+		b, ok := q.blocks[h]
+		if !ok {
+			continue
+		}
+		if b.refs--; b.refs > 0 {
+			continue
+		}
+		if b.key != "" {
+			orphans = append(orphans, h)
+			continue
+		}
+		delete(q.blocks, h)
+		q.used -= b.size
+	}
+	return orphans
+}
+
+// prune frees unreferenced content the wrapped store no longer has. content
+// is kept counted if the store can't be checked
+func (q *QuotaStore) prune(orphans []string) {
+	for _, h := range orphans {
+		q.lk.Lock()
+		b, ok := q.blocks[h]
+		q.lk.Unlock()
+		if !ok {
+			continue
+		}
+		if has, err := q.store.Has(b.key); err != nil || has {
+			continue
+		}
+
+		q.lk.Lock()
+		if b, ok := q.blocks[h]; ok && b.refs <= 0 {
+			delete(q.blocks, h)
+			q.used -= b.size
+		}
+		q.lk.Unlock()
+	}
+}
+
+// setRoot records the content a root references, dropping references held by
+// any previous record. callers must hold the lock
+func (q *QuotaStore) setRoot(key string, r *quotaRoot) (orphans []string) {
+	if prev, ok := q.roots[key]; ok {
+		orphans = q.release(prev)
+	}
+	q.roots[key] = r
+	return orphans
+}
+
+// quotaAccount accounts for the content of a file tree as it's read
+type quotaAccount struct {
+	q       *QuotaStore
+	op      string
+	enforce bool
+	hasher  Hasher
+
+	lk   sync.Mutex
+	root *quotaRoot
+	read int64
+	// err is the first quota error
+	err   error
+	files []*quotaFile
+}
+
+// newAccount starts accounting for a file tree. quotas are only checked if
+// enforce is true
+func (q *QuotaStore) newAccount(op string, enforce bool) *quotaAccount {
+	h, _ := q.store.(Hasher)
+	return &quotaAccount{
+		q:       q,
+		op:      op,
+		enforce: enforce,
+		hasher:  h,
+		root:    &quotaRoot{hashes: map[string]int64{}},
+	}
+}
+
+// file wraps a file tree for accounting
+func (a *quotaAccount) file(f File) File {
+	qf := &quotaFile{File: f, account: a}
+	if !f.IsDirectory() {
+		qf.hash, _ = NewHash(multihash.SHA2_256)
+		if a.hasher != nil {
+			qf.key = newFileKeyer(a.hasher, f.FileName())
+		}
+		a.lk.Lock()
+		a.files = append(a.files, qf)
+		a.lk.Unlock()
+	}
+	return qf
+}
+
+// reserve checks n more bytes of a file that's size bytes so far fit within
+// quotas
+func (a *quotaAccount) reserve(size, n int64) error {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	a.read += n
+	if !a.enforce {
+		return nil
+	}
+
+	cfg := a.q.cfg
+	if cfg.MaxRootBytes > 0 && a.read > cfg.MaxRootBytes {
+		a.err = fmt.Errorf("%w: root is at least %d bytes, limit is %d", ErrQuotaExceeded, a.read, cfg.MaxRootBytes)
+		return a.err
+	}
+	if cfg.MaxBytes > 0 {
+		a.q.lk.Lock()
+		used, largest := a.q.used, a.q.largest
+		a.q.lk.Unlock()
+		// files larger than any stored file can't be duplicates
+		if size > cfg.MaxBytes-used && size > largest {
+			a.err = fmt.Errorf("%w: adding at least %d bytes to %d of %d", ErrQuotaExceeded, size, used, cfg.MaxBytes)
+			return a.err
+		}
+	}
+	return nil
+}
+
+// add references a file's content once it's been read
+func (a *quotaAccount) add(f *quotaFile) error {
+	key := ""
+	if f.key != nil {
+		// content without a key is accounted for as if the store didn't
+		// implement Hasher
+		key, _ = f.key.finish()
+	}
+	h := string(encodeMultihash(f.hash.Sum(nil), multihash.SHA2_256))
+
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	if _, ok := a.root.hashes[h]; ok {
+		return nil
+	}
+
+	q := a.q
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	b, ok := q.blocks[h]
+	if !ok {
+		if a.enforce && q.cfg.MaxBytes > 0 && q.used+f.size > q.cfg.MaxBytes {
+			a.err = fmt.Errorf("%w: adding %d bytes to %d of %d", ErrQuotaExceeded, f.size, q.used, q.cfg.MaxBytes)
+			return a.err
+		}
+		b = &quotaBlock{size: f.size}
+		q.blocks[h] = b
+		q.used += f.size
+		if f.size > q.largest {
+			q.largest = f.size
+		}
+	}
+	if b.key == "" {
+		b.key = key
+	}
+	b.refs++
+	a.root.hashes[h] = f.size
+	return nil
+}
+
+// finish ends accounting once the tree has been read, releasing content if
+// reading failed. quota errors take precedence over err, as wrapped stores
+// may not preserve read errors
+func (a *quotaAccount) finish(err error) error {
+	a.lk.Lock()
+	files, qerr := a.files, a.err
+	a.lk.Unlock()
+	for _, f := range files {
+		if f.key != nil && !f.done {
+			f.key.abort()
+		}
+	}
+
+	if qerr != nil {
+		err = NewKeyError(a.op, "", qerr)
+	}
+	if err != nil {
+		a.q.lk.Lock()
+		orphans := a.q.release(a.root)
+		a.q.lk.Unlock()
+		a.q.prune(orphans)
+		return err
+	}
+	a.root.total = a.read
+	return nil
+}
+
+// quotaFile accounts for a file as it's read. directories wrap their children
+type quotaFile struct {
+	File
+	account *quotaAccount
+	hash    hash.Hash
+	key     *fileKeyer
+	size    int64
+	done    bool
+}
+
+func (f *quotaFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if n > 0 {
+		f.hash.Write(p[:n])
+		if f.key != nil {
+			f.key.write(p[:n])
+		}
+		f.size += int64(n)
+		if qerr := f.account.reserve(f.size, int64(n)); qerr != nil {
+			return 0, qerr
+		}
+	}
+	if err == io.EOF && !f.done {
+		f.done = true
+		if qerr := f.account.add(f); qerr != nil {
+			return 0, qerr
+		}
+	}
+	return n, err
+}
+
+func (f *quotaFile) NextFile() (File, error) {
+	next, err := f.File.NextFile()
+	if err != nil {
+		return nil, err
+	}
+	return f.account.file(next), nil
+}
+
+// fileKeyer computes the key a Hasher gives a file from its content as it's
+// read, without buffering it
+type fileKeyer struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	key  string
+	err  error
+}
+
+func newFileKeyer(h Hasher, name string) *fileKeyer {
+	pr, pw := io.Pipe()
+	k := &fileKeyer{pw: pw, done: make(chan struct{})}
+	go func() {
+		k.key, _, k.err = HashFile(h, NewMemfileReader(name, pr))
+		// unblock writes if hashing stopped early
+		pr.CloseWithError(io.ErrClosedPipe)
+		close(k.done)
+	}()
+	return k
+}
+
+// write passes file content to the hasher. errors are reported by finish
+func (k *fileKeyer) write(p []byte) {
+	k.pw.Write(p)
+}
+
+// finish waits for the key once all content has been written
+func (k *fileKeyer) finish() (string, error) {
+	k.pw.Close()
+	<-k.done
+	return k.key, k.err
+}
+
+// abort stops hashing a file that won't be read to the end
+func (k *fileKeyer) abort() {
+	k.pw.CloseWithError(io.ErrUnexpectedEOF)
+	<-k.done
+}
+
+// drain reads every file in a tree
+func drain(f File) error {
+	if !f.IsDirectory() {
+		_, err := io.Copy(ioutil.Discard, f)
+		return err
+	}
+	for {
+		ch, err := f.NextFile()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := drain(ch); err != nil {
+			return err
+		}
+	}
+}
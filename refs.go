@@ -0,0 +1,215 @@
+package cafs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Referencer is implemented by Filestores that can store named references
+// to keys, like git refs, eg: refs/datasets/foo -> /ipfs/QmFoo. Refs are
+// updated with compare-and-swap, so concurrent writers can't silently
+// overwrite each other, and every change is recorded in the ref's history.
+// Referenced keys are GC roots: stores that collect garbage keep content refs
+// point to as if it were pinned
+type Referencer interface {
+	// Ref returns the key name refers to, or ErrNotFound if there's no ref
+	// with that name
+	Ref(name string) (key string, err error)
+	// UpdateRef points name at new if it currently points at old, returning
+	// ErrRefConflict otherwise. An old value of "" requires the ref not to
+	// exist, and a new value of "" deletes the ref
+	UpdateRef(name, old, new string) error
+	// ListRefs returns refs with names beginning with prefix, sorted by name
+	ListRefs(prefix string) ([]Ref, error)
+	// RefHistory returns changes to a ref, newest first. History is kept
+	// after a ref is deleted
+	RefHistory(name string) ([]RefUpdate, error)
+}
+
+// Ref is a named reference to a key
+type Ref struct {
+	Name string
+	Key  string
+}
+
+// RefUpdate records a change to a ref. Old is "" when the ref was created,
+// and New is "" when it was deleted
+type RefUpdate struct {
+	Name string
+	Old  string
+	New  string
+	Time time.Time
+}
+
+// ValidRefName checks name can be used as a ref. Ref names are slash
+// separated components, eg: refs/datasets/foo. Components can't be empty, "."
+// or "..", and names can't contain whitespace, control characters or any of
+// ~^:?*[\
+func ValidRefName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: ref name is empty", ErrInvalidRef)
+	}
+	for _, comp := range strings.Split(name, "/") {
+		if comp == "" || comp == "." || comp == ".." {
+			return fmt.Errorf("%w: %q has an empty, \".\" or \"..\" component", ErrInvalidRef, name)
+		}
+	}
+	for _, r := range name {
+		if r <= ' ' || r == 0x7f || strings.ContainsRune("~^:?*[\\", r) {
+			return fmt.Errorf("%w: %q contains invalid character %q", ErrInvalidRef, name, r)
+		}
+	}
+	return nil
+}
+
+var _ Referencer = (*Refs)(nil)
+
+// Refs is a table of refs and their history. Filestores use Refs to
+// implement Referencer, checking keys belong to the store before updating.
+// Refs is safe for concurrent use, and encodes to JSON for persistence
+type Refs struct {
+	lk      sync.Mutex
+	refs    map[string]string
+	history map[string][]RefUpdate
+}
+
+// NewRefs allocates an empty Refs
+func NewRefs() *Refs {
+	return &Refs{
+		refs:    map[string]string{},
+		history: map[string][]RefUpdate{},
+	}
+}
+
+// Ref implements the Referencer interface
+func (r *Refs) Ref(name string) (string, error) {
+	if err := ValidRefName(name); err != nil {
+		return "", NewKeyError("ref", name, err)
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	key, ok := r.refs[name]
+	if !ok {
+		return "", NewKeyError("ref", name, ErrNotFound)
+	}
+	return key, nil
+}
+
+// UpdateRef implements the Referencer interface
+func (r *Refs) UpdateRef(name, old, new string) error {
+	if err := ValidRefName(name); err != nil {
+		return NewKeyError("updateref", name, err)
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if current := r.refs[name]; current != old {
+		return NewKeyError("updateref", name, fmt.Errorf("%w: expected %q, ref is %q", ErrRefConflict, old, current))
+	}
+	if old == new {
+		return nil
+	}
+
+	if new == "" {
+		delete(r.refs, name)
+	} else {
+		r.refs[name] = new
+	}
+	r.history[name] = append(r.history[name], RefUpdate{Name: name, Old: old, New: new, Time: time.Now()})
+	return nil
+}
+
+// ListRefs implements the Referencer interface
+func (r *Refs) ListRefs(prefix string) ([]Ref, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	refs := []Ref{}
+	for name, key := range r.refs {
+		if strings.HasPrefix(name, prefix) {
+			refs = append(refs, Ref{Name: name, Key: key})
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name < refs[j].Name })
+	return refs, nil
+}
+
+// RefHistory implements the Referencer interface
+func (r *Refs) RefHistory(name string) ([]RefUpdate, error) {
+	if err := ValidRefName(name); err != nil {
+		return nil, NewKeyError("refhistory", name, err)
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	history := r.history[name]
+	updates := make([]RefUpdate, len(history))
+	for i, u := range history {
+		updates[len(history)-1-i] = u
+	}
+	return updates, nil
+}
+
+// Roots returns the distinct keys refs point to, which stores must keep when
+// collecting garbage
+func (r *Refs) Roots() []string {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	seen := map[string]bool{}
+	roots := []string{}
+	for _, key := range r.refs {
+		if !seen[key] {
+			seen[key] = true
+			roots = append(roots, key)
+		}
+	}
+	sort.Strings(roots)
+	return roots
+}
+
+// Clone returns a copy of r. Stores that persist refs can update a clone,
+// replacing the original only once the clone has been saved
+func (r *Refs) Clone() *Refs {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	c := NewRefs()
+	for name, key := range r.refs {
+		c.refs[name] = key
+	}
+	for name, history := range r.history {
+		c.history[name] = append([]RefUpdate(nil), history...)
+	}
+	return c
+}
+
+// refsJSON is the encoded form of Refs
+type refsJSON struct {
+	Refs    map[string]string      `json:"refs"`
+	History map[string][]RefUpdate `json:"history"`
+}
+
+// MarshalJSON implements the json.Marshaler interface
+func (r *Refs) MarshalJSON() ([]byte, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	return json.Marshal(refsJSON{Refs: r.refs, History: r.history})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface
+func (r *Refs) UnmarshalJSON(data []byte) error {
+	v := refsJSON{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.Refs == nil {
+		v.Refs = map[string]string{}
+	}
+	if v.History == nil {
+		v.History = map[string][]RefUpdate{}
+	}
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.refs, r.history = v.Refs, v.History
+	return nil
+}
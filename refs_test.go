@@ -0,0 +1,50 @@
+package cafs
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRefsJSON(t *testing.T) {
+	refs := NewRefs()
+	if err := refs.UpdateRef("refs/a", "", "/map/QmA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := refs.UpdateRef("refs/a", "/map/QmA", "/map/QmB"); err != nil {
+		t.Fatal(err)
+	}
+	if err := refs.UpdateRef("refs/b", "", "/map/QmB"); err != nil {
+		t.Fatal(err)
+	}
+
+	// clones are independent of the original
+	clone := refs.Clone()
+	if err := clone.UpdateRef("refs/b", "/map/QmB", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := refs.Ref("refs/b"); err != nil {
+		t.Errorf("expected updating a clone to leave the original unchanged, got: %s", err)
+	}
+
+	data, err := json.Marshal(refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := NewRefs()
+	if err := json.Unmarshal(data, got); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := got.Ref("refs/a"); err != nil || key != "/map/QmB" {
+		t.Errorf("expected refs/a to be /map/QmB, got: %q, err: %v", key, err)
+	}
+	history, err := got.RefHistory("refs/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].New != "/map/QmB" || history[1].New != "/map/QmA" {
+		t.Errorf("history mismatch: %v", history)
+	}
+	if roots := got.Roots(); len(roots) != 1 || roots[0] != "/map/QmB" {
+		t.Errorf("expected a single root /map/QmB, got: %v", roots)
+	}
+}
@@ -0,0 +1,370 @@
+package cafs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ReplicaSet is a Filestore that writes content to a number of stores.
+// The first store is the primary, and all keys a ReplicaSet returns are keys
+// of the primary store. Replicas with a different PathPrefix than the primary
+// store content under different keys. ReplicaSet keeps a table mapping primary
+// keys to replica keys for content it has written. The table is only kept in
+// memory: after a restart content in replicas with a different PathPrefix
+// can't be found by primary key until it's written again. Replicas that share
+// the primary's PathPrefix must produce the same keys
+type ReplicaSet struct {
+	stores []Filestore
+	quorum int
+
+	lk sync.Mutex
+	// keys maps primary root keys to the root key stored in each replica.
+	// an empty string means the replica doesn't have the content
+	keys map[string][]string
+}
+
+var (
+	_ Filestore = (*ReplicaSet)(nil)
+	_ Fetcher   = (*ReplicaSet)(nil)
+	_ Pinner    = (*ReplicaSet)(nil)
+	_ Closer    = (*ReplicaSet)(nil)
+)
+
+// NewReplicaSet creates a ReplicaSet. Put will fail unless at least quorum
+// stores, including the primary, successfully write content
+func NewReplicaSet(quorum int, primary Filestore, replicas ...Filestore) (*ReplicaSet, error) {
+	stores := append([]Filestore{primary}, replicas...)
+	if quorum < 1 || quorum > len(stores) {
+		return nil, fmt.Errorf("quorum must be between 1 and the number of stores (%d), got: %d", len(stores), quorum)
+	}
+
+	return &ReplicaSet{
+		stores: stores,
+		quorum: quorum,
+		keys:   map[string][]string{},
+	}, nil
+}
+
+// PathPrefix returns the prefix of the primary store
+func (r *ReplicaSet) PathPrefix() string {
+	return r.stores[0].PathPrefix()
+}
+
+// Put writes a file to all stores in parallel. If fewer than quorum stores
+// succeed Put returns the primary key alongside an error
+func (r *ReplicaSet) Put(file File, pin bool) (key string, err error) {
+	snap, err := snapshotFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, len(r.stores))
+	errs := make([]error, len(r.stores))
+	wg := sync.WaitGroup{}
+	for i, s := range r.stores {
+		wg.Add(1)
+		go func(i int, s Filestore) {
+			keys[i], errs[i] = s.Put(snap.File(), pin)
+			wg.Done()
+		}(i, s)
+	}
+	wg.Wait()
+
+	if errs[0] != nil {
+		return "", errs[0]
+	}
+	key = keys[0]
+
+	written := 1
+	for i := 1; i < len(keys); i++ {
+		if errs[i] == nil && !r.keysMatch(i, key, keys[i]) {
+			errs[i] = fmt.Errorf("replica %d key %s doesn't match primary key %s", i, keys[i], key)
+		}
+		if errs[i] != nil {
+			keys[i] = ""
+			continue
+		}
+		written++
+	}
+
+	r.setKeys(key, keys)
+
+	if written < r.quorum {
+		return key, NewKeyError("put", key, fmt.Errorf("wrote to %d stores, quorum is %d: %w", written, r.quorum, firstError(errs)))
+	}
+	return key, nil
+}
+
+// keysMatch checks a replica key is consistent with the primary key
+func (r *ReplicaSet) keysMatch(i int, primaryKey, replicaKey string) bool {
+	if r.stores[i].PathPrefix() != r.PathPrefix() {
+		return true
+	}
+	return primaryKey == replicaKey
+}
+
+// Get reads from the primary store, falling back to replicas in order
+func (r *ReplicaSet) Get(key string) (File, error) {
+	var first error
+	for i, s := range r.stores {
+		rk, err := r.replicaKey(i, key)
+		if err != nil {
+			return nil, err
+		}
+		if rk == "" {
+			continue
+		}
+		f, err := s.Get(rk)
+		if err == nil {
+			return f, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	if first == nil {
+		first = NewKeyError("get", key, ErrNotFound)
+	}
+	return nil, first
+}
+
+// Fetch fetches from the first store that implements Fetcher
+func (r *ReplicaSet) Fetch(source Source, key string) (File, error) {
+	for i, s := range r.stores {
+		if _, ok := s.(Fetcher); !ok {
+			continue
+		}
+		rk, err := r.replicaKey(i, key)
+		if err != nil {
+			return nil, err
+		}
+		if rk != "" {
+			return fetch(s, source, rk)
+		}
+	}
+	return nil, NewKeyError("fetch", key, ErrNotSupported)
+}
+
+// Has returns true if any store has the key
+func (r *ReplicaSet) Has(key string) (exists bool, err error) {
+	for i, s := range r.stores {
+		rk, err := r.replicaKey(i, key)
+		if err != nil {
+			return false, err
+		}
+		if rk == "" {
+			continue
+		}
+		if exists, err = s.Has(rk); err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+// Delete removes a key from all stores
+func (r *ReplicaSet) Delete(key string) error {
+	errs := make([]error, len(r.stores))
+	for i, s := range r.stores {
+		rk, err := r.replicaKey(i, key)
+		if err != nil {
+			return err
+		}
+		if rk != "" {
+			errs[i] = s.Delete(rk)
+		}
+	}
+
+	if k, err := ParseKey(key); err == nil && k.Path == "" {
+		r.lk.Lock()
+		delete(r.keys, key)
+		r.lk.Unlock()
+	}
+	return firstError(errs)
+}
+
+// NewAdder creates an adder that writes each added file to all stores
+func (r *ReplicaSet) NewAdder(pin, wrap bool) (Adder, error) {
+	return newPutAdder(func(f File) (string, error) {
+		return r.Put(f, pin)
+	}), nil
+}
+
+// Pin pins a key in all stores that implement Pinner
+func (r *ReplicaSet) Pin(key string, recursive bool) error {
+	return r.eachPinner("pin", key, func(p Pinner, rk string) error {
+		return p.Pin(rk, recursive)
+	})
+}
+
+// Unpin unpins a key in all stores that implement Pinner
+func (r *ReplicaSet) Unpin(key string, recursive bool) error {
+	return r.eachPinner("unpin", key, func(p Pinner, rk string) error {
+		return p.Unpin(rk, recursive)
+	})
+}
+
+// Close closes all stores
+func (r *ReplicaSet) Close() error {
+	return closeAll(r.stores...)
+}
+
+func (r *ReplicaSet) eachPinner(op, key string, do func(p Pinner, rk string) error) error {
+	var errs []error
+	for i, s := range r.stores {
+		p, ok := s.(Pinner)
+		if !ok {
+			continue
+		}
+		rk, err := r.replicaKey(i, key)
+		if err != nil {
+			return err
+		}
+		if rk != "" {
+			errs = append(errs, do(p, rk))
+		}
+	}
+	if errs == nil {
+		return NewKeyError(op, key, ErrNotSupported)
+	}
+	return firstError(errs)
+}
+
+// ReplicaKeys returns the key content is stored under in each store, in the
+// order stores were given to NewReplicaSet. Stores known to be missing the
+// content have an empty string
+func (r *ReplicaSet) ReplicaKeys(key string) ([]string, error) {
+	keys := make([]string, len(r.stores))
+	for i := range r.stores {
+		rk, err := r.replicaKey(i, key)
+		if err != nil {
+			return nil, err
+		}
+		keys[i] = rk
+	}
+	return keys, nil
+}
+
+// Repair copies content the ReplicaSet has written to stores that are missing
+// it, returning the number of copies made
+func (r *ReplicaSet) Repair() (copied int, err error) {
+	r.lk.Lock()
+	roots := make([]string, 0, len(r.keys))
+	for key := range r.keys {
+		roots = append(roots, key)
+	}
+	r.lk.Unlock()
+
+	for _, key := range roots {
+		n, err := r.repair(key)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// repair copies a single key to replicas missing it
+func (r *ReplicaSet) repair(key string) (copied int, err error) {
+	keys, err := r.ReplicaKeys(key)
+	if err != nil {
+		return 0, err
+	}
+
+	missing := make([]bool, len(r.stores))
+	var snap *fileSnapshot
+	for i, s := range r.stores {
+		if keys[i] != "" {
+			has, err := s.Has(keys[i])
+			if err != nil {
+				return copied, err
+			}
+			if has {
+				if snap == nil {
+					f, err := s.Get(keys[i])
+					if err != nil {
+						return copied, err
+					}
+					if snap, err = snapshotFile(f); err != nil {
+						return copied, err
+					}
+				}
+				continue
+			}
+		}
+		missing[i] = true
+	}
+
+	if snap == nil {
+		return 0, NewKeyError("repair", key, fmt.Errorf("%w: no store has content", ErrNotFound))
+	}
+
+	for i, s := range r.stores {
+		if !missing[i] {
+			continue
+		}
+		rk, err := s.Put(snap.File(), false)
+		if err != nil {
+			return copied, err
+		}
+		if !r.keysMatch(i, key, rk) {
+			return copied, NewKeyError("repair", key, fmt.Errorf("store %d wrote mismatched key: %s", i, rk))
+		}
+		keys[i] = rk
+		copied++
+	}
+
+	r.setKeys(key, keys)
+	return copied, nil
+}
+
+// replicaKey maps a primary key to the key for store i. keys with a path are
+// mapped by their root
+func (r *ReplicaSet) replicaKey(i int, key string) (string, error) {
+	k, err := ParseKey(key)
+	if err != nil {
+		return "", err
+	}
+	if i == 0 {
+		return key, nil
+	}
+
+	r.lk.Lock()
+	keys, ok := r.keys[k.Root().String()]
+	r.lk.Unlock()
+
+	if ok {
+		if keys[i] == "" {
+			return "", nil
+		}
+		rk, err := ParseKey(keys[i])
+		if err != nil {
+			return "", err
+		}
+		return rk.Join(k.Path).String(), nil
+	}
+
+	// without a record of the content, replicas that share a prefix with the
+	// primary use the same key
+	if r.stores[i].PathPrefix() == k.Prefix {
+		return key, nil
+	}
+	return "", nil
+}
+
+func (r *ReplicaSet) setKeys(key string, keys []string) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.keys[key] = keys
+}
+
+// firstError returns the first non-nil error in a slice
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package test
+
+import (
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestMapstoreBatch(t *testing.T) {
+	ms := cafs.NewMapstore()
+	if err := EnsureBatcherBehavior(ms); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms.Files) != 0 {
+		t.Errorf("expected DeleteMany to remove all files, %d remain", len(ms.Files))
+	}
+}
@@ -0,0 +1,206 @@
+package test
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestCache(t *testing.T) {
+	c, err := cafs.NewCache(cafs.NewMapstore(), cafs.NewMapstore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureFilestoreBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureHasherBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+
+	c, err = cafs.NewCache(cafs.NewMapstore(), cafs.NewMapstore(), cafs.OptCacheWriteBack, cafs.OptCacheMaxSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureFilestoreBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestCacheReadThrough(t *testing.T) {
+	fast, slow := cafs.NewMapstore(), cafs.NewMapstore()
+	key, err := slow.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := cafs.NewCache(fast, slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(key); err != nil {
+		t.Fatal(err)
+	}
+	if len(fast.Files) != 1 {
+		t.Errorf("expected read to populate fast store. expected 1 file, got: %d", len(fast.Files))
+	}
+
+	// reads should be served from the fast store
+	if err := slow.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	f, err := c.Get(key)
+	if err != nil {
+		t.Fatalf("expected cached read to succeed, got: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a" {
+		t.Errorf("data mismatch. expected: a, got: %s", data)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	fast, slow := cafs.NewMapstore(), cafs.NewMapstore()
+	c, err := cafs.NewCache(fast, slow, cafs.OptCacheMaxSize(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := c.Put(cafs.NewMemfileBytes("a.txt", []byte("aaa")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(cafs.NewMemfileBytes("b.txt", []byte("bbb")), false); err != nil {
+		t.Fatal(err)
+	}
+	// touch a so b is least recently used
+	if _, err := c.Get(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put(cafs.NewMemfileBytes("c.txt", []byte("ccc")), false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fast.Files) != 2 {
+		t.Errorf("expected fast store to hold 2 files, got: %d", len(fast.Files))
+	}
+	if len(slow.Files) != 3 {
+		t.Errorf("expected slow store to hold 3 files, got: %d", len(slow.Files))
+	}
+	if has, _ := fast.Has(a); !has {
+		t.Errorf("expected recently used key to remain cached")
+	}
+}
+
+func TestCacheEvictDirectory(t *testing.T) {
+	fast, slow := cafs.NewMapstore(), cafs.NewMapstore()
+	c, err := cafs.NewCache(fast, slow, cafs.OptCacheMaxSize(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Put(cafs.NewMemdir("/dir",
+		cafs.NewMemfileBytes("a.txt", []byte("aaa")),
+		cafs.NewMemfileBytes("b.txt", []byte("bbb")),
+	), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(fast.Files) != 3 {
+		t.Errorf("expected fast store to hold a directory & 2 files, got: %d", len(fast.Files))
+	}
+	if _, err := c.Put(cafs.NewMemfileBytes("c.txt", []byte("ccc")), false); err != nil {
+		t.Fatal(err)
+	}
+	// evicting the directory removes its children
+	if len(fast.Files) != 1 {
+		t.Errorf("expected fast store to hold 1 file after evicting a directory, got: %d", len(fast.Files))
+	}
+}
+
+func TestCachePutFailure(t *testing.T) {
+	fast := cafs.NewMapstore()
+	c, err := cafs.NewCache(fast, failStore{cafs.NewMapstore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := c.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err == nil {
+		t.Fatal("expected error when the slow store fails")
+	}
+	if key != "" {
+		t.Errorf("expected no key on error, got: %s", key)
+	}
+	if len(fast.Files) != 0 {
+		t.Errorf("expected failed put to be removed from the fast store, got %d files", len(fast.Files))
+	}
+}
+
+func TestCacheWriteBack(t *testing.T) {
+	fast, slow := cafs.NewMapstore(), cafs.NewMapstore()
+	c, err := cafs.NewCache(fast, slow, cafs.OptCacheWriteBack)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := c.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := slow.Has(key); has {
+		t.Errorf("write back cache shouldn't write to the slow store before flushing")
+	}
+	if has, _ := c.Has(key); !has {
+		t.Errorf("expected cache to have unflushed key")
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := slow.Has(key); !has {
+		t.Errorf("expected flush to write key to slow store")
+	}
+
+	if _, err := cafs.NewCache(fast, bareStore{slow}, cafs.OptCacheWriteBack); err == nil {
+		t.Errorf("expected error creating write back cache without a Hasher")
+	}
+}
+
+func TestCacheForwarding(t *testing.T) {
+	c, err := cafs.NewCache(cafs.NewMapstore(), bareStore{cafs.NewMapstore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pin("/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S", true); !errors.Is(err, cafs.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported pinning in a store that doesn't pin, got: %v", err)
+	}
+	if _, err := c.Fetch(cafs.SourceAny, "/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S"); !errors.Is(err, cafs.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported fetching from a store that doesn't fetch, got: %v", err)
+	}
+
+	slow := cafs.NewMapstore()
+	c, err = cafs.NewCache(cafs.NewMapstore(), slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Pin("/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S", true); err != nil {
+		t.Errorf("unexpected error pinning: %s", err)
+	}
+	if _, pinned, _ := slow.IsPinned("/map/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S"); !pinned {
+		t.Errorf("expected pin to be forwarded to slow store")
+	}
+}
+
+// bareStore hides the optional interfaces (Pinner, Fetcher, Hasher) of a store
+type bareStore struct {
+	cafs.Filestore
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	def := cafs.NewMapstore()
+	other := newMuxBackend("other")
+	defEvents := def.Subscribe(ctx, 1)
+	otherEvents := other.Subscribe(ctx, 1)
+
+	m, err := cafs.NewMux(def, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := cafs.NewEncryptedStore(m, encryptionKey("a", cafs.CipherAESGCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := cafs.NewInstrumentedStore(encrypted)
+
+	// closing the outermost wrapper closes every store it wraps
+	if err := cafs.Close(fs); err != nil {
+		t.Fatal(err)
+	}
+	for name, events := range map[string]<-chan cafs.Event{"default": defEvents, "other": otherEvents} {
+		select {
+		case _, ok := <-events:
+			if ok {
+				t.Errorf("%s: expected subscription to be closed, got an event", name)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: timed out waiting for subscription to close", name)
+		}
+	}
+
+	// subscribing to a closed store returns a closed channel
+	if _, ok := <-def.Subscribe(ctx, 1); ok {
+		t.Error("expected subscribing to a closed store to return a closed channel")
+	}
+
+	// closing twice is a no-op
+	if err := cafs.Close(fs); err != nil {
+		t.Errorf("expected closing a closed store to succeed, got: %s", err)
+	}
+
+	// errors from wrapped stores are reported
+	rs, err := cafs.NewReplicaSet(1, cafs.NewMapstore(), failCloser{cafs.NewMapstore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.Close(); !errors.Is(err, errCloseFailed) {
+		t.Errorf("expected close error, got: %v", err)
+	}
+
+	// stores that don't implement Closer have nothing to close
+	if err := cafs.Close(notCloser{cafs.NewMapstore()}); err != nil {
+		t.Errorf("expected closing a store that isn't a Closer to succeed, got: %s", err)
+	}
+}
+
+var errCloseFailed = errors.New("close failed")
+
+// failCloser is a store that fails to close
+type failCloser struct {
+	*cafs.MapStore
+}
+
+func (failCloser) Close() error { return errCloseFailed }
+
+// notCloser hides MapStore's Close method
+type notCloser struct {
+	cafs.Filestore
+}
@@ -0,0 +1,160 @@
+package test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestCompressedStore(t *testing.T) {
+	c := cafs.NewCompressedStore(cafs.NewMapstore(), cafs.OptCompressMinSize(0))
+	if err := EnsureFilestoreBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureHasherBehavior(c); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestCompressedStoreStoredBytes(t *testing.T) {
+	ms := cafs.NewMapstore()
+	c := cafs.NewCompressedStore(ms)
+	csv := []byte(strings.Repeat("a,b,c,d\n1,2,3,4\n", 500))
+
+	cases := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"data.csv", csv, true},
+		{"data.csv.gz", csv, false},
+		{"small.csv", []byte("a,b\n1,2\n"), false},
+		{"sniffed.bin", append([]byte{0x1f, 0x8b}, csv...), false},
+	}
+
+	for _, cas := range cases {
+		key, err := c.Put(cafs.NewMemfileBytes(cas.name, cas.data), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, err := ioutil.ReadAll(mustGet(t, ms, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := len(stored) < len(cas.data); compressed != cas.compressed {
+			t.Errorf("%s: expected compressed: %t. logical: %d, stored: %d", cas.name, cas.compressed, len(cas.data), len(stored))
+		}
+		got, err := ioutil.ReadAll(mustGet(t, c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, cas.data) {
+			t.Errorf("%s: content mismatch after decompression", cas.name)
+		}
+	}
+}
+
+func TestCompressedStoreMixed(t *testing.T) {
+	ms := cafs.NewMapstore()
+	raw, err := ms.Put(cafs.NewMemfileBytes("raw.txt", []byte("written without compression")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cafs.NewCompressedStore(ms)
+	data, err := ioutil.ReadAll(mustGet(t, c, raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "written without compression" {
+		t.Errorf("expected unmarked content to read as-is, got: %q", string(data))
+	}
+
+	cafs.RegisterCompressor(rleCompressor{})
+	rle := cafs.NewCompressedStore(ms, cafs.OptCompressor(rleCompressor{}), cafs.OptCompressMinSize(0))
+	key, err := rle.Put(cafs.NewMemfileBytes("a.txt", []byte(strings.Repeat("a", 90)+"b")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a store configured with gzip reads content written with another compressor
+	data, err = ioutil.ReadAll(mustGet(t, c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != strings.Repeat("a", 90)+"b" {
+		t.Errorf("expected registered compressor to decompress, got: %q", string(data))
+	}
+}
+
+func TestCompressedStoreAdder(t *testing.T) {
+	c := cafs.NewCompressedStore(cafs.NewMapstore())
+	a, err := c.NewAdder(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("compressible ", 1000))
+	if err := a.AddFile(cafs.NewMemfileBytes("a.txt", data)); err != nil {
+		t.Fatal(err)
+	}
+	added := <-a.Added()
+	if added.Bytes != int64(len(data)) {
+		t.Errorf("expected Bytes to report logical size %d, got: %d", len(data), added.Bytes)
+	}
+	stored, err := strconv.ParseInt(added.Size, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored <= 0 || stored >= added.Bytes {
+		t.Errorf("expected Size to report compressed size, got: %d", stored)
+	}
+}
+
+// rleCompressor is a toy run-length encoding compressor
+type rleCompressor struct{}
+
+func (rleCompressor) ID() byte { return 0x7f }
+
+func (rleCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	return &rleWriter{w: w}, nil
+}
+
+func (rleCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	for i := 0; i+1 < len(data); i += 2 {
+		out.Write(bytes.Repeat(data[i+1:i+2], int(data[i])))
+	}
+	return out, nil
+}
+
+type rleWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (w *rleWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+func (w *rleWriter) Close() error {
+	data, out := w.buf.Bytes(), []byte{}
+	for i := 0; i < len(data); {
+		n := 1
+		for i+n < len(data) && data[i+n] == data[i] && n < 255 {
+			n++
+		}
+		out = append(out, byte(n), data[i])
+		i += n
+	}
+	_, err := w.w.Write(out)
+	return err
+}
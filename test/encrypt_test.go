@@ -0,0 +1,184 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func encryptionKey(id string, c cafs.Cipher) cafs.EncryptionKey {
+	return cafs.EncryptionKey{ID: id, Cipher: c, Secret: bytes.Repeat([]byte(id[:1]), 32)}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	cases := []struct {
+		key  cafs.EncryptionKey
+		opts []cafs.EncryptOption
+	}{
+		{encryptionKey("aes", cafs.CipherAESGCM), nil},
+		{encryptionKey("xchacha", cafs.CipherXChaCha20Poly1305), nil},
+		{encryptionKey("aes", cafs.CipherAESGCM), []cafs.EncryptOption{cafs.OptEncryptNames}},
+	}
+
+	for _, c := range cases {
+		e, err := cafs.NewEncryptedStore(cafs.NewMapstore(), c.key, c.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := EnsureFilestoreBehavior(e); err != nil {
+			t.Errorf("%s: %s", c.key.Cipher, err)
+		}
+		if err := EnsureDirectoryBehavior(e); err != nil {
+			t.Errorf("%s: %s", c.key.Cipher, err)
+		}
+		if err := EnsureHasherBehavior(e); err != nil {
+			t.Errorf("%s: %s", c.key.Cipher, err)
+		}
+	}
+
+	if _, err := cafs.NewEncryptedStore(cafs.NewMapstore(), cafs.EncryptionKey{ID: "short", Cipher: cafs.CipherAESGCM, Secret: []byte("short")}); err == nil {
+		t.Error("expected short secret to error")
+	}
+}
+
+func TestEncryptedStoreCiphertext(t *testing.T) {
+	ms := cafs.NewMapstore()
+	e, err := cafs.NewEncryptedStore(ms, encryptionKey("a", cafs.CipherAESGCM), cafs.OptEncryptNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := e.Put(cafs.NewMemdir("/dir",
+		cafs.NewMemfileBytes("secret.txt", []byte("secret content")),
+	), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cafs.Walk(mustGet(t, ms, key), 0, func(f cafs.File, depth int) error {
+		if f.FileName() == "secret.txt" {
+			t.Errorf("expected file name to be encrypted")
+		}
+		if f.IsDirectory() {
+			return nil
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(data, []byte("secret content")) {
+			t.Errorf("expected underlying store to hold ciphertext")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	err = cafs.Walk(mustGet(t, e, key), 0, func(f cafs.File, depth int) error {
+		if f.FullPath() != "/dir/secret.txt" {
+			return nil
+		}
+		found = true
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		if string(data) != "secret content" {
+			t.Errorf("content mismatch. expected: %q, got: %q", "secret content", string(data))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("expected decrypted tree to contain /dir/secret.txt")
+	}
+
+	// encryption is deterministic, preserving deduplication
+	again, err := e.Put(cafs.NewMemdir("/dir",
+		cafs.NewMemfileBytes("secret.txt", []byte("secret content")),
+	), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != key {
+		t.Errorf("expected same content to produce the same key. expected: %s, got: %s", key, again)
+	}
+
+	other, err := cafs.NewEncryptedStore(ms, encryptionKey("b", cafs.CipherAESGCM), cafs.OptEncryptNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Get(key); !errors.Is(err, cafs.ErrDecrypt) {
+		t.Errorf("expected get with an unknown key to return ErrDecrypt, got: %v", err)
+	}
+}
+
+func TestEncryptedStoreRotate(t *testing.T) {
+	ms := cafs.NewMapstore()
+	old := encryptionKey("old", cafs.CipherAESGCM)
+	e, err := cafs.NewEncryptedStore(ms, old, cafs.OptEncryptNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := e.Put(cafs.NewMemdir("/dir", cafs.NewMemfileBytes("a.txt", []byte("a"))), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Rotate(encryptionKey("new", cafs.CipherXChaCha20Poly1305)); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := e.KeyID(key); err != nil || id != "old" {
+		t.Errorf("expected key id 'old', got: %q, err: %v", id, err)
+	}
+	if _, err := e.Get(key); err != nil {
+		t.Errorf("expected content encrypted with a previous key to be readable, got: %s", err)
+	}
+
+	rotated, err := e.Reencrypt(key, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated == key {
+		t.Errorf("expected reencrypted content to have a new key")
+	}
+	if id, err := e.KeyID(rotated); err != nil || id != "new" {
+		t.Errorf("expected key id 'new', got: %q, err: %v", id, err)
+	}
+
+	// a store configured with only the new key can read rotated content, but
+	// needs the old key as a decryption key to read anything else
+	reader, err := cafs.NewEncryptedStore(ms, encryptionKey("new", cafs.CipherXChaCha20Poly1305), cafs.OptEncryptNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Get(rotated); err != nil {
+		t.Errorf("expected rotated content to be readable, got: %s", err)
+	}
+	if _, err := reader.Get(key); !errors.Is(err, cafs.ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt without the old key, got: %v", err)
+	}
+	reader, err = cafs.NewEncryptedStore(ms, encryptionKey("new", cafs.CipherXChaCha20Poly1305), cafs.OptEncryptNames, cafs.OptDecryptionKeys(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Get(key); err != nil {
+		t.Errorf("expected decryption key to read old content, got: %s", err)
+	}
+}
+
+func mustGet(t *testing.T, fs cafs.Filestore, key string) cafs.File {
+	t.Helper()
+	f, err := fs.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
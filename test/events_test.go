@@ -0,0 +1,110 @@
+package test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestMapstoreEvents(t *testing.T) {
+	ms := cafs.NewMapstore()
+	if err := EnsureSubscriberBehavior(ms); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ms.Subscribe(ctx, 10)
+
+	key, err := ms.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Pin(key, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Unpin(key, true); err != nil {
+		t.Fatal(err)
+	}
+	adder, err := ms.NewAdder(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adder.AddFile(cafs.NewMemfileBytes("b.txt", []byte("b"))); err != nil {
+		t.Fatal(err)
+	}
+	added := <-adder.Added()
+
+	for _, expect := range []struct {
+		t   cafs.EventType
+		key string
+	}{
+		{cafs.EventAdd, key},
+		{cafs.EventPin, key},
+		{cafs.EventUnpin, key},
+		{cafs.EventAdd, added.Path},
+	} {
+		if err := nextEvent(events, expect.t, expect.key); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestEventsBackpressure(t *testing.T) {
+	e := cafs.NewEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := e.Subscribe(ctx, 2)
+
+	// a subscriber that isn't reading must never block emitters
+	for i := 0; i < 5; i++ {
+		e.Emit(cafs.EventAdd, "/map/a")
+	}
+
+	for i := 0; i < 2; i++ {
+		if evt := <-events; evt.Type != cafs.EventAdd {
+			t.Errorf("event %d: expected add, got: %s", i, evt.Type)
+		}
+	}
+	// delivery resumes once the subscriber catches up, starting with a count
+	// of dropped events
+	e.Emit(cafs.EventDelete, "/map/a")
+	evt := <-events
+	if evt.Type != cafs.EventDropped || evt.Dropped != 3 {
+		t.Errorf("expected dropped event reporting 3 events, got: %s %d", evt.Type, evt.Dropped)
+	}
+	if evt := <-events; evt.Type != cafs.EventDelete {
+		t.Errorf("expected delete event, got: %s", evt.Type)
+	}
+
+	// nil Events discard events
+	var none *cafs.Events
+	none.Emit(cafs.EventGC, "")
+}
+
+func TestEventsSubscribeBuffer(t *testing.T) {
+	e := cafs.NewEvents()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, ok := <-e.Subscribe(ctx, -1); ok {
+		t.Error("expected negative buffer to return a closed channel")
+	}
+
+	// a zero buffer still holds one event & reports what was dropped
+	events := e.Subscribe(ctx, 0)
+	e.Emit(cafs.EventAdd, "/map/a")
+	e.Emit(cafs.EventAdd, "/map/b")
+	if evt := <-events; evt.Type != cafs.EventAdd || evt.Key != "/map/a" {
+		t.Errorf("expected add event for /map/a, got: %s %s", evt.Type, evt.Key)
+	}
+	e.Emit(cafs.EventDelete, "/map/a")
+	evt := <-events
+	if evt.Type != cafs.EventDropped || evt.Dropped != 1 {
+		t.Errorf("expected dropped event reporting 1 event, got: %s %d", evt.Type, evt.Dropped)
+	}
+	if evt := <-events; evt.Type != cafs.EventDelete {
+		t.Errorf("expected delete event, got: %s", evt.Type)
+	}
+}
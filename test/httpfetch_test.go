@@ -0,0 +1,134 @@
+package test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qri-io/cafs"
+)
+
+// gatewayHandler serves files from a store at their keys
+func gatewayHandler(fs cafs.Filestore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f, err := fs.Get(r.URL.Path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(data)
+	}
+}
+
+func TestHTTPFetcher(t *testing.T) {
+	remote := cafs.NewMapstore()
+	key, err := remote.Put(cafs.NewMemfileBytes("a.txt", []byte("hello gateway")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/map/", gatewayHandler(remote))
+	mux.HandleFunc("/files/a.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello gateway"))
+	})
+	mux.HandleFunc("/files/wrong.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not what you asked for"))
+	})
+	mux.HandleFunc("/files/slow.txt", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	expectContent := func(f cafs.File, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "hello gateway" {
+			t.Errorf("expected 'hello gateway', got: %q", string(data))
+		}
+	}
+
+	// gateway sources serve content at key paths
+	local := cafs.NewMapstore()
+	h := cafs.NewHTTPFetcher(local)
+	expectContent(h.Fetch(cafs.URLSource{URL: s.URL, Gateway: true}, key))
+	if has, _ := local.Has(key); !has {
+		t.Error("expected fetched content to be stored locally")
+	}
+
+	// content already in the store doesn't need a request
+	expectContent(h.Fetch(cafs.URLSource{URL: s.URL + "/nothing-here", Gateway: true}, key))
+
+	// plain url sources address content directly
+	local = cafs.NewMapstore()
+	h = cafs.NewHTTPFetcher(local)
+	expectContent(h.Fetch(cafs.URLSource{URL: s.URL + "/files/a.txt"}, key))
+
+	// content that doesn't match the key is rejected & not stored
+	local = cafs.NewMapstore()
+	h = cafs.NewHTTPFetcher(local)
+	if _, err := h.Fetch(cafs.URLSource{URL: s.URL + "/files/wrong.txt"}, key); !errors.Is(err, cafs.ErrIntegrity) {
+		t.Errorf("expected mismatched content to return ErrIntegrity, got: %v", err)
+	}
+	if len(local.Files) != 0 {
+		t.Errorf("expected mismatched content not to be stored, store has %d files", len(local.Files))
+	}
+
+	missing := "/map/QmcbyjMMT5fFtoiWRJiwV8xoiRWJpSRwC6qCFMqp7EXD4Q"
+	if _, err := h.Fetch(cafs.URLSource{URL: s.URL, Gateway: true}, missing); !errors.Is(err, cafs.ErrNotFound) {
+		t.Errorf("expected missing content to return ErrNotFound, got: %v", err)
+	}
+
+	slow := cafs.SourceWithTimeout(cafs.URLSource{URL: s.URL + "/files/slow.txt"}, time.Millisecond*10)
+	if _, err := h.Fetch(slow, key); !errors.Is(err, cafs.ErrTimeout) {
+		t.Errorf("expected slow fetch to return ErrTimeout, got: %v", err)
+	}
+
+	if _, err := h.Fetch(cafs.URLSource{URL: "ftp://example.com/a.txt"}, key); err == nil {
+		t.Error("expected non-http source to error")
+	}
+	if _, err := h.Fetch(cafs.URLSource{URL: s.URL, Gateway: true}, key+"/a.txt"); !errors.Is(err, cafs.ErrNotSupported) {
+		t.Errorf("expected key with a path to return ErrNotSupported, got: %v", err)
+	}
+
+	// downloads over the size limit are rejected & not stored
+	local = cafs.NewMapstore()
+	h = cafs.NewHTTPFetcher(local, cafs.OptHTTPMaxBytes(5))
+	if _, err := h.Fetch(cafs.URLSource{URL: s.URL + "/files/a.txt"}, key); !errors.Is(err, cafs.ErrByteLimit) {
+		t.Errorf("expected oversized content to return ErrByteLimit, got: %v", err)
+	}
+	if len(local.Files) != 0 {
+		t.Errorf("expected oversized content not to be stored, store has %d files", len(local.Files))
+	}
+	h = cafs.NewHTTPFetcher(local, cafs.OptHTTPMaxBytes(int64(len("hello gateway"))))
+	expectContent(h.Fetch(cafs.URLSource{URL: s.URL + "/files/a.txt"}, key))
+
+	// SourceAny tries gateways in order
+	local = cafs.NewMapstore()
+	h = cafs.NewHTTPFetcher(local, cafs.OptHTTPGateways(s.URL+"/nothing-here", s.URL))
+	expectContent(h.Fetch(cafs.SourceAny, key))
+
+	// without gateways, other sources are fetched by the store
+	h = cafs.NewHTTPFetcher(cafs.NewMapstore())
+	if _, err := h.Fetch(cafs.SourceAny, key); !errors.Is(err, cafs.ErrOffline) {
+		t.Errorf("expected fetch without gateways to be passed to the store, got: %v", err)
+	}
+}
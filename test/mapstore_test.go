@@ -1,8 +1,14 @@
 package test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"testing"
+	"time"
 
+	"github.com/multiformats/go-multihash"
 	"github.com/qri-io/cafs"
 )
 
@@ -14,6 +20,112 @@ func TestMemFilestore(t *testing.T) {
 	if err := EnsureDirectoryBehavior(ms); err != nil {
 		t.Error(err.Error())
 	}
+	if err := EnsureHasherBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsurePinTrackerBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureReferencerBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureNameSystemBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsurePubSubBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestMapstoreLiteral(t *testing.T) {
+	ms := &cafs.MapStore{}
+	key, err := ms.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ms.Pinned {
+		t.Error("expected deprecated Pinned field to be set")
+	}
+	if err := ms.Unpin(key, false); !errors.Is(err, cafs.ErrPinnedRecursively) {
+		t.Errorf("expected direct unpin of a recursive pin to return ErrPinnedRecursively, got: %v", err)
+	}
+	if err := ms.Unpin(key, true); err != nil {
+		t.Fatal(err)
+	}
+	if ms.Pinned {
+		t.Error("expected deprecated Pinned field to be cleared")
+	}
+	if err := ms.UpdateRef("refs/a", "", key); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.PubSubPublish(context.Background(), "topic", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMapstoreLiteralAdder(t *testing.T) {
+	if err := EnsureFilestoreBehavior(&cafs.MapStore{}); err != nil {
+		t.Error(err)
+	}
+	if err := EnsurePinTrackerBehavior(&cafs.MapStore{}); err != nil {
+		t.Error(err)
+	}
+
+	ms := &cafs.MapStore{}
+	events := ms.Subscribe(context.Background(), 10)
+	adder, err := ms.NewAdder(true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adder.AddFile(cafs.NewMemfileBytes("a.txt", []byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	added := <-adder.Added()
+	if err := adder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := ms.Get(added.Path)
+	if err != nil {
+		t.Fatalf("expected added file to be stored, got: %s", err)
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a" {
+		t.Errorf("expected 'a', got: %q", string(data))
+	}
+	if kind, pinned, err := ms.IsPinned(added.Path); err != nil || !pinned || kind != cafs.PinRecursive {
+		t.Errorf("expected added file to be pinned recursively, got: %s %t %v", kind, pinned, err)
+	}
+	for _, expect := range []cafs.EventType{cafs.EventAdd, cafs.EventPin} {
+		if err := nextEvent(events, expect, added.Path); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMapstoreFetchLocal(t *testing.T) {
+	a, b := cafs.NewMapstore(), cafs.NewMapstore()
+	a.AddConnection(b)
+
+	key, err := b.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Fetch(cafs.SourceAny, key); err != nil {
+		t.Errorf("expected fetching from any source to find content on the network, got: %s", err)
+	}
+	if _, err := a.Fetch(cafs.SourceLocal, key); !errors.Is(err, cafs.ErrNotFound) {
+		t.Errorf("expected fetching missing content locally to return ErrNotFound, got: %v", err)
+	}
+	if _, err := b.Fetch(cafs.SourceWithTimeout(cafs.SourceLocal, time.Second), key); err != nil {
+		t.Errorf("expected fetching local content to succeed, got: %s", err)
+	}
 }
 
 func TestPathPrefix(t *testing.T) {
@@ -22,3 +134,238 @@ func TestPathPrefix(t *testing.T) {
 		t.Errorf("path prefix mismatch. expected: 'map', got: %s", got)
 	}
 }
+
+func TestMapstoreVerify(t *testing.T) {
+	peer := cafs.NewMapstore()
+	good, err := peer.Put(cafs.NewMemfileBytes("good.txt", []byte("good")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, err := peer.Put(cafs.NewMemfileBytes("bad.txt", []byte("bad")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a misbehaving peer serves the wrong content for a key
+	peer.Files[good] = peer.Files[bad]
+
+	ms := cafs.NewMapstore()
+	ms.AddConnection(peer)
+
+	f, err := ms.Get(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(f); err != nil {
+		t.Errorf("unverified store shouldn't error reading tampered data, got: %s", err)
+	}
+
+	ms.Verify = true
+	f, err = ms.Get(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(f); !errors.Is(err, cafs.ErrIntegrity) {
+		t.Errorf("expected ErrIntegrity reading tampered data, got: %v", err)
+	}
+
+	if err := EnsureFilestoreBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(ms); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestMapstoreMissingChild(t *testing.T) {
+	ms := cafs.NewMapstore()
+	key, err := ms.Put(cafs.NewMemdir("/dir",
+		cafs.NewMemfileBytes("a.txt", []byte("a")),
+	), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// remove the directory's children, leaving it referring to missing keys
+	for k := range ms.Files {
+		if k != key {
+			delete(ms.Files, k)
+		}
+	}
+
+	for _, verify := range []bool{false, true} {
+		ms.Verify = verify
+		if _, err := ms.Get(key); !errors.Is(err, cafs.ErrNotFound) {
+			t.Errorf("verify %t: expected getting a directory with a missing child to return ErrNotFound, got: %v", verify, err)
+		}
+	}
+}
+
+func TestMapstoreAdderAddedAfterAdd(t *testing.T) {
+	files := make([]cafs.File, 20)
+	for i := range files {
+		files[i] = cafs.NewMemfileBytes(fmt.Sprintf("%d.txt", i), []byte(fmt.Sprintf("file %d", i)))
+	}
+
+	ms := cafs.NewMapstore()
+	a, err := ms.NewAdder(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// adding shouldn't block on a caller that reads Added once it's done
+	done := make(chan error)
+	go func() {
+		done <- a.AddFile(cafs.NewMemdir("/dir", files...))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AddFile blocked waiting for Added to be read")
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	added := 0
+	for range a.Added() {
+		added++
+	}
+	// each file, and the directory
+	if added != len(files)+1 {
+		t.Errorf("expected %d added nodes, got: %d", len(files)+1, added)
+	}
+}
+
+func TestMapstoreHashFuncs(t *testing.T) {
+	cases := []struct {
+		hashFunc uint64
+		encoding cafs.KeyEncoding
+		version  uint64
+	}{
+		{0, cafs.EncodingBase58, 0},
+		{multihash.SHA3_256, cafs.EncodingBase58, 0},
+		{cafs.BLAKE2B_256, cafs.EncodingCIDv1Base32, 1},
+		{multihash.SHA2_256, cafs.EncodingCIDv1Base32, 1},
+	}
+
+	for i, c := range cases {
+		ms := cafs.NewMapstore()
+		ms.HashFunc = c.hashFunc
+		ms.KeyEncoding = c.encoding
+		ms.Verify = true
+
+		if err := EnsureFilestoreBehavior(ms); err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+		}
+		if err := EnsureDirectoryBehavior(ms); err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+		}
+		if err := EnsureHasherBehavior(ms); err != nil {
+			t.Errorf("case %d: %s", i, err.Error())
+		}
+
+		key, err := ms.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		k, err := cafs.ParseKey(key)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		if k.Version != c.version {
+			t.Errorf("case %d version mismatch. expected: %d, got: %d", i, c.version, k.Version)
+		}
+		dec, err := multihash.Decode(k.Multihash)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		expectCode := c.hashFunc
+		if expectCode == 0 {
+			expectCode = multihash.SHA2_256
+		}
+		if dec.Code != expectCode {
+			t.Errorf("case %d hash function mismatch. expected: %x, got: %x", i, expectCode, dec.Code)
+		}
+	}
+}
+
+func TestMapstoreNames(t *testing.T) {
+	ctx := context.Background()
+	a, b := cafs.NewMapstore(), cafs.NewMapstore()
+	a.AddConnection(b)
+
+	key, err := b.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := b.Publish(ctx, "self", key, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.Resolve(ctx, name); err != nil || got != key {
+		t.Errorf("expected names to resolve across the network. got: %q, err: %v", got, err)
+	}
+	if got, err := a.Resolve(ctx, name+"/a.txt"); err != nil || got != key+"/a.txt" {
+		t.Errorf("expected a path on the name to be appended to the key. got: %q, err: %v", got, err)
+	}
+
+	if _, err := b.Publish(ctx, "self", key, time.Nanosecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := b.Resolve(ctx, name); !errors.Is(err, cafs.ErrNotFound) {
+		t.Errorf("expected expired names not to resolve, got: %v", err)
+	}
+	if _, err := b.Resolve(ctx, key); !errors.Is(err, cafs.ErrInvalidKey) {
+		t.Errorf("expected resolving a content key to return ErrInvalidKey, got: %v", err)
+	}
+}
+
+func TestMapstorePubSub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b, c := cafs.NewMapstore(), cafs.NewMapstore(), cafs.NewMapstore()
+	a.AddConnection(b)
+
+	bMsgs, err := b.PubSubSubscribe(ctx, "datasets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cMsgs, err := c.PubSubSubscribe(ctx, "datasets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := a.PubSubPeers(ctx, "datasets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != b.ID() {
+		t.Errorf("expected peers to be [%s], got: %v", b.ID(), peers)
+	}
+
+	if err := a.PubSubPublish(ctx, "datasets", []byte("new version")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-bMsgs:
+		if msg.From != a.ID() || string(msg.Data) != "new version" {
+			t.Errorf("unexpected message: %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message on a connected store")
+	}
+	select {
+	case msg := <-cMsgs:
+		t.Errorf("expected stores that aren't connected not to receive messages, got: %v", msg)
+	default:
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for range bMsgs {
+		// closing a store ends its subscriptions
+	}
+}
@@ -0,0 +1,118 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestInstrumentedStore(t *testing.T) {
+	m := cafs.NewInstrumentedStore(cafs.NewMapstore())
+	if err := EnsureFilestoreBehavior(m); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(m); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureHasherBehavior(m); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestInstrumentedStoreMetrics(t *testing.T) {
+	var spans []cafs.Span
+	m := cafs.NewInstrumentedStore(cafs.NewMapstore(), cafs.OptMetricsSpans(func(s cafs.Span) {
+		spans = append(spans, s)
+	}))
+
+	key, err := m.Put(cafs.NewMemfileBytes("a.txt", []byte("hello")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := m.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(f); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Get("/map/not-a-key"); err == nil {
+		t.Fatal("expected error getting invalid key")
+	}
+	if err := m.Pin(key, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.BytesWritten() != 5 || m.BytesRead() != 5 {
+		t.Errorf("byte count mismatch. expected 5 written & read, got: %d, %d", m.BytesWritten(), m.BytesRead())
+	}
+
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got: %d", len(spans))
+	}
+	if spans[1].Name != "cafs.get" || spans[1].Attributes["cafs.key"] != key || spans[1].Attributes["cafs.store"] != "map" {
+		t.Errorf("unexpected get span: %v", spans[1])
+	}
+	if !errors.Is(spans[2].Err, cafs.ErrInvalidKey) {
+		t.Errorf("expected span to record error, got: %v", spans[2].Err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		`# TYPE cafs_operation_duration_seconds histogram`,
+		`cafs_operation_duration_seconds_count{store="map",op="get"} 2`,
+		`cafs_operation_duration_seconds_bucket{store="map",op="put",le="+Inf"} 1`,
+		`cafs_operation_errors_total{store="map",op="get"} 1`,
+		`cafs_operation_errors_total{store="map",op="pin"} 0`,
+		`cafs_bytes_read_total{store="map"} 5`,
+		`cafs_bytes_written_total{store="map"} 5`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected prometheus output to contain:\n%s\ngot:\n%s", line, out)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != out {
+		t.Errorf("expected ServeHTTP to write prometheus metrics")
+	}
+}
+
+func TestInstrumentedStoreAdder(t *testing.T) {
+	m := cafs.NewInstrumentedStore(cafs.NewMapstore())
+	a, err := m.NewAdder(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for range a.Added() {
+		}
+	}()
+	if err := a.AddFile(cafs.NewMemfileBytes("a.txt", []byte("abc"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if m.BytesWritten() != 3 {
+		t.Errorf("expected adder bytes to be counted. got: %d", m.BytesWritten())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := m.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `cafs_operation_duration_seconds_count{store="map",op="adder_add_file"} 1`) {
+		t.Errorf("expected adder operations to be recorded, got:\n%s", buf.String())
+	}
+}
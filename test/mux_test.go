@@ -0,0 +1,90 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestMux(t *testing.T) {
+	def := cafs.NewMapstore()
+	other := newMuxBackend("other")
+	m, err := cafs.NewMux(def, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureFilestoreBehavior(m); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(m); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureHasherBehavior(m); err != nil {
+		t.Error(err.Error())
+	}
+
+	key, err := other.Put(cafs.NewMemfileBytes("other.txt", []byte("only in other")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, "/other/") {
+		t.Fatalf("expected key with /other/ prefix, got: %s", key)
+	}
+	if _, err := m.Get(key); err != nil {
+		t.Errorf("expected mux to route get to other store, got: %s", err)
+	}
+	if has, err := m.Has(key); err != nil || !has {
+		t.Errorf("expected mux to route has to other store. has: %t err: %v", has, err)
+	}
+	if has, _ := def.Has(strings.Replace(key, "/other/", "/map/", 1)); has {
+		t.Errorf("default store shouldn't have content added to other store")
+	}
+
+	if _, err := m.Get("/nope/QmZ3KfGaSrb3cnTriJbddCzG7hwQi2j6km7Xe7hVpnsW5S"); !errors.Is(err, cafs.ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey for a key with an unknown prefix, got: %v", err)
+	}
+
+	if _, err := cafs.NewMux(cafs.NewMapstore(), cafs.NewMapstore()); err == nil {
+		t.Errorf("expected error creating mux with duplicate prefixes")
+	}
+}
+
+// muxBackend is a MapStore that uses a different path prefix, allowing mux
+// tests to route keys to different backends
+type muxBackend struct {
+	*cafs.MapStore
+	prefix string
+}
+
+func newMuxBackend(prefix string) muxBackend {
+	return muxBackend{MapStore: cafs.NewMapstore(), prefix: prefix}
+}
+
+func (p muxBackend) PathPrefix() string { return p.prefix }
+
+// toMap & fromMap convert keys between prefixes
+func (p muxBackend) toMap(key string) string {
+	return strings.Replace(key, "/"+p.prefix+"/", "/map/", 1)
+}
+func (p muxBackend) fromMap(key string) string {
+	return strings.Replace(key, "/map/", "/"+p.prefix+"/", 1)
+}
+
+func (p muxBackend) Put(file cafs.File, pin bool) (string, error) {
+	key, err := p.MapStore.Put(file, pin)
+	return p.fromMap(key), err
+}
+func (p muxBackend) Get(key string) (cafs.File, error) { return p.MapStore.Get(p.toMap(key)) }
+func (p muxBackend) Has(key string) (bool, error)      { return p.MapStore.Has(p.toMap(key)) }
+func (p muxBackend) Delete(key string) error           { return p.MapStore.Delete(p.toMap(key)) }
+func (p muxBackend) Fetch(s cafs.Source, key string) (cafs.File, error) {
+	return p.MapStore.Fetch(s, p.toMap(key))
+}
+func (p muxBackend) Pin(key string, recursive bool) error {
+	return p.MapStore.Pin(p.toMap(key), recursive)
+}
+func (p muxBackend) Unpin(key string, recursive bool) error {
+	return p.MapStore.Unpin(p.toMap(key), recursive)
+}
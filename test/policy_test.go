@@ -0,0 +1,149 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestReadOnlyStore(t *testing.T) {
+	ms := cafs.NewMapstore()
+	key, err := ms.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := cafs.NewReadOnlyStore(ms)
+	if _, err := r.Get(key); err != nil {
+		t.Errorf("expected read-only store to allow reads, got: %s", err)
+	}
+	if has, err := r.Has(key); err != nil || !has {
+		t.Errorf("expected read-only store to have key. has: %t err: %v", has, err)
+	}
+
+	if _, err := r.Put(cafs.NewMemfileBytes("b.txt", []byte("b")), false); !errors.Is(err, cafs.ErrReadOnly) {
+		t.Errorf("put: expected ErrReadOnly, got: %v", err)
+	}
+	if err := r.Delete(key); !errors.Is(err, cafs.ErrReadOnly) {
+		t.Errorf("delete: expected ErrReadOnly, got: %v", err)
+	}
+	if _, err := r.NewAdder(false, false); !errors.Is(err, cafs.ErrReadOnly) {
+		t.Errorf("new adder: expected ErrReadOnly, got: %v", err)
+	}
+	if err := r.Pin(key, true); !errors.Is(err, cafs.ErrReadOnly) {
+		t.Errorf("pin: expected ErrReadOnly, got: %v", err)
+	}
+	if err := r.Unpin(key, true); !errors.Is(err, cafs.ErrReadOnly) {
+		t.Errorf("unpin: expected ErrReadOnly, got: %v", err)
+	}
+	if has, err := ms.Has(key); err != nil || !has {
+		t.Errorf("expected content to survive read-only delete")
+	}
+}
+
+func TestAllowListStore(t *testing.T) {
+	ms := cafs.NewMapstore()
+	allowed, err := ms.Put(cafs.NewMemdir("/a", cafs.NewMemfileBytes("b.txt", []byte("b"))), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied, err := ms.Put(cafs.NewMemfileBytes("secret.txt", []byte("secret")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := cafs.NewAllowListStore(ms, allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EnsureFilestoreBehavior probes keys that were never written, which an
+	// allow-list rejects
+	if err := EnsureDirectoryBehavior(a); err != nil {
+		t.Error(err.Error())
+	}
+
+	if _, err := a.Get(allowed); err != nil {
+		t.Errorf("expected allowed key to be readable, got: %s", err)
+	}
+	if _, err := a.Get(allowed + "/b.txt"); err != nil {
+		t.Errorf("expected descendants of allowed key to be readable, got: %s", err)
+	}
+	if _, err := a.Get(denied); !errors.Is(err, cafs.ErrNotAllowed) {
+		t.Errorf("get: expected ErrNotAllowed, got: %v", err)
+	}
+	if _, err := a.Has(denied); !errors.Is(err, cafs.ErrNotAllowed) {
+		t.Errorf("has: expected ErrNotAllowed, got: %v", err)
+	}
+	if err := a.Delete(denied); !errors.Is(err, cafs.ErrNotAllowed) {
+		t.Errorf("delete: expected ErrNotAllowed, got: %v", err)
+	}
+	if err := a.Pin(denied, true); !errors.Is(err, cafs.ErrNotAllowed) {
+		t.Errorf("pin: expected ErrNotAllowed, got: %v", err)
+	}
+
+	if _, err := cafs.NewAllowListStore(ms, "not a key"); !errors.Is(err, cafs.ErrInvalidKey) {
+		t.Errorf("expected invalid allow-list key to return ErrInvalidKey, got: %v", err)
+	}
+}
+
+func TestByteLimitStore(t *testing.T) {
+	b := cafs.NewByteLimitStore(cafs.NewMapstore(), 10)
+	if _, err := b.Put(cafs.NewMemfileBytes("a.txt", []byte("123456")), false); err != nil {
+		t.Fatal(err)
+	}
+	if b.Added() != 6 {
+		t.Errorf("expected 6 bytes added, got: %d", b.Added())
+	}
+
+	_, err := b.Put(cafs.NewMemdir("/dir",
+		cafs.NewMemfileBytes("b.txt", []byte("123")),
+		cafs.NewMemfileBytes("c.txt", []byte("45")),
+	), false)
+	if !errors.Is(err, cafs.ErrByteLimit) {
+		t.Errorf("expected ErrByteLimit, got: %v", err)
+	}
+	if b.Added() != 6 {
+		t.Errorf("expected failed put not to count toward limit. got: %d", b.Added())
+	}
+
+	a, err := b.NewAdder(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddFile(cafs.NewMemfileBytes("d.txt", []byte("1234"))); err != nil {
+		t.Errorf("expected add within limit to succeed, got: %s", err)
+	}
+	if err := a.AddFile(cafs.NewMemfileBytes("e.txt", []byte("1"))); !errors.Is(err, cafs.ErrByteLimit) {
+		t.Errorf("expected adder to return ErrByteLimit, got: %v", err)
+	}
+}
+
+func TestByteLimitStoreStreaming(t *testing.T) {
+	b := cafs.NewByteLimitStore(cafs.NewMapstore(), 1024)
+	r := &endlessReader{}
+	_, err := b.Put(cafs.NewMemfileReader("big.bin", r), false)
+	if !errors.Is(err, cafs.ErrByteLimit) {
+		t.Errorf("expected ErrByteLimit, got: %v", err)
+	}
+	// reading stops once the limit is exceeded
+	if r.n > 64*1024 {
+		t.Errorf("expected put to stop reading after exceeding the limit, read %d bytes", r.n)
+	}
+	if b.Added() != 0 {
+		t.Errorf("expected failed put not to count toward limit. got: %d", b.Added())
+	}
+}
+
+// endlessReader produces an unlimited stream of zeros, counting bytes read
+type endlessReader struct {
+	n int64
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
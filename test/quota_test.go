@@ -0,0 +1,161 @@
+package test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestQuotaStore(t *testing.T) {
+	q := cafs.NewQuotaStore(cafs.NewMapstore())
+	if err := EnsureFilestoreBehavior(q); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(q); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureHasherBehavior(q); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestQuotaStoreAccounting(t *testing.T) {
+	q := cafs.NewQuotaStore(cafs.NewMapstore())
+
+	a, err := q.Put(cafs.NewMemdir("/a",
+		cafs.NewMemfileBytes("shared.csv", []byte("0123456789")),
+		cafs.NewMemfileBytes("a.csv", []byte("aaaaa")),
+		cafs.NewMemfileBytes("copy.csv", []byte("0123456789")),
+	), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Usage() != 15 {
+		t.Errorf("expected duplicate files within a root to count once. usage: %d", q.Usage())
+	}
+
+	b, err := q.Put(cafs.NewMemdir("/b",
+		cafs.NewMemfileBytes("shared.csv", []byte("0123456789")),
+		cafs.NewMemfileBytes("b.csv", []byte("bbb")),
+	), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Usage() != 18 {
+		t.Errorf("expected shared content to count once. usage: %d", q.Usage())
+	}
+
+	u, err := q.RootUsage(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Bytes != 25 || u.Unique != 5 {
+		t.Errorf("root a usage mismatch. expected: {25 5}, got: %v", u)
+	}
+
+	// putting the same content again changes nothing
+	if _, err := q.Put(cafs.NewMemdir("/b",
+		cafs.NewMemfileBytes("shared.csv", []byte("0123456789")),
+		cafs.NewMemfileBytes("b.csv", []byte("bbb")),
+	), false); err != nil {
+		t.Fatal(err)
+	}
+	if q.Usage() != 18 {
+		t.Errorf("expected repeated put not to change usage. usage: %d", q.Usage())
+	}
+
+	if err := q.Delete(a); err != nil {
+		t.Fatal(err)
+	}
+	// MapStore keeps the files of a deleted directory, so they stay counted
+	if q.Usage() != 18 {
+		t.Errorf("expected content the store still has to stay counted. usage: %d", q.Usage())
+	}
+	aCsv, err := cafs.NewMapstore().Put(cafs.NewMemfileBytes("a.csv", []byte("aaaaa")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete(aCsv); err != nil {
+		t.Fatal(err)
+	}
+	if q.Usage() != 13 {
+		t.Errorf("expected deleting unreferenced content to free it. usage: %d", q.Usage())
+	}
+	if u, err = q.RootUsage(b); err != nil || u.Unique != 13 {
+		t.Errorf("expected shared content to become unique to b. got: %v, err: %v", u, err)
+	}
+	if _, err := q.RootUsage(a); !errors.Is(err, cafs.ErrNotFound) {
+		t.Errorf("expected deleted root usage to return ErrNotFound, got: %v", err)
+	}
+}
+
+func TestQuotaStoreLimits(t *testing.T) {
+	ms := cafs.NewMapstore()
+	q := cafs.NewQuotaStore(ms, cafs.OptQuotaMaxBytes(10), cafs.OptQuotaMaxRootBytes(8))
+
+	if _, err := q.Put(cafs.NewMemfileBytes("big.txt", []byte("123456789")), false); !errors.Is(err, cafs.ErrQuotaExceeded) {
+		t.Errorf("expected root over MaxRootBytes to return ErrQuotaExceeded, got: %v", err)
+	}
+
+	first, err := q.Put(cafs.NewMemfileBytes("a.txt", []byte("12345678")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adder, err := q.NewAdder(false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adder.AddFile(cafs.NewMemfileBytes("b.txt", []byte("abc"))); !errors.Is(err, cafs.ErrQuotaExceeded) {
+		t.Errorf("expected AddFile over MaxBytes to return ErrQuotaExceeded, got: %v", err)
+	}
+	// content that's already stored doesn't count against the quota
+	if err := adder.AddFile(cafs.NewMemdir("/dup", cafs.NewMemfileBytes("a.txt", []byte("12345678")))); err != nil {
+		t.Errorf("expected deduplicated content to fit within quota, got: %s", err)
+	}
+
+	// deleting one root doesn't free content another root references
+	if err := q.Delete(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := adder.AddFile(cafs.NewMemfileBytes("b.txt", []byte("abc"))); !errors.Is(err, cafs.ErrQuotaExceeded) {
+		t.Errorf("expected shared content to remain counted after delete, got: %v", err)
+	}
+
+	// existing content can be tracked
+	existing, err := ms.Put(cafs.NewMemfileBytes("c.txt", []byte("cc")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Track(existing); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := q.RootUsage(existing); err != nil || u.Bytes != 2 {
+		t.Errorf("expected tracked root to report usage. got: %v, err: %v", u, err)
+	}
+}
+
+func TestQuotaStoreStreaming(t *testing.T) {
+	q := cafs.NewQuotaStore(cafs.NewMapstore(), cafs.OptQuotaMaxBytes(1024))
+	r := &endlessReader{}
+	if _, err := q.Put(cafs.NewMemfileReader("big.bin", r), false); !errors.Is(err, cafs.ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got: %v", err)
+	}
+	// reading stops once content can't fit
+	if r.n > 64*1024 {
+		t.Errorf("expected put to stop reading after exceeding the quota, read %d bytes", r.n)
+	}
+	if q.Usage() != 0 {
+		t.Errorf("expected failed put not to count toward usage. got: %d", q.Usage())
+	}
+
+	q = cafs.NewQuotaStore(cafs.NewMapstore(), cafs.OptQuotaMaxRootBytes(1024))
+	r = &endlessReader{}
+	if _, err := q.Put(cafs.NewMemfileReader("big.bin", r), false); !errors.Is(err, cafs.ErrQuotaExceeded) {
+		t.Errorf("expected ErrQuotaExceeded, got: %v", err)
+	}
+	if r.n > 64*1024 {
+		t.Errorf("expected put to stop reading after exceeding the root quota, read %d bytes", r.n)
+	}
+}
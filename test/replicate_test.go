@@ -0,0 +1,145 @@
+package test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/qri-io/cafs"
+)
+
+func TestReplicaSet(t *testing.T) {
+	rs, err := cafs.NewReplicaSet(2, cafs.NewMapstore(), cafs.NewMapstore(), cafs.NewMapstore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := EnsureFilestoreBehavior(rs); err != nil {
+		t.Error(err.Error())
+	}
+	if err := EnsureDirectoryBehavior(rs); err != nil {
+		t.Error(err.Error())
+	}
+
+	if _, err := cafs.NewReplicaSet(3, cafs.NewMapstore(), cafs.NewMapstore()); err == nil {
+		t.Errorf("expected error creating a replica set with a quorum larger than the number of stores")
+	}
+}
+
+func TestReplicaSetFallback(t *testing.T) {
+	primary, replica := cafs.NewMapstore(), cafs.NewMapstore()
+	rs, err := cafs.NewReplicaSet(2, primary, replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rs.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if has, _ := replica.Has(key); !has {
+		t.Errorf("expected replica to have key")
+	}
+
+	if err := primary.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Get(key); err != nil {
+		t.Errorf("expected get to fall back to replica, got: %s", err)
+	}
+
+	copied, err := rs.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != 1 {
+		t.Errorf("expected repair to make 1 copy, made: %d", copied)
+	}
+	if has, _ := primary.Has(key); !has {
+		t.Errorf("expected repair to restore key to primary")
+	}
+}
+
+func TestReplicaSetKeyMapping(t *testing.T) {
+	primary := cafs.NewMapstore()
+	replica := cafs.NewMapstore()
+	replica.KeyEncoding = cafs.EncodingCIDv1Base32
+	other := prefixStore{replica, "other"}
+	rs, err := cafs.NewReplicaSet(2, primary, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := rs.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := rs.ReplicaKeys(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0] != key {
+		t.Errorf("expected first replica key to be the primary key. expected: %s, got: %s", key, keys[0])
+	}
+	if !strings.HasPrefix(keys[1], "/other/") {
+		t.Errorf("expected a replica key with the replica's prefix, got: %q", keys[1])
+	}
+	if has, err := other.Has(keys[1]); err != nil || !has {
+		t.Errorf("expected replica to have mapped key %s. has: %t err: %v", keys[1], has, err)
+	}
+
+	// reads fall back to the replica through the mapped key
+	if err := primary.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.Get(key); err != nil {
+		t.Errorf("expected get to fall back to the replica's mapped key, got: %s", err)
+	}
+}
+
+func TestReplicaSetQuorum(t *testing.T) {
+	rs, err := cafs.NewReplicaSet(2, cafs.NewMapstore(), failStore{cafs.NewMapstore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rs.Put(cafs.NewMemfileBytes("a.txt", []byte("a")), false)
+	if err == nil {
+		t.Errorf("expected error when quorum isn't met")
+	}
+	if key == "" {
+		t.Errorf("expected primary key to be returned when quorum isn't met")
+	}
+}
+
+// prefixStore is a MapStore that stores content under keys with a different
+// path prefix, allowing tests to simulate different backends
+type prefixStore struct {
+	*cafs.MapStore
+	prefix string
+}
+
+func (p prefixStore) PathPrefix() string { return p.prefix }
+
+// mapKey converts a key with this store's prefix to the MapStore's prefix
+func (p prefixStore) mapKey(key string) string {
+	return strings.Replace(key, "/"+p.prefix+"/", "/map/", 1)
+}
+
+func (p prefixStore) Put(file cafs.File, pin bool) (string, error) {
+	key, err := p.MapStore.Put(file, pin)
+	if err != nil {
+		return "", err
+	}
+	return strings.Replace(key, "/map/", "/"+p.prefix+"/", 1), nil
+}
+func (p prefixStore) Get(key string) (cafs.File, error) { return p.MapStore.Get(p.mapKey(key)) }
+func (p prefixStore) Has(key string) (bool, error)      { return p.MapStore.Has(p.mapKey(key)) }
+func (p prefixStore) Delete(key string) error           { return p.MapStore.Delete(p.mapKey(key)) }
+
+// failStore is a store that errors on Put
+type failStore struct {
+	cafs.Filestore
+}
+
+func (failStore) Put(file cafs.File, pin bool) (string, error) {
+	return "", errors.New("failStore always fails")
+}
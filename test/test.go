@@ -2,10 +2,14 @@ package test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
+	"github.com/multiformats/go-multihash"
 	"github.com/qri-io/cafs"
 )
 
@@ -45,7 +49,15 @@ func EnsureFilestoreSingleFileBehavior(f cafs.Filestore) error {
 		// return fmt.Errorf("mismatched return value from get: %s != %s", outf.FileName(), string(data))
 	}
 
-	has, err := f.Has("no-match")
+	if _, err := f.Has("no-match"); !errors.Is(err, cafs.ErrInvalidKey) {
+		return fmt.Errorf("Filestore.Has([malformed key]) should return ErrInvalidKey, got: %v", err)
+	}
+
+	missing, err := missingKey(f)
+	if err != nil {
+		return err
+	}
+	has, err := f.Has(missing)
 	if err != nil {
 		return fmt.Errorf("Filestore.Has([nonexistent key]) error: %s", err.Error())
 	}
@@ -61,9 +73,22 @@ func EnsureFilestoreSingleFileBehavior(f cafs.Filestore) error {
 	if !has {
 		return fmt.Errorf("Filestore.Has(%s) should have returned true", key)
 	}
+
+	if p, ok := f.(cafs.Pinner); ok {
+		if err = p.Unpin(key, true); !errors.Is(err, cafs.ErrNotPinned) && !errors.Is(err, cafs.ErrNotSupported) {
+			return fmt.Errorf("Pinner.Unpin(%s) on an unpinned key should return ErrNotPinned, got: %v", key, err)
+		}
+	}
+
 	if err = f.Delete(key); err != nil {
 		return fmt.Errorf("Filestore.Delete(%s) error: %s", key, err.Error())
 	}
+	if has, err = f.Has(key); err != nil {
+		return fmt.Errorf("Filestore.Has(%s) after delete error: %s", key, err.Error())
+	}
+	if has {
+		return fmt.Errorf("Filestore.Has(%s) should return false after delete", key)
+	}
 
 	return nil
 }
@@ -134,3 +159,522 @@ func EnsureFilestoreAdderBehavior(f cafs.Filestore) error {
 
 	return nil
 }
+
+// missingKey creates a well-formed key for content that has never been added
+// to the store
+func missingKey(f cafs.Filestore) (string, error) {
+	mh, err := multihash.Sum([]byte("no-match"), multihash.SHA2_256, -1)
+	if err != nil {
+		return "", fmt.Errorf("error hashing missing key: %s", err.Error())
+	}
+	return cafs.NewKey(f.PathPrefix(), mh).String(), nil
+}
+
+// EnsureHasherBehavior checks that computing keys for files matches the
+// keys the store assigns when adding them, without storing content
+func EnsureHasherBehavior(f cafs.Filestore) error {
+	h, ok := f.(cafs.Hasher)
+	if !ok {
+		return fmt.Errorf("filestore doesn't implement the Hasher interface")
+	}
+
+	newFile := func() cafs.File {
+		return cafs.NewMemfileBytes("hash.txt", []byte("hash me"))
+	}
+	newDir := func() cafs.File {
+		return cafs.NewMemdir("/hash_dir",
+			cafs.NewMemfileBytes("a.txt", []byte("hash a")),
+			cafs.NewMemdir("b",
+				cafs.NewMemfileBytes("c.txt", []byte("hash c")),
+			),
+		)
+	}
+
+	for _, newFn := range []func() cafs.File{newFile, newDir} {
+		key, nodes, err := cafs.HashFile(h, newFn())
+		if err != nil {
+			return fmt.Errorf("HashFile error: %s", err.Error())
+		}
+		if len(nodes) == 0 {
+			return fmt.Errorf("HashFile should report nodes")
+		}
+
+		has, err := f.Has(key)
+		if err != nil {
+			return fmt.Errorf("Filestore.Has(%s) error: %s", key, err.Error())
+		}
+		if has {
+			return fmt.Errorf("HashFile shouldn't store content, but store has key: %s", key)
+		}
+
+		putKey, err := f.Put(newFn(), false)
+		if err != nil {
+			return fmt.Errorf("Filestore.Put error: %s", err.Error())
+		}
+		if key != putKey {
+			return fmt.Errorf("HashFile key mismatch. Put returned: %s, HashFile returned: %s", putKey, key)
+		}
+		if err = f.Delete(putKey); err != nil {
+			return fmt.Errorf("Filestore.Delete(%s) error: %s", putKey, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// EnsureSubscriberBehavior checks that stores emit events for changes
+func EnsureSubscriberBehavior(f cafs.Filestore) error {
+	s, ok := f.(cafs.Subscriber)
+	if !ok {
+		return fmt.Errorf("filestore doesn't implement the Subscriber interface")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := s.Subscribe(ctx, 10)
+
+	key, err := f.Put(cafs.NewMemfileBytes("event.txt", []byte("event")), false)
+	if err != nil {
+		return fmt.Errorf("Filestore.Put error: %s", err.Error())
+	}
+	if err := f.Delete(key); err != nil {
+		return fmt.Errorf("Filestore.Delete(%s) error: %s", key, err.Error())
+	}
+
+	for _, expect := range []cafs.EventType{cafs.EventAdd, cafs.EventDelete} {
+		if err := nextEvent(events, expect, key); err != nil {
+			return err
+		}
+	}
+
+	cancel()
+	for range events {
+		// subscriptions must close when their context is done
+	}
+	return nil
+}
+
+// nextEvent reads events until one of type t arrives, checking its key
+func nextEvent(events <-chan cafs.Event, t cafs.EventType, key string) error {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != t {
+				continue
+			}
+			if e.Key != key {
+				return fmt.Errorf("%s event key mismatch. expected: %s, got: %s", t, key, e.Key)
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for %s event", t)
+		}
+	}
+}
+
+// EnsureBatcherBehavior checks batch operations, using generic fallbacks for
+// stores that don't implement Batcher
+func EnsureBatcherBehavior(f cafs.Filestore) error {
+	files := []cafs.File{
+		cafs.NewMemfileBytes("batch_a.txt", []byte("batch a")),
+		cafs.NewMemfileBytes("batch_b.txt", []byte("batch b")),
+	}
+	keys, err := cafs.PutMany(f, files, false)
+	if err != nil {
+		return fmt.Errorf("PutMany error: %s", err.Error())
+	}
+	if len(keys) != len(files) {
+		return fmt.Errorf("PutMany should return a key for each file. expected %d, got: %d", len(files), len(keys))
+	}
+
+	missing, err := missingKey(f)
+	if err != nil {
+		return err
+	}
+	exists, err := cafs.HasMany(f, append(keys, missing))
+	if err != nil {
+		return fmt.Errorf("HasMany error: %s", err.Error())
+	}
+	if !exists[0] || !exists[1] || exists[2] {
+		return fmt.Errorf("HasMany mismatch. expected: [true true false], got: %v", exists)
+	}
+
+	got, err := cafs.GetMany(f, keys)
+	if err != nil {
+		return fmt.Errorf("GetMany error: %s", err.Error())
+	}
+	for i, file := range got {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return fmt.Errorf("error reading file %d: %s", i, err.Error())
+		}
+		if expect := []string{"batch a", "batch b"}[i]; string(data) != expect {
+			return fmt.Errorf("GetMany file %d mismatch. expected: %q, got: %q", i, expect, string(data))
+		}
+	}
+
+	_, err = cafs.HasMany(f, []string{keys[0], "invalid"})
+	batchErr := &cafs.BatchError{}
+	if !errors.As(err, &batchErr) {
+		return fmt.Errorf("expected HasMany with an invalid key to return a *BatchError, got: %v", err)
+	}
+	if batchErr.Errs[0] != nil || !errors.Is(batchErr.Errs[1], cafs.ErrInvalidKey) {
+		return fmt.Errorf("expected BatchError to report ErrInvalidKey for the second key only, got: %v", batchErr.Errs)
+	}
+
+	if err := cafs.DeleteMany(f, keys); err != nil {
+		return fmt.Errorf("DeleteMany error: %s", err.Error())
+	}
+	return nil
+}
+
+// EnsurePinTrackerBehavior checks pins are reported accurately as content is
+// pinned, unpinned & updated
+func EnsurePinTrackerBehavior(f cafs.Filestore) error {
+	p, ok := f.(cafs.PinTracker)
+	if !ok {
+		return fmt.Errorf("filestore doesn't implement the PinTracker interface")
+	}
+
+	// adding a file on its own gives the key it has within a directory
+	child, err := f.Put(cafs.NewMemfileBytes("pinned.txt", []byte("pinned child")), false)
+	if err != nil {
+		return fmt.Errorf("Filestore.Put error: %s", err.Error())
+	}
+	dir, err := f.Put(cafs.NewMemdir("/pin_dir",
+		cafs.NewMemfileBytes("pinned.txt", []byte("pinned child")),
+	), false)
+	if err != nil {
+		return fmt.Errorf("Filestore.Put error: %s", err.Error())
+	}
+	next, err := f.Put(cafs.NewMemdir("/pin_dir",
+		cafs.NewMemfileBytes("pinned.txt", []byte("pinned child")),
+		cafs.NewMemfileBytes("next.txt", []byte("next version")),
+	), false)
+	if err != nil {
+		return fmt.Errorf("Filestore.Put error: %s", err.Error())
+	}
+
+	expectPin := func(key string, expect cafs.PinKind) error {
+		kind, pinned, err := p.IsPinned(key)
+		if err != nil {
+			return fmt.Errorf("PinTracker.IsPinned(%s) error: %s", key, err.Error())
+		}
+		if pinned != (expect != 0) || kind != expect {
+			return fmt.Errorf("PinTracker.IsPinned(%s) mismatch. expected: %s, got: %s (pinned: %t)", key, expect, kind, pinned)
+		}
+
+		listed, err := p.ListPins(cafs.PinAny)
+		if err != nil {
+			return fmt.Errorf("PinTracker.ListPins error: %s", err.Error())
+		}
+		kind = 0
+		for _, pin := range listed {
+			if pin.Key == key {
+				if kind != 0 {
+					return fmt.Errorf("PinTracker.ListPins listed %s more than once", key)
+				}
+				kind = pin.Kind
+			}
+		}
+		if kind != expect {
+			return fmt.Errorf("PinTracker.ListPins mismatch for %s. expected: %s, got: %s", key, expect, kind)
+		}
+		return nil
+	}
+
+	for _, key := range []string{child, dir, next} {
+		if err := expectPin(key, 0); err != nil {
+			return err
+		}
+	}
+
+	if err := p.Pin(dir, true); err != nil {
+		return fmt.Errorf("Pinner.Pin(%s) error: %s", dir, err.Error())
+	}
+	if err := expectPin(dir, cafs.PinRecursive); err != nil {
+		return err
+	}
+	if err := expectPin(child, cafs.PinIndirect); err != nil {
+		return err
+	}
+	indirect, err := p.ListPins(cafs.PinIndirect)
+	if err != nil {
+		return fmt.Errorf("PinTracker.ListPins error: %s", err.Error())
+	}
+	for _, pin := range indirect {
+		if pin.Kind != cafs.PinIndirect {
+			return fmt.Errorf("PinTracker.ListPins(%s) returned a %s pin", cafs.PinIndirect, pin.Kind)
+		}
+	}
+
+	if err := p.Pin(child, false); err != nil {
+		return fmt.Errorf("Pinner.Pin(%s) error: %s", child, err.Error())
+	}
+	if err := expectPin(child, cafs.PinDirect); err != nil {
+		return err
+	}
+	if err := p.Unpin(child, false); err != nil {
+		return fmt.Errorf("Pinner.Unpin(%s) error: %s", child, err.Error())
+	}
+	if err := expectPin(child, cafs.PinIndirect); err != nil {
+		return err
+	}
+
+	if err := p.PinUpdate(dir, next); err != nil {
+		return fmt.Errorf("PinTracker.PinUpdate error: %s", err.Error())
+	}
+	if err := expectPin(dir, 0); err != nil {
+		return err
+	}
+	if err := expectPin(next, cafs.PinRecursive); err != nil {
+		return err
+	}
+	if err := expectPin(child, cafs.PinIndirect); err != nil {
+		return err
+	}
+	if err := p.PinUpdate(dir, next); !errors.Is(err, cafs.ErrNotPinned) {
+		return fmt.Errorf("PinTracker.PinUpdate from an unpinned key should return ErrNotPinned, got: %v", err)
+	}
+
+	if err := p.Unpin(next, true); err != nil {
+		return fmt.Errorf("Pinner.Unpin(%s) error: %s", next, err.Error())
+	}
+	for _, key := range []string{child, dir, next} {
+		if err := expectPin(key, 0); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{child, dir, next} {
+		if err := f.Delete(key); err != nil {
+			return fmt.Errorf("Filestore.Delete(%s) error: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// EnsureReferencerBehavior checks refs are updated with compare-and-swap &
+// record their history
+func EnsureReferencerBehavior(f cafs.Filestore) error {
+	r, ok := f.(cafs.Referencer)
+	if !ok {
+		return fmt.Errorf("filestore doesn't implement the Referencer interface")
+	}
+
+	a, err := f.Put(cafs.NewMemfileBytes("ref_a.txt", []byte("ref a")), false)
+	if err != nil {
+		return fmt.Errorf("Filestore.Put error: %s", err.Error())
+	}
+	b, err := f.Put(cafs.NewMemfileBytes("ref_b.txt", []byte("ref b")), false)
+	if err != nil {
+		return fmt.Errorf("Filestore.Put error: %s", err.Error())
+	}
+
+	name := "refs/test/dataset"
+	if _, err := r.Ref(name); !errors.Is(err, cafs.ErrNotFound) {
+		return fmt.Errorf("Referencer.Ref of a missing ref should return ErrNotFound, got: %v", err)
+	}
+	for _, invalid := range []string{"", "/refs/test", "refs//test", "refs/../test", "refs/a test"} {
+		if err := r.UpdateRef(invalid, "", a); !errors.Is(err, cafs.ErrInvalidRef) {
+			return fmt.Errorf("Referencer.UpdateRef(%q) should return ErrInvalidRef, got: %v", invalid, err)
+		}
+	}
+	if err := r.UpdateRef(name, "", "/nope/QmcbyjMMT5fFtoiWRJiwV8xoiRWJpSRwC6qCFMqp7EXD4Q"); !errors.Is(err, cafs.ErrInvalidKey) {
+		return fmt.Errorf("Referencer.UpdateRef to another store's key should return ErrInvalidKey, got: %v", err)
+	}
+
+	if err := r.UpdateRef(name, "", a); err != nil {
+		return fmt.Errorf("Referencer.UpdateRef error: %s", err.Error())
+	}
+	if err := r.UpdateRef(name, "", b); !errors.Is(err, cafs.ErrRefConflict) {
+		return fmt.Errorf("creating a ref that exists should return ErrRefConflict, got: %v", err)
+	}
+	if err := r.UpdateRef(name, b, a); !errors.Is(err, cafs.ErrRefConflict) {
+		return fmt.Errorf("updating a ref from the wrong key should return ErrRefConflict, got: %v", err)
+	}
+	if err := r.UpdateRef(name, a, b); err != nil {
+		return fmt.Errorf("Referencer.UpdateRef error: %s", err.Error())
+	}
+	if key, err := r.Ref(name); err != nil || key != b {
+		return fmt.Errorf("Referencer.Ref mismatch. expected: %s, got: %s, err: %v", b, key, err)
+	}
+
+	other := "refs/other/dataset"
+	if err := r.UpdateRef(other, "", a); err != nil {
+		return fmt.Errorf("Referencer.UpdateRef error: %s", err.Error())
+	}
+	refs, err := r.ListRefs("refs/test/")
+	if err != nil {
+		return fmt.Errorf("Referencer.ListRefs error: %s", err.Error())
+	}
+	if len(refs) != 1 || refs[0].Name != name || refs[0].Key != b {
+		return fmt.Errorf("Referencer.ListRefs mismatch. expected: [{%s %s}], got: %v", name, b, refs)
+	}
+
+	if err := r.UpdateRef(name, b, ""); err != nil {
+		return fmt.Errorf("deleting a ref error: %s", err.Error())
+	}
+	if _, err := r.Ref(name); !errors.Is(err, cafs.ErrNotFound) {
+		return fmt.Errorf("Referencer.Ref of a deleted ref should return ErrNotFound, got: %v", err)
+	}
+
+	history, err := r.RefHistory(name)
+	if err != nil {
+		return fmt.Errorf("Referencer.RefHistory error: %s", err.Error())
+	}
+	expect := []cafs.RefUpdate{
+		{Name: name, Old: b, New: ""},
+		{Name: name, Old: a, New: b},
+		{Name: name, Old: "", New: a},
+	}
+	if len(history) != len(expect) {
+		return fmt.Errorf("Referencer.RefHistory length mismatch. expected: %d, got: %d", len(expect), len(history))
+	}
+	for i, u := range history {
+		if u.Name != expect[i].Name || u.Old != expect[i].Old || u.New != expect[i].New {
+			return fmt.Errorf("Referencer.RefHistory entry %d mismatch. expected: %v, got: %v", i, expect[i], u)
+		}
+		if i > 0 && u.Time.After(history[i-1].Time) {
+			return fmt.Errorf("Referencer.RefHistory should be newest first")
+		}
+	}
+
+	if err := r.UpdateRef(other, a, ""); err != nil {
+		return fmt.Errorf("deleting a ref error: %s", err.Error())
+	}
+	for _, key := range []string{a, b} {
+		if err := f.Delete(key); err != nil {
+			return fmt.Errorf("Filestore.Delete(%s) error: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// EnsureNameSystemBehavior checks names can be published & resolved with
+// keys the store generates
+func EnsureNameSystemBehavior(f cafs.Filestore) error {
+	ns, ok := f.(cafs.NameSystem)
+	if !ok {
+		return fmt.Errorf("filestore doesn't implement the NameSystem interface")
+	}
+	ctx := context.Background()
+
+	key, err := ns.GenerateKey(ctx, "test_name")
+	if err != nil {
+		return fmt.Errorf("NameSystem.GenerateKey error: %s", err.Error())
+	}
+	if key.Name != "test_name" || key.ID == "" {
+		return fmt.Errorf("NameSystem.GenerateKey returned an invalid key: %v", key)
+	}
+	if _, err := ns.GenerateKey(ctx, "test_name"); !errors.Is(err, cafs.ErrKeyExists) {
+		return fmt.Errorf("generating a key that exists should return ErrKeyExists, got: %v", err)
+	}
+	if _, err := ns.GenerateKey(ctx, "self"); !errors.Is(err, cafs.ErrKeyExists) {
+		return fmt.Errorf("generating a key named self should return ErrKeyExists, got: %v", err)
+	}
+
+	keys, err := ns.ListKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("NameSystem.ListKeys error: %s", err.Error())
+	}
+	found := map[string]string{}
+	for _, k := range keys {
+		found[k.Name] = k.ID
+	}
+	if found["self"] == "" {
+		return fmt.Errorf("NameSystem.ListKeys should include a self key, got: %v", keys)
+	}
+	if found["test_name"] != key.ID {
+		return fmt.Errorf("NameSystem.ListKeys mismatch for test_name. expected: %s, got: %s", key.ID, found["test_name"])
+	}
+
+	if _, err := ns.Resolve(ctx, key.ID); !errors.Is(err, cafs.ErrNotFound) {
+		return fmt.Errorf("resolving an unpublished name should return ErrNotFound, got: %v", err)
+	}
+
+	for _, data := range []string{"name v1", "name v2"} {
+		content, err := f.Put(cafs.NewMemfileBytes("name.txt", []byte(data)), false)
+		if err != nil {
+			return fmt.Errorf("Filestore.Put error: %s", err.Error())
+		}
+		name, err := ns.Publish(ctx, "test_name", content, time.Hour, time.Minute)
+		if err != nil {
+			return fmt.Errorf("NameSystem.Publish error: %s", err.Error())
+		}
+		if name != key.ID {
+			return fmt.Errorf("NameSystem.Publish should return the key's name. expected: %s, got: %s", key.ID, name)
+		}
+		resolved, err := ns.Resolve(ctx, name)
+		if err != nil {
+			return fmt.Errorf("NameSystem.Resolve(%s) error: %s", name, err.Error())
+		}
+		if resolved != content {
+			return fmt.Errorf("NameSystem.Resolve(%s) mismatch. expected: %s, got: %s", name, content, resolved)
+		}
+		if err := f.Delete(content); err != nil {
+			return fmt.Errorf("Filestore.Delete(%s) error: %s", content, err.Error())
+		}
+	}
+
+	missing, err := missingKey(f)
+	if err != nil {
+		return err
+	}
+	if _, err := ns.Publish(ctx, "no_such_key", missing, 0, 0); !errors.Is(err, cafs.ErrNotFound) {
+		return fmt.Errorf("publishing with a missing key should return ErrNotFound, got: %v", err)
+	}
+	return nil
+}
+
+// EnsurePubSubBehavior checks a store receives messages it publishes to
+// topics it's subscribed to
+func EnsurePubSubBehavior(f cafs.Filestore) error {
+	ps, ok := f.(cafs.PubSub)
+	if !ok {
+		return fmt.Errorf("filestore doesn't implement the PubSub interface")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := ps.PubSubSubscribe(ctx, ""); err == nil {
+		return fmt.Errorf("subscribing to an empty topic should error")
+	}
+	msgs, err := ps.PubSubSubscribe(ctx, "test_topic")
+	if err != nil {
+		return fmt.Errorf("PubSub.PubSubSubscribe error: %s", err.Error())
+	}
+	topics, err := ps.PubSubTopics(ctx)
+	if err != nil {
+		return fmt.Errorf("PubSub.PubSubTopics error: %s", err.Error())
+	}
+	found := false
+	for _, t := range topics {
+		found = found || t == "test_topic"
+	}
+	if !found {
+		return fmt.Errorf("PubSub.PubSubTopics should list subscribed topics, got: %v", topics)
+	}
+
+	if err := ps.PubSubPublish(ctx, "other_topic", []byte("ignored")); err != nil {
+		return fmt.Errorf("PubSub.PubSubPublish error: %s", err.Error())
+	}
+	if err := ps.PubSubPublish(ctx, "test_topic", []byte("hello")); err != nil {
+		return fmt.Errorf("PubSub.PubSubPublish error: %s", err.Error())
+	}
+	select {
+	case msg := <-msgs:
+		if msg.Topic != "test_topic" || string(msg.Data) != "hello" {
+			return fmt.Errorf("message mismatch. expected hello on test_topic, got: %q on %s", string(msg.Data), msg.Topic)
+		}
+	case <-time.After(time.Second):
+		return fmt.Errorf("timed out waiting for message")
+	}
+
+	cancel()
+	for range msgs {
+		// subscriptions must close when their context is done
+	}
+	return nil
+}
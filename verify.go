@@ -0,0 +1,122 @@
+package cafs
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/multiformats/go-multihash"
+)
+
+// IntegrityError is returned when content doesn't hash to the key it was
+// requested by
+type IntegrityError struct {
+	Key      string
+	Expected multihash.Multihash
+	Got      multihash.Multihash
+}
+
+// Error implements the error interface
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%s: %s expected hash %s, got %s", ErrIntegrity, e.Key, e.Expected.B58String(), e.Got.B58String())
+}
+
+// Is makes IntegrityError match ErrIntegrity when compared with errors.Is
+func (e *IntegrityError) Is(target error) bool { return target == ErrIntegrity }
+
+// VerifyingReader recomputes the multihash of data as it's read, checking it
+// against the multihash of a key when the underlying reader is exhausted.
+// Verification only makes sense for keys that hash raw file bytes, as
+// MapStore keys do. IPFS keys hash a merkle-dag encoding, & ipfs itself
+// verifies blocks as they are fetched
+type VerifyingReader struct {
+	r        io.Reader
+	key      string
+	expected multihash.Multihash
+	code     uint64
+	length   int
+	h        hash.Hash
+	err      error
+}
+
+// NewVerifyingReader wraps r in a reader that checks data read hashes to key.
+// A final read will return an *IntegrityError in place of io.EOF if the data
+// doesn't match
+func NewVerifyingReader(r io.Reader, key Key) (*VerifyingReader, error) {
+	dec, err := multihash.Decode(key.Multihash)
+	if err != nil {
+		return nil, NewKeyError("verify", key.String(), fmt.Errorf("%w: %s", ErrInvalidKey, err))
+	}
+	h, err := NewHash(dec.Code)
+	if err != nil {
+		return nil, NewKeyError("verify", key.String(), err)
+	}
+	return &VerifyingReader{
+		r:        r,
+		key:      key.String(),
+		expected: key.Multihash,
+		code:     dec.Code,
+		length:   dec.Length,
+		h:        h,
+	}, nil
+}
+
+// Read implements the io.Reader interface
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		if verr := v.verify(); verr != nil {
+			v.err = verr
+			return n, verr
+		}
+		v.err = io.EOF
+	}
+	return n, err
+}
+
+func (v *VerifyingReader) verify() error {
+	digest := v.h.Sum(nil)
+	if v.length >= 0 && v.length < len(digest) {
+		digest = digest[:v.length]
+	}
+	// keys may use hash functions registered with RegisterHash, which
+	// multihash.Encode rejects
+	got := encodeMultihash(digest, v.code)
+	if !bytes.Equal(got, v.expected) {
+		return &IntegrityError{Key: v.key, Expected: v.expected, Got: got}
+	}
+	return nil
+}
+
+// verifiedFile is a file that is verified as it's read
+type verifiedFile struct {
+	File
+	r io.Reader
+}
+
+// Read reads from the verifying reader
+func (f verifiedFile) Read(p []byte) (int, error) {
+	return f.r.Read(p)
+}
+
+// VerifyFile wraps a file in a reader that checks the file contents hash to
+// key. Directories are returned unmodified
+func VerifyFile(f File, key string) (File, error) {
+	if f.IsDirectory() {
+		return f, nil
+	}
+	k, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewVerifyingReader(f, k)
+	if err != nil {
+		return nil, err
+	}
+	return verifiedFile{File: f, r: r}, nil
+}
@@ -0,0 +1,110 @@
+package cafs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"testing"
+
+	"github.com/multiformats/go-multihash"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	data := []byte("hello world")
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey("map", mh)
+
+	r, err := NewVerifyingReader(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Errorf("unexpected error reading matching data: %s", err.Error())
+	}
+	if !bytes.Equal(data, got) {
+		t.Errorf("data mismatch. expected: %s, got: %s", data, got)
+	}
+
+	r, err = NewVerifyingReader(bytes.NewReader([]byte("goodbye world")), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("expected ErrIntegrity reading mismatched data, got: %v", err)
+	}
+	var ie *IntegrityError
+	if !errors.As(err, &ie) {
+		t.Fatalf("expected error to be an *IntegrityError")
+	}
+	if ie.Key != key.String() {
+		t.Errorf("key mismatch. expected: %s, got: %s", key.String(), ie.Key)
+	}
+}
+
+func TestVerifyingReaderRegisteredHash(t *testing.T) {
+	// stand in for a real hash function the multihash package doesn't know
+	const code = 0x300002
+	RegisterHash(code, func() hash.Hash { return sha256.New() })
+	defer func() {
+		hashesLk.Lock()
+		delete(hashes, code)
+		hashesLk.Unlock()
+	}()
+
+	data := []byte("hello world")
+	mh, err := Sum(data, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseKey(NewKey("map", mh).String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewVerifyingReader(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Errorf("unexpected error reading matching data: %s", err)
+	}
+
+	r, err = NewVerifyingReader(bytes.NewReader([]byte("goodbye world")), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("expected ErrIntegrity reading mismatched data, got: %v", err)
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	data := []byte("hello world")
+	mh, err := multihash.Sum(data, multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := NewKey("map", mh).String()
+
+	f, err := VerifyFile(NewMemfileBytes("hello.txt", []byte("goodbye")), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.FileName() != "hello.txt" {
+		t.Errorf("filename mismatch. expected: hello.txt, got: %s", f.FileName())
+	}
+	if _, err := ioutil.ReadAll(f); !errors.Is(err, ErrIntegrity) {
+		t.Errorf("expected ErrIntegrity, got: %v", err)
+	}
+
+	if _, err := VerifyFile(NewMemfileBytes("hello.txt", data), "bad-key"); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got: %v", err)
+	}
+}
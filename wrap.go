@@ -0,0 +1,188 @@
+package cafs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// helpers for Filestores that wrap other Filestores
+
+// fetch calls Fetch on fs if it implements Fetcher
+func fetch(fs Filestore, source Source, key string) (File, error) {
+	f, ok := fs.(Fetcher)
+	if !ok {
+		return nil, NewKeyError("fetch", key, ErrNotSupported)
+	}
+	return f.Fetch(source, key)
+}
+
+// pin calls Pin on fs if it implements Pinner
+func pin(fs Filestore, key string, recursive bool) error {
+	p, ok := fs.(Pinner)
+	if !ok {
+		return NewKeyError("pin", key, ErrNotSupported)
+	}
+	return p.Pin(key, recursive)
+}
+
+// unpin calls Unpin on fs if it implements Pinner
+func unpin(fs Filestore, key string, recursive bool) error {
+	p, ok := fs.(Pinner)
+	if !ok {
+		return NewKeyError("unpin", key, ErrNotSupported)
+	}
+	return p.Unpin(key, recursive)
+}
+
+// closeAll closes stores, returning the first error
+func closeAll(stores ...Filestore) error {
+	errs := make([]error, len(stores))
+	for i, s := range stores {
+		errs[i] = Close(s)
+	}
+	return firstError(errs)
+}
+
+// countingFile tallies bytes read from a file and all of its children
+type countingFile struct {
+	File
+	n *int64
+}
+
+// newCountingFile wraps f, adding bytes read from it to n
+func newCountingFile(f File, n *int64) File {
+	return countingFile{File: f, n: n}
+}
+
+func (f countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	atomic.AddInt64(f.n, int64(n))
+	return n, err
+}
+
+func (f countingFile) NextFile() (File, error) {
+	next, err := f.File.NextFile()
+	if err != nil {
+		return nil, err
+	}
+	return countingFile{File: next, n: f.n}, nil
+}
+
+// reservingFile calls reserve with the size of each read from a file & all of
+// its children before returning data, failing the read if reserve errors.
+// Wrapped stores stop reading at the first failed read, so limits are
+// enforced while content streams, without buffering it
+type reservingFile struct {
+	File
+	reserve func(n int64) error
+}
+
+// newReservingFile wraps f, reserving bytes as they're read
+func newReservingFile(f File, reserve func(n int64) error) File {
+	return reservingFile{File: f, reserve: reserve}
+}
+
+func (f reservingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	if n > 0 {
+		if rerr := f.reserve(int64(n)); rerr != nil {
+			return 0, rerr
+		}
+	}
+	return n, err
+}
+
+func (f reservingFile) NextFile() (File, error) {
+	next, err := f.File.NextFile()
+	if err != nil {
+		return nil, err
+	}
+	return reservingFile{File: next, reserve: f.reserve}, nil
+}
+
+// fileSnapshot is an in-memory copy of a file tree that can be read any
+// number of times
+type fileSnapshot struct {
+	name     string
+	path     string
+	data     []byte
+	isDir    bool
+	children []*fileSnapshot
+}
+
+// snapshotFile reads a file tree into memory
+func snapshotFile(f File) (*fileSnapshot, error) {
+	s := &fileSnapshot{
+		name:  f.FileName(),
+		path:  f.FullPath(),
+		isDir: f.IsDirectory(),
+	}
+
+	if !s.isDir {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		s.data = data
+		return s, nil
+	}
+
+	for {
+		ch, err := f.NextFile()
+		if err != nil {
+			if err == io.EOF {
+				return s, nil
+			}
+			return nil, err
+		}
+		chs, err := snapshotFile(ch)
+		if err != nil {
+			return nil, err
+		}
+		s.children = append(s.children, chs)
+	}
+}
+
+// File creates a new File from the snapshot
+func (s *fileSnapshot) File() File {
+	if !s.isDir {
+		return &Memfile{name: s.name, path: s.path, buf: bytes.NewReader(s.data)}
+	}
+	links := make([]File, len(s.children))
+	for i, ch := range s.children {
+		links[i] = ch.File()
+	}
+	return &Memdir{path: s.path, links: links}
+}
+
+// putAdder is an Adder for Filestores that can't do better than calling Put
+// for each added file
+type putAdder struct {
+	put func(f File) (key string, err error)
+	out chan AddedFile
+}
+
+func newPutAdder(put func(f File) (string, error)) *putAdder {
+	return &putAdder{put: put, out: make(chan AddedFile, 9)}
+}
+
+func (a *putAdder) AddFile(f File) error {
+	name := f.FileName()
+	key, err := a.put(f)
+	if err != nil {
+		return err
+	}
+	a.out <- AddedFile{Path: key, Name: name, Hash: key}
+	return nil
+}
+
+func (a *putAdder) Added() chan AddedFile {
+	return a.out
+}
+
+func (a *putAdder) Close() error {
+	close(a.out)
+	return nil
+}